@@ -0,0 +1,10 @@
+package main
+
+// The plugins compiled into pgfisher.  Each one registers itself in its init
+// function.
+import (
+	_ "github.com/johto/pgfisher/internal/plugins/autovacuum"
+	_ "github.com/johto/pgfisher/internal/plugins/errorrate"
+	_ "github.com/johto/pgfisher/internal/plugins/slowquery"
+	_ "github.com/johto/pgfisher/internal/plugins/statements"
+)
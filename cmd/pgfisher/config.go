@@ -0,0 +1,443 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+// Config holds the settings of the tail command.  They can be read from a
+// TOML file, and are overridden by any command-line flags.
+type Config struct {
+	Tail    TailConfig    `toml:"tail"`
+	Metrics MetricsConfig `toml:"metrics"`
+	// The plugins to run, in the order each record is passed to them
+	Plugins []PluginConfig `toml:"plugins"`
+}
+
+type TailConfig struct {
+	LogFilename   string `toml:"log_filename"`
+	Format        string `toml:"format"`
+	LogLinePrefix string `toml:"log_line_prefix"`
+	LogTimezone   string `toml:"log_timezone"`
+	ServerVersion string `toml:"server_version"`
+
+	// How often to check for new data once we've reached the end of a file
+	PollInterval duration `toml:"poll_interval"`
+	// The number of bytes to read before persisting the position in the log
+	// stream into the database
+	PersistIntervalBytes int64 `toml:"persist_interval_bytes"`
+	// The number of newly created files which can be waiting to be read
+	FsnotifyQueueSize int `toml:"fsnotify_queue_size"`
+	// The number of records which can be read ahead of the plugins
+	PipelineQueueSize int `toml:"pipeline_queue_size"`
+	// How long to wait for the plugins and the metrics server to shut down
+	// before exiting
+	ShutdownTimeout duration `toml:"shutdown_timeout"`
+}
+
+type MetricsConfig struct {
+	// Empty if metrics shouldn't be served
+	ListenAddress string `toml:"listen_address"`
+}
+
+type PluginConfig struct {
+	// The name the plugin was registered under.  Defaults to the file name of
+	// Path without the suffix, or of the program run by Command.
+	Name string `toml:"name"`
+	// A Go plugin to load before looking up Name, if any
+	Path string `toml:"path"`
+	// The program and its arguments to run as an external plugin, if any
+	Command []string `toml:"command"`
+
+	Args string `toml:"args"`
+	// Only records matching this expression are passed to the plugin; see
+	// recordFilter for the syntax
+	Filter string `toml:"filter"`
+
+	// The limits of the batches passed to a shared.BatchProcessor.  A batch
+	// is passed to the plugin as soon as any of them is reached.
+	BatchMaxRecords int   `toml:"batch_max_records"`
+	BatchMaxBytes   int64 `toml:"batch_max_bytes"`
+	// How long the first record of a batch can wait for the batch to fill up.
+	// The limit is only checked when new records are read and once per
+	// poll_interval, so a batch can wait for up to this long plus
+	// poll_interval.
+	BatchMaxLatency duration `toml:"batch_max_latency"`
+	// What to do when one of the plugin's functions returns an error; one of
+	// the pluginOnError* constants
+	OnError string `toml:"on_error"`
+	// Passed to the plugin as is
+	Config map[string]interface{} `toml:"config"`
+}
+
+// The values of PluginConfig.OnError.
+const (
+	// exit, without persisting the position in the log stream
+	pluginOnErrorFatal = "fatal"
+	// log the error and carry on
+	pluginOnErrorSkip = "skip"
+	// log the error and don't call the plugin again
+	pluginOnErrorDisable = "disable"
+)
+
+// The defaults of the batch_* settings of plugins.
+const (
+	defaultBatchMaxRecords = 1000
+	defaultBatchMaxBytes   = 1024 * 1024
+	defaultBatchMaxLatency = time.Second
+)
+
+// pluginFlag implements flag.Value for --plugin NAME[=ARGS].  NAME can also
+// be the path of a Go plugin, or "exec:" followed by the command line of an
+// external plugin, quoted as described in splitCommandLine.  The plugins given
+// on the command line replace the ones in the configuration file.
+type pluginFlag struct {
+	plugins *[]PluginConfig
+	set     bool
+}
+
+func (f *pluginFlag) String() string {
+	return ""
+}
+
+func (f *pluginFlag) Set(value string) error {
+	if !f.set {
+		*f.plugins = nil
+		f.set = true
+	}
+	if strings.HasPrefix(value, externalPluginPrefix) {
+		// The command can take arguments of its own.
+		command, err := splitCommandLine(strings.TrimPrefix(value, externalPluginPrefix))
+		if err != nil {
+			return fmt.Errorf("invalid command in %q: %s", value, err)
+		}
+		if len(command) == 0 {
+			return fmt.Errorf("missing command in %q", value)
+		}
+		*f.plugins = append(*f.plugins, PluginConfig{Command: command})
+		return nil
+	}
+
+	name, args, _ := strings.Cut(value, "=")
+	if name == "" {
+		return fmt.Errorf("missing plugin name in %q", value)
+	}
+	pc := PluginConfig{
+		Name: name,
+		Args: args,
+	}
+	if strings.HasSuffix(name, goPluginSuffix) {
+		pc.Name = ""
+		pc.Path = name
+	}
+	*f.plugins = append(*f.plugins, pc)
+	return nil
+}
+
+// Splits a command line into the program and its arguments at whitespace.
+// As in the shell, single quotes preserve everything between them, and double
+// quotes everything but a backslash escaping a double quote or a backslash.
+// Outside quotes, a backslash preserves the character after it.
+func splitCommandLine(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			if quote == '"' && c != '"' && c != '\\' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Tail: TailConfig{
+			LogFilename:          defaultLogFilename,
+			LogLinePrefix:        defaultLogLinePrefix,
+			PollInterval:         duration{time.Second},
+			PersistIntervalBytes: 32 * 1024 * 1024,
+			FsnotifyQueueSize:    32,
+			PipelineQueueSize:    1024,
+			ShutdownTimeout:      duration{10 * time.Second},
+		},
+		Metrics: MetricsConfig{
+			ListenAddress: ":9488",
+		},
+	}
+}
+
+// Returns a FlagSet which stores the settings given on the command line into
+// config, and the path to the configuration file into configPath.
+func newTailFlagSet(name string, config *Config, configPath *string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(configPath, "config", "", "")
+	flags.StringVar(&config.Tail.LogFilename, "log-filename", config.Tail.LogFilename, "")
+	flags.StringVar(&config.Tail.Format, "format", config.Tail.Format, "")
+	flags.StringVar(&config.Tail.LogLinePrefix, "log-line-prefix", config.Tail.LogLinePrefix, "")
+	flags.StringVar(&config.Tail.LogTimezone, "log-timezone", config.Tail.LogTimezone, "")
+	flags.StringVar(&config.Tail.ServerVersion, "server-version", config.Tail.ServerVersion, "")
+	flags.DurationVar(&config.Tail.PollInterval.Duration, "poll-interval", config.Tail.PollInterval.Duration, "")
+	flags.Int64Var(&config.Tail.PersistIntervalBytes, "persist-interval-bytes", config.Tail.PersistIntervalBytes, "")
+	flags.IntVar(&config.Tail.FsnotifyQueueSize, "fsnotify-queue-size", config.Tail.FsnotifyQueueSize, "")
+	flags.IntVar(&config.Tail.PipelineQueueSize, "pipeline-queue-size", config.Tail.PipelineQueueSize, "")
+	flags.DurationVar(&config.Tail.ShutdownTimeout.Duration, "shutdown-timeout", config.Tail.ShutdownTimeout.Duration, "")
+	flags.StringVar(&config.Metrics.ListenAddress, "metrics-address", config.Metrics.ListenAddress, "")
+	flags.Var(&pluginFlag{plugins: &config.Plugins}, "plugin", "")
+	return flags
+}
+
+// parseTailArgs reads the configuration file given with --config, if any,
+// and applies the rest of the command-line flags on top of it.  Returns the
+// configuration, the positional arguments, and the problems found in the
+// configuration file, which should be reported together with the ones
+// applyConfig finds.  err is only set if the command line is invalid.
+// Commands other than tail which take the same settings can register flags of
+// their own with addFlags, which can be nil.
+func parseTailArgs(command string, args []string, addFlags func(flags *flag.FlagSet)) (config *Config, positional []string, configErrs []error, err error) {
+	// The flags are parsed twice: once to find the configuration file, and
+	// once more after it has been read to override its settings.
+	var configPath string
+	flags := newTailFlagSet(command, defaultConfig(), &configPath)
+	if addFlags != nil {
+		addFlags(flags)
+	}
+	err = flags.Parse(args)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	config = defaultConfig()
+	if configPath != "" {
+		configErrs = loadConfigFile(configPath, config)
+	}
+	flags = newTailFlagSet(command, config, &configPath)
+	if addFlags != nil {
+		addFlags(flags)
+	}
+	err = flags.Parse(args)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return config, flags.Args(), configErrs, nil
+}
+
+// Reads the configuration file at path into config.  All problems found are
+// returned.
+func loadConfigFile(path string, config *Config) []error {
+	md, err := toml.DecodeFile(path, config)
+	if err != nil {
+		return []error{fmt.Errorf("could not read configuration file %s: %s", path, err)}
+	}
+	var errs []error
+	for _, key := range md.Undecoded() {
+		// the plugins' own settings are their business
+		if len(key) > 2 && key[0] == "plugins" && key[1] == "config" {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("unknown setting %q in configuration file %s", key.String(), path))
+	}
+	return errs
+}
+
+// applyConfig validates the configuration and sets up the package-level
+// state derived from it.  All problems found are returned.
+func applyConfig(config *Config) []error {
+	var errs []error
+	var err error
+
+	logFilename, err = ParseLogFilenamePattern(config.Tail.LogFilename)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid log_filename: %s", err))
+	}
+	logFormat = config.Tail.Format
+	switch logFormat {
+	case "", logFormatCSV, logFormatJSON, logFormatStderr:
+	default:
+		errs = append(errs, fmt.Errorf("invalid format %q; must be %q, %q or %q", logFormat, logFormatCSV, logFormatJSON, logFormatStderr))
+	}
+	logLinePrefix, err = compileLogLinePrefix(config.Tail.LogLinePrefix)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid log_line_prefix: %s", err))
+	}
+	logTimezone = time.Local
+	if config.Tail.LogTimezone != "" {
+		logTimezone, err = time.LoadLocation(config.Tail.LogTimezone)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid log_timezone: %s", err))
+		}
+	}
+	csvLogSchema = nil
+	if config.Tail.ServerVersion != "" {
+		serverVersion, err := shared.ParseServerVersion(config.Tail.ServerVersion)
+		if err == nil {
+			var schema shared.CSVLogSchema
+			schema, err = shared.CSVLogSchemaForServerVersion(serverVersion)
+			csvLogSchema = &schema
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid server_version: %s", err))
+		}
+	}
+
+	if config.Tail.PollInterval.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("invalid poll_interval %s; must be positive", config.Tail.PollInterval.Duration))
+	}
+	if config.Tail.PersistIntervalBytes <= 0 {
+		errs = append(errs, fmt.Errorf("invalid persist_interval_bytes %d; must be positive", config.Tail.PersistIntervalBytes))
+	}
+	if config.Tail.FsnotifyQueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("invalid fsnotify_queue_size %d; must be positive", config.Tail.FsnotifyQueueSize))
+	}
+	if config.Tail.PipelineQueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("invalid pipeline_queue_size %d; must be positive", config.Tail.PipelineQueueSize))
+	}
+	if config.Tail.ShutdownTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("invalid shutdown_timeout %s; must be positive", config.Tail.ShutdownTimeout.Duration))
+	}
+	if config.Metrics.ListenAddress != "" {
+		_, _, err = net.SplitHostPort(config.Metrics.ListenAddress)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid metrics listen_address: %s", err))
+		}
+	}
+
+	return errs
+}
+
+// applyPluginConfig validates the plugins section of the configuration,
+// loading Go plugins and registering external plugins on the way.  All
+// problems found are returned.
+func applyPluginConfig(config *Config) []error {
+	var errs []error
+	var err error
+
+	if len(config.Plugins) == 0 {
+		errs = append(errs, fmt.Errorf("no plugins configured"))
+	}
+	seenPlugins := make(map[string]bool)
+	for i := range config.Plugins {
+		pc := &config.Plugins[i]
+		if pc.OnError == "" {
+			pc.OnError = pluginOnErrorFatal
+		}
+		if pc.Path != "" && len(pc.Command) > 0 {
+			errs = append(errs, fmt.Errorf("plugin %q has both a path and a command", pc.Name))
+			continue
+		} else if pc.Path != "" {
+			if pc.Name == "" {
+				pc.Name = goPluginName(pc.Path)
+			}
+			err = loadGoPlugin(pc.Name, pc.Path)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		} else if len(pc.Command) > 0 {
+			if pc.Name == "" {
+				pc.Name = externalPluginName(pc.Command)
+			}
+			err = registerExternalPlugin(pc.Name, pc.Command)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		_, ok := shared.LookupPlugin(pc.Name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown plugin %q; available plugins: %s", pc.Name, strings.Join(shared.RegisteredPlugins(), ", ")))
+		}
+		if seenPlugins[pc.Name] {
+			errs = append(errs, fmt.Errorf("plugin %q configured more than once", pc.Name))
+		}
+		seenPlugins[pc.Name] = true
+		if pc.Filter != "" {
+			_, err = compileRecordFilter(pc.Filter)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("plugin %q: %s", pc.Name, err))
+			}
+		}
+		if pc.BatchMaxRecords == 0 {
+			pc.BatchMaxRecords = defaultBatchMaxRecords
+		} else if pc.BatchMaxRecords < 0 {
+			errs = append(errs, fmt.Errorf("invalid batch_max_records %d for plugin %q; must be positive", pc.BatchMaxRecords, pc.Name))
+		}
+		if pc.BatchMaxBytes == 0 {
+			pc.BatchMaxBytes = defaultBatchMaxBytes
+		} else if pc.BatchMaxBytes < 0 {
+			errs = append(errs, fmt.Errorf("invalid batch_max_bytes %d for plugin %q; must be positive", pc.BatchMaxBytes, pc.Name))
+		}
+		if pc.BatchMaxLatency.Duration == 0 {
+			pc.BatchMaxLatency.Duration = defaultBatchMaxLatency
+		} else if pc.BatchMaxLatency.Duration < 0 {
+			errs = append(errs, fmt.Errorf("invalid batch_max_latency %s for plugin %q; must be positive", pc.BatchMaxLatency.Duration, pc.Name))
+		}
+		switch pc.OnError {
+		case pluginOnErrorFatal, pluginOnErrorSkip, pluginOnErrorDisable:
+		default:
+			errs = append(errs, fmt.Errorf("invalid on_error %q for plugin %q; must be %q, %q or %q", pc.OnError, pc.Name, pluginOnErrorFatal, pluginOnErrorSkip, pluginOnErrorDisable))
+		}
+	}
+	return errs
+}
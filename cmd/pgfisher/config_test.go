@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTailArgs(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config string
+		args   []string
+		// the errors expected from the configuration file, as substrings
+		expectedErrs []string
+		// the poll_interval expected if the file could be read
+		expectedPollInterval time.Duration
+	}{
+		{
+			name:                 "valid",
+			config:               "[tail]\npoll_interval = \"5s\"\n[[plugins]]\nname = \"slowquery\"\n[plugins.config]\ntop_n = 5\n",
+			expectedPollInterval: 5 * time.Second,
+		},
+		{
+			name:                 "overridden on the command line",
+			config:               "[tail]\npoll_interval = \"5s\"\n",
+			args:                 []string{"--poll-interval", "2s"},
+			expectedPollInterval: 2 * time.Second,
+		},
+		{
+			// every unknown setting is reported, not only the first one
+			name:                 "unknown settings",
+			config:               "[tail]\npoll_interval = \"5s\"\npoll_intervall = \"5s\"\n[metrics]\nlisten = \":1\"\n",
+			expectedErrs:         []string{`unknown setting "tail.poll_intervall"`, `unknown setting "metrics.listen"`},
+			expectedPollInterval: 5 * time.Second,
+		},
+		{
+			name:         "syntax error",
+			config:       "[tail\n",
+			expectedErrs: []string{"could not read configuration file"},
+		},
+		{
+			name:         "wrong type",
+			config:       "[tail]\npersist_interval_bytes = \"many\"\n",
+			expectedErrs: []string{"could not read configuration file"},
+		},
+	}
+	for _, tc := range testCases {
+		path := filepath.Join(t.TempDir(), "pgfisher.toml")
+		err := os.WriteFile(path, []byte(tc.config), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := append([]string{"--config", path}, tc.args...)
+		args = append(args, "pgfisher.db", "/var/log/postgresql")
+		config, positional, configErrs, err := parseTailArgs("tail", args, nil)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if len(positional) != 2 {
+			t.Errorf("%s: got positional arguments %q", tc.name, positional)
+		}
+		if len(configErrs) != len(tc.expectedErrs) {
+			t.Errorf("%s: got errors %v; expected %q", tc.name, configErrs, tc.expectedErrs)
+			continue
+		}
+		for i, expected := range tc.expectedErrs {
+			if !strings.Contains(configErrs[i].Error(), expected) {
+				t.Errorf("%s: got error %q; expected %q", tc.name, configErrs[i], expected)
+			}
+		}
+		if tc.expectedPollInterval != 0 && config.Tail.PollInterval.Duration != tc.expectedPollInterval {
+			t.Errorf("%s: got poll_interval %s; expected %s", tc.name, config.Tail.PollInterval.Duration, tc.expectedPollInterval)
+		}
+	}
+
+	_, _, configErrs, err := parseTailArgs("tail", []string{"--config", filepath.Join(t.TempDir(), "missing.toml")}, nil)
+	if err != nil || len(configErrs) != 1 {
+		t.Errorf("got %v, %v for a missing configuration file; expected one configuration error", configErrs, err)
+	}
+	_, _, _, err = parseTailArgs("tail", []string{"--no-such-flag"}, nil)
+	if err == nil {
+		t.Errorf("parseTailArgs accepted an unknown flag")
+	}
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected []string
+		// the error expected, as a substring, if any
+		expectedErr string
+	}{
+		{"", nil, ""},
+		{"  \t ", nil, ""},
+		{"analyzer", []string{"analyzer"}, ""},
+		{" /usr/bin/python3  analyzer.py --verbose ", []string{"/usr/bin/python3", "analyzer.py", "--verbose"}, ""},
+		{`'/opt/my plugins/analyze' -x`, []string{"/opt/my plugins/analyze", "-x"}, ""},
+		{`"/opt/my plugins/analyze" -x`, []string{"/opt/my plugins/analyze", "-x"}, ""},
+		{`/opt/my\ plugins/analyze`, []string{"/opt/my plugins/analyze"}, ""},
+		{`--name=a" b "c`, []string{"--name=a b c"}, ""},
+		{`'' ""`, []string{"", ""}, ""},
+		{`'it''s' "say \"hi\"" 'back\slash' "back\slash"`, []string{"its", `say "hi"`, `back\slash`, `back\slash`}, ""},
+		{`'unterminated`, nil, "unterminated ' quote"},
+		{`"unterminated`, nil, `unterminated " quote`},
+		{`trailing\`, nil, "trailing backslash"},
+	}
+	for _, tc := range testCases {
+		got, err := splitCommandLine(tc.input)
+		if tc.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+				t.Errorf("%q: got error %v; expected %q", tc.input, err, tc.expectedErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %s", tc.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%q: got %q; expected %q", tc.input, got, tc.expected)
+		}
+	}
+}
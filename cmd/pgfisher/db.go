@@ -34,10 +34,13 @@ func (db *PGFisherDatabase) InitializeDatabase(pos *shared.LogStreamPosition) {
 	if err != nil {
 		log.Fatalf("could not update database: %s", err)
 	}
-	db.PersistLogStreamPosition(pos)
+	db.PersistLogStreamPosition(pos, nil)
 }
 
-func (db *PGFisherDatabase) PersistLogStreamPosition(pos *shared.LogStreamPosition) {
+// PersistLogStreamPosition writes pos into the database.  If checkpointFunc
+// is not nil, it's called within the same transaction, and if it fails,
+// nothing is written.
+func (db *PGFisherDatabase) PersistLogStreamPosition(pos *shared.LogStreamPosition, checkpointFunc func(tx *bolt.Tx) error) {
 	data, err := json.Marshal(pos)
 	if err != nil {
 		panic(err)
@@ -48,6 +51,12 @@ func (db *PGFisherDatabase) PersistLogStreamPosition(pos *shared.LogStreamPositi
 		if bucket == nil {
 			panic("nil bucket")
 		}
+		if checkpointFunc != nil {
+			err := checkpointFunc(tx)
+			if err != nil {
+				return fmt.Errorf("checkpoint failed: %s", err)
+			}
+		}
 		return bucket.Put([]byte("logStreamPosition"), data)
 	})
 	if err != nil {
@@ -55,6 +64,55 @@ func (db *PGFisherDatabase) PersistLogStreamPosition(pos *shared.LogStreamPositi
 	}
 }
 
+// CheckpointPlugins calls checkpointFunc in a transaction without persisting
+// the position in the log stream, for when the position isn't persisted but
+// the plugins' state should be.
+func (db *PGFisherDatabase) CheckpointPlugins(checkpointFunc func(tx *bolt.Tx) error) {
+	err := db.dbh.Update(func(tx *bolt.Tx) error {
+		err := checkpointFunc(tx)
+		if err != nil {
+			return fmt.Errorf("checkpoint failed: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("could not write to %s: %s", db.dbh.Path(), err)
+	}
+}
+
+// CreatePluginBucket creates the bucket reserved for the plugin called name,
+// unless it already exists, and returns its name.
+func (db *PGFisherDatabase) CreatePluginBucket(name string) []byte {
+	bucketName := pluginBucketName(name)
+	err := db.dbh.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		log.Fatalf("could not create bucket for plugin %q: %s", name, err)
+	}
+	return bucketName
+}
+
+// Returns the name of the bucket reserved for the plugin called name.
+func pluginBucketName(name string) []byte {
+	return []byte("plugin:" + name)
+}
+
+// IsInitialized reports whether InitializeDatabase has been called on the
+// database.
+func (db *PGFisherDatabase) IsInitialized() bool {
+	initialized := false
+	err := db.dbh.View(func(tx *bolt.Tx) error {
+		initialized = tx.Bucket([]byte("pgfisher")) != nil
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("could not read from %s: %s", db.dbh.Path(), err)
+	}
+	return initialized
+}
+
 func (db *PGFisherDatabase) ReadLogStreamPosition() shared.LogStreamPosition {
 	var streamPosition shared.LogStreamPosition
 	err := db.dbh.View(func(tx *bolt.Tx) error {
@@ -78,6 +136,10 @@ func (db *PGFisherDatabase) ReadLogStreamPosition() shared.LogStreamPosition {
 	return streamPosition
 }
 
+func (db *PGFisherDatabase) Close() error {
+	return db.dbh.Close()
+}
+
 func (db *PGFisherDatabase) BoltDBHandle() *bolt.DB {
 	return db.dbh
 }
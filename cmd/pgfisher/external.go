@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The prefix of --plugin values which are commands to run as external
+// plugins.
+const externalPluginPrefix = "exec:"
+
+const (
+	// The maximum number of records sent to an external plugin but not yet
+	// acknowledged.  Process blocks once there are this many.
+	externalPluginMaxUnacked = 10000
+
+	externalPluginMinBackoff = time.Second
+	externalPluginMaxBackoff = time.Minute
+	// How long to wait for acknowledgements before complaining about it.
+	externalPluginAckWarningInterval = time.Minute
+)
+
+// Returns the name a plugin running command is registered under if its
+// configuration doesn't say otherwise.
+func externalPluginName(command []string) string {
+	return filepath.Base(command[0])
+}
+
+// registerExternalPlugin registers a plugin called name which runs command as
+// an external plugin.  See ExternalMessage for the protocol.
+func registerExternalPlugin(name string, command []string) error {
+	if _, ok := shared.LookupPlugin(name); ok {
+		return fmt.Errorf("external plugin %q can't be registered: the name is already in use", name)
+	}
+	shared.RegisterPlugin(name, func(args shared.PluginInitArgs) (shared.Plugin, error) {
+		return newExternalPlugin(command, args)
+	})
+	return nil
+}
+
+type externalPluginRecord struct {
+	seq  uint64
+	line []byte
+}
+
+// externalPlugin implements shared.Plugin by passing the records to a child
+// process.  The child is restarted with an exponential backoff if it exits.
+type externalPlugin struct {
+	name    string
+	command []string
+	// The init message, sent every time the child is started
+	initLine []byte
+
+	restartsTotal prometheus.Counter
+
+	// Held while writing into the child's standard input, so that the
+	// records are always sent in order.
+	writeLock sync.Mutex
+
+	lock sync.Mutex
+	// Closed and replaced whenever ackedSeq changes or the child exits.
+	changed chan struct{}
+	child   *externalPluginChild
+	// Records which haven't been acknowledged by the child, oldest first.
+	unacked  []externalPluginRecord
+	nextSeq  uint64
+	ackedSeq uint64
+	// The errors the child has reported for records since takeFailures was
+	// last called
+	failures []error
+	closing  bool
+
+	// Closed by Close, to wake up the supervisor if it's waiting to restart
+	// the child.
+	closed chan struct{}
+	// Closed once the supervisor has given up on restarting the child.
+	supervisorDone chan struct{}
+}
+
+type externalPluginChild struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// Closed once the child has exited.
+	done chan struct{}
+	err  error
+}
+
+func newExternalPlugin(command []string, args shared.PluginInitArgs) (*externalPlugin, error) {
+	initLine, err := json.Marshal(shared.ExternalMessage{
+		Type:        shared.ExternalMessageInit,
+		Name:        args.Name,
+		Args:        args.Args,
+		Config:      args.Config,
+		LogTimezone: args.LogTimezone.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	restartsTotal := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name:        "pgfisher_external_plugin_restarts_total",
+			Help:        "The number of times an external plugin has been restarted after exiting.",
+			ConstLabels: prometheus.Labels{"plugin": args.Name},
+		},
+	)
+	args.PrometheusRegistry.MustRegister(restartsTotal)
+
+	p := &externalPlugin{
+		name:           args.Name,
+		command:        command,
+		initLine:       append(initLine, '\n'),
+		restartsTotal:  restartsTotal,
+		changed:        make(chan struct{}),
+		closed:         make(chan struct{}),
+		supervisorDone: make(chan struct{}),
+	}
+	// Fail early if the command can't be run at all.
+	child, err := p.startChild()
+	if err != nil {
+		return nil, err
+	}
+	go p.supervisorLoop(child)
+	return p, nil
+}
+
+// Must be called with p.lock held.
+func (p *externalPlugin) notifyChanged() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Starts the child and sends it the init message and any unacknowledged
+// records.
+func (p *externalPlugin) startChild() (*externalPluginChild, error) {
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("could not start external plugin %q: %s", p.name, err)
+	}
+	child := &externalPluginChild{
+		cmd:   cmd,
+		stdin: stdin,
+		done:  make(chan struct{}),
+	}
+	go p.childReaderLoop(child, stdout)
+
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+
+	p.lock.Lock()
+	closing := p.closing
+	if !closing {
+		p.child = child
+	}
+	unacked := p.unacked
+	p.lock.Unlock()
+
+	if closing {
+		// Close has already been called; let the child exit right away.
+		stdin.Close()
+		return child, nil
+	}
+	// If these fail, the child has exited and the reader will notice.
+	_, _ = stdin.Write(p.initLine)
+	for _, r := range unacked {
+		_, _ = stdin.Write(r.line)
+	}
+	return child, nil
+}
+
+// Reads acknowledgements and errors from the child until it exits.  Runs in
+// its own goroutine.
+func (p *externalPlugin) childReaderLoop(child *externalPluginChild, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var msg shared.ExternalMessage
+		err := json.Unmarshal(scanner.Bytes(), &msg)
+		if err == nil && msg.Type != shared.ExternalMessageAck && msg.Type != shared.ExternalMessageError {
+			err = fmt.Errorf("unexpected message type %q", msg.Type)
+		}
+		if err != nil {
+			log.Printf("external plugin %q: invalid message: %s; killing the plugin", p.name, err)
+			child.cmd.Process.Kill()
+			break
+		}
+
+		p.lock.Lock()
+		if msg.Seq > p.ackedSeq && msg.Seq <= p.nextSeq {
+			if msg.Type == shared.ExternalMessageError {
+				p.failures = append(p.failures, errors.New(msg.Error))
+			}
+			p.ackedSeq = msg.Seq
+			n := 0
+			for n < len(p.unacked) && p.unacked[n].seq <= msg.Seq {
+				n++
+			}
+			p.unacked = p.unacked[n:]
+			p.notifyChanged()
+		}
+		p.lock.Unlock()
+	}
+	// Drain the pipe so that the child isn't stuck writing into it.
+	io.Copy(io.Discard, stdout)
+
+	child.err = child.cmd.Wait()
+	p.lock.Lock()
+	close(child.done)
+	p.notifyChanged()
+	p.lock.Unlock()
+}
+
+// Restarts the child whenever it exits, until Close is called.  Runs in its
+// own goroutine.
+func (p *externalPlugin) supervisorLoop(child *externalPluginChild) {
+	defer close(p.supervisorDone)
+
+	backoff := externalPluginMinBackoff
+	for {
+		startTime := time.Now()
+		<-child.done
+
+		p.lock.Lock()
+		closing := p.closing
+		p.child = nil
+		p.lock.Unlock()
+		if closing {
+			return
+		}
+		if child.err == nil {
+			child.err = fmt.Errorf("exited unexpectedly")
+		}
+		if time.Since(startTime) > externalPluginMaxBackoff {
+			backoff = externalPluginMinBackoff
+		}
+
+		for {
+			log.Printf("external plugin %q: %s; restarting in %s", p.name, child.err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-p.closed:
+				return
+			}
+			backoff *= 2
+			if backoff > externalPluginMaxBackoff {
+				backoff = externalPluginMaxBackoff
+			}
+
+			var err error
+			child, err = p.startChild()
+			if err == nil {
+				break
+			}
+			child = &externalPluginChild{err: err}
+		}
+		p.restartsTotal.Inc()
+	}
+}
+
+func (p *externalPlugin) Process(streamPos *shared.LogStreamPosition, record []string) error {
+	// Don't buffer an unbounded number of records while the child is slow or
+	// not running.
+	p.waitUntil(func() bool {
+		return len(p.unacked) < externalPluginMaxUnacked
+	}, "to catch up", 0)
+
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+
+	p.lock.Lock()
+	p.nextSeq++
+	pos := *streamPos
+	line, err := json.Marshal(shared.ExternalMessage{
+		Type:     shared.ExternalMessageRecord,
+		Seq:      p.nextSeq,
+		Position: &pos,
+		Record:   record,
+	})
+	if err != nil {
+		p.nextSeq--
+		p.lock.Unlock()
+		return err
+	}
+	line = append(line, '\n')
+	p.unacked = append(p.unacked, externalPluginRecord{seq: p.nextSeq, line: line})
+	child := p.child
+	p.lock.Unlock()
+
+	if child != nil {
+		// If this fails, the child has exited, and the record will be sent
+		// again once it has been restarted.
+		_, _ = child.stdin.Write(line)
+	}
+	return nil
+}
+
+// waitProcessed implements asyncPlugin.
+func (p *externalPlugin) waitProcessed(timeout time.Duration) bool {
+	return p.waitUntil(func() bool {
+		return len(p.unacked) == 0
+	}, "to acknowledge all records", timeout)
+}
+
+// takeFailures implements asyncPlugin.
+func (p *externalPlugin) takeFailures() []error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	failures := p.failures
+	p.failures = nil
+	return failures
+}
+
+// Close doesn't wait for the records to be acknowledged: pgfisher has already
+// done that before persisting the position for the last time, and any records
+// sent after that are sent again when pgfisher is next started.
+func (p *externalPlugin) Close() error {
+	p.writeLock.Lock()
+	p.lock.Lock()
+	p.closing = true
+	close(p.closed)
+	child := p.child
+	p.lock.Unlock()
+	if child != nil {
+		child.stdin.Close()
+	}
+	p.writeLock.Unlock()
+
+	<-p.supervisorDone
+	if child != nil && child.err != nil {
+		return fmt.Errorf("external plugin exited with an error: %s", child.err)
+	}
+	return nil
+}
+
+// Blocks until cond, which is called with p.lock held, returns true, or until
+// timeout has passed.  Returns false on timeout.  A zero timeout waits
+// forever.
+func (p *externalPlugin) waitUntil(cond func() bool, what string, timeout time.Duration) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	for {
+		p.lock.Lock()
+		if cond() {
+			p.lock.Unlock()
+			return true
+		}
+		changed := p.changed
+		unacked := len(p.unacked)
+		p.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		case <-time.After(externalPluginAckWarningInterval):
+			log.Printf("still waiting for external plugin %q %s; %d records not acknowledged", p.name, what, unacked)
+		}
+	}
+}
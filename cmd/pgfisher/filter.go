@@ -0,0 +1,489 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+// recordFilter is a compiled filter expression, which decides which records
+// are passed to a plugin.  The syntax is:
+//
+//	expr       = and { "or" and }
+//	and        = not { "and" not }
+//	not        = "not" not | "(" expr ")" | comparison
+//	comparison = column op value
+//	           | column [ "not" ] "in" "(" value { "," value } ")"
+//	op         = "=" | "!=" | "<" | "<=" | ">" | ">=" | "~" | "!~"
+//
+// where column is the name of a csvlog column as returned by
+// shared.ColumnName, and value is a string literal in single or double quotes,
+// a number or a bare word.  "~" and "!~" match the column against a regular
+// expression.  The values of error_severity are compared in the order of
+// client_min_messages, where LOG ranks below NOTICE and WARNING, not above
+// ERROR like in log_min_messages.  The values of the integer columns such as
+// process_id and of virtual_transaction_id are compared numerically, and
+// everything else as strings.  The keywords are case insensitive.  For
+// example:
+//
+//	database_name in ('app', 'reporting') and error_severity >= WARNING
+type recordFilter struct {
+	expr string
+	root filterNode
+}
+
+type filterNode interface {
+	match(record []string) bool
+}
+
+type filterAnd struct {
+	left, right filterNode
+}
+
+func (n filterAnd) match(record []string) bool {
+	return n.left.match(record) && n.right.match(record)
+}
+
+type filterOr struct {
+	left, right filterNode
+}
+
+func (n filterOr) match(record []string) bool {
+	return n.left.match(record) || n.right.match(record)
+}
+
+type filterNot struct {
+	operand filterNode
+}
+
+func (n filterNot) match(record []string) bool {
+	return !n.operand.match(record)
+}
+
+type filterComparison struct {
+	attno int
+	op    string
+	value string
+}
+
+func (n filterComparison) match(record []string) bool {
+	cmp := compareFilterValues(n.attno, filterColumn(record, n.attno), n.value)
+	switch n.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	default:
+		panic(n.op)
+	}
+}
+
+type filterRegexp struct {
+	attno  int
+	re     *regexp.Regexp
+	negate bool
+}
+
+func (n filterRegexp) match(record []string) bool {
+	return n.re.MatchString(filterColumn(record, n.attno)) != n.negate
+}
+
+type filterIn struct {
+	attno  int
+	values []string
+	negate bool
+}
+
+func (n filterIn) match(record []string) bool {
+	value := filterColumn(record, n.attno)
+	for _, v := range n.values {
+		if compareFilterValues(n.attno, value, v) == 0 {
+			return !n.negate
+		}
+	}
+	return n.negate
+}
+
+// Columns not present in the record's format are considered empty.
+func filterColumn(record []string, attno int) string {
+	if attno >= len(record) {
+		return ""
+	}
+	return record[attno]
+}
+
+// The columns whose values are compared as integers
+var filterIntegerColumns = map[int]bool{
+	shared.ProcessIDAttno:        true,
+	shared.SessionLineNumAttno:   true,
+	shared.TransactionIDAttno:    true,
+	shared.InternalQueryPosAttno: true,
+	shared.QueryPosAttno:         true,
+	shared.LeaderPidAttno:        true,
+	shared.QueryIDAttno:          true,
+}
+
+func compareFilterValues(attno int, a string, b string) int {
+	switch {
+	case attno == shared.ErrorSeverityAttno:
+		levelA, okA := shared.SeverityLevel(strings.ToUpper(a))
+		levelB, okB := shared.SeverityLevel(strings.ToUpper(b))
+		if okA && okB {
+			return levelA - levelB
+		}
+	case attno == shared.VirtualTransactionIDAttno:
+		// backend ID and local transaction ID, e.g. "3/42"
+		backendA, localA, okA := strings.Cut(a, "/")
+		backendB, localB, okB := strings.Cut(b, "/")
+		if okA && okB {
+			cmp, ok := compareFilterIntegers(backendA, backendB)
+			if ok && cmp == 0 {
+				cmp, ok = compareFilterIntegers(localA, localB)
+			}
+			if ok {
+				return cmp
+			}
+		}
+	case filterIntegerColumns[attno]:
+		cmp, ok := compareFilterIntegers(a, b)
+		if ok {
+			return cmp
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// Returns false if either value isn't an integer.
+func compareFilterIntegers(a string, b string) (int, bool) {
+	numA, errA := strconv.ParseInt(a, 10, 64)
+	numB, errB := strconv.ParseInt(b, 10, 64)
+	if errA != nil || errB != nil {
+		return 0, false
+	}
+	switch {
+	case numA < numB:
+		return -1, true
+	case numA > numB:
+		return 1, true
+	default:
+		return 0, true
+	}
+}
+
+func compileRecordFilter(expr string) (*recordFilter, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %s", expr, err)
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %s", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %s", expr, err)
+	}
+	return &recordFilter{
+		expr: expr,
+		root: root,
+	}, nil
+}
+
+// Match reports whether record passes the filter.
+func (f *recordFilter) Match(record []string) bool {
+	return f.root.match(record)
+}
+
+func (f *recordFilter) String() string {
+	return f.expr
+}
+
+type filterTokenKind int
+
+const (
+	filterTokenWord filterTokenKind = iota
+	filterTokenString
+	filterTokenOperator
+	filterTokenPunctuation
+)
+
+type filterToken struct {
+	kind  filterTokenKind
+	value string
+	// byte offset in the expression
+	pos int
+}
+
+func (t filterToken) String() string {
+	if t.kind == filterTokenString {
+		return fmt.Sprintf("string %q at position %d", t.value, t.pos)
+	}
+	return fmt.Sprintf("%q at position %d", t.value, t.pos)
+}
+
+// Returns true if the token is the keyword keyword.
+func (t filterToken) isKeyword(keyword string) bool {
+	return t.kind == filterTokenWord && strings.EqualFold(t.value, keyword)
+}
+
+func isFilterWordByte(c byte) bool {
+	return c == '_' || c == '.' || c == '-' || c == '+' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, filterToken{filterTokenPunctuation, string(c), i})
+			i++
+
+		case c == '\'' || c == '"':
+			// The quote character is escaped by doubling it, like in SQL.
+			start := i
+			var value strings.Builder
+			i++
+			for {
+				if i >= len(expr) {
+					return nil, fmt.Errorf("unterminated string starting at position %d", start)
+				}
+				if expr[i] == c {
+					if i+1 < len(expr) && expr[i+1] == c {
+						value.WriteByte(c)
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				value.WriteByte(expr[i])
+				i++
+			}
+			tokens = append(tokens, filterToken{filterTokenString, value.String(), start})
+
+		case strings.ContainsRune("=!<>~", rune(c)):
+			start := i
+			op := string(c)
+			if i+1 < len(expr) && (expr[i+1] == '=' || expr[i+1] == '~') {
+				op += string(expr[i+1])
+			}
+			switch op {
+			case "=", "!=", "<", "<=", ">", ">=", "~", "!~":
+			default:
+				return nil, fmt.Errorf("invalid operator %q at position %d", op, start)
+			}
+			i += len(op)
+			tokens = append(tokens, filterToken{filterTokenOperator, op, start})
+
+		case isFilterWordByte(c):
+			start := i
+			for i < len(expr) && isFilterWordByte(expr[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{filterTokenWord, expr[start:i], start})
+
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// Returns the next token without consuming it.  ok is false at the end of the
+// expression.
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *filterParser) next() (filterToken, error) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, fmt.Errorf("unexpected end of filter")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *filterParser) expectPunctuation(value string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if t.kind != filterTokenPunctuation || t.value != value {
+		return fmt.Errorf("expected %q, found %s", value, t)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || !t.isKeyword("or") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || !t.isKeyword("and") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t.isKeyword("not"):
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{operand}, nil
+
+	case t.kind == filterTokenPunctuation && t.value == "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectPunctuation(")")
+		if err != nil {
+			return nil, err
+		}
+		return node, nil
+
+	case t.kind == filterTokenWord:
+		return p.parseComparison(t)
+
+	default:
+		return nil, fmt.Errorf("expected a column name, found %s", t)
+	}
+}
+
+func (p *filterParser) parseComparison(column filterToken) (filterNode, error) {
+	attno, ok := shared.ColumnAttno(strings.ToLower(column.value))
+	if !ok {
+		return nil, fmt.Errorf("unknown column %s", column)
+	}
+
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	negate := false
+	if t.isKeyword("not") {
+		negate = true
+		t, err = p.next()
+		if err != nil {
+			return nil, err
+		}
+		if !t.isKeyword("in") {
+			return nil, fmt.Errorf(`expected "in", found %s`, t)
+		}
+	}
+	if t.isKeyword("in") {
+		return p.parseInList(attno, negate)
+	}
+	if t.kind != filterTokenOperator {
+		return nil, fmt.Errorf("expected an operator, found %s", t)
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if t.value == "~" || t.value == "!~" {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %s", value, err)
+		}
+		return filterRegexp{attno, re, t.value == "!~"}, nil
+	}
+	return filterComparison{attno, t.value, value}, nil
+}
+
+func (p *filterParser) parseInList(attno int, negate bool) (filterNode, error) {
+	err := p.expectPunctuation("(")
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if t.kind == filterTokenPunctuation && t.value == ")" {
+			return filterIn{attno, values, negate}, nil
+		}
+		if t.kind != filterTokenPunctuation || t.value != "," {
+			return nil, fmt.Errorf(`expected "," or ")", found %s`, t)
+		}
+	}
+}
+
+func (p *filterParser) parseValue() (string, error) {
+	t, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if t.kind != filterTokenString && t.kind != filterTokenWord {
+		return "", fmt.Errorf("expected a value, found %s", t)
+	}
+	return t.value, nil
+}
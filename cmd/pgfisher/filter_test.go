@@ -0,0 +1,177 @@
+package main
+
+import (
+	"testing"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+func TestRecordFilterMatch(t *testing.T) {
+	record := shared.LatestCSVLogSchema().NewRecord(map[int]string{
+		shared.DatabaseNameAttno:         "app",
+		shared.ProcessIDAttno:            "1234",
+		shared.VirtualTransactionIDAttno: "3/42",
+		shared.ErrorSeverityAttno:        "ERROR",
+		shared.SQLStateAttno:             "42P01",
+		shared.MessageAttno:              `relation "foo" does not exist`,
+		shared.ApplicationNameAttno:      "007",
+	})
+	logRecord := shared.LatestCSVLogSchema().NewRecord(map[int]string{
+		shared.ErrorSeverityAttno: "LOG",
+	})
+	// the csvlog format of 9.4, without backend_type and later columns
+	schema94, err := shared.CSVLogSchemaForServerVersion(90400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortRecord := schema94.NewRecord(nil)
+
+	testCases := []struct {
+		expr     string
+		record   []string
+		expected bool
+	}{
+		// comparison operators
+		{"database_name = app", record, true},
+		{"database_name = 'app'", record, true},
+		{`database_name = "app"`, record, true},
+		{"database_name != app", record, false},
+		{"database_name < b", record, true},
+		{"database_name <= app", record, true},
+		{"database_name > app", record, false},
+		{"database_name >= app", record, true},
+
+		// regular expressions
+		{"message ~ '^relation .* does not exist$'", record, true},
+		{"message ~ '^column'", record, false},
+		{"message !~ '^column'", record, true},
+		{"message !~ 'foo'", record, false},
+
+		// lists
+		{"database_name in (app, reporting)", record, true},
+		{"database_name in ('other')", record, false},
+		{"database_name not in (app, reporting)", record, false},
+		{"database_name not in (other)", record, true},
+		{"process_id in (1, 01234)", record, true},
+
+		// boolean operators and precedence
+		{"not database_name = app", record, false},
+		{"not not database_name = app", record, true},
+		{"database_name = app and sql_state_code = 42P01", record, true},
+		{"database_name = app and sql_state_code = 42P02", record, false},
+		{"database_name = other or sql_state_code = 42P01", record, true},
+		{"database_name = other or sql_state_code = 42P02", record, false},
+		// "and" binds tighter than "or"
+		{"database_name = app or database_name = x and database_name = y", record, true},
+		{"(database_name = app or database_name = x) and database_name = y", record, false},
+		{"not (database_name = x or database_name = y)", record, true},
+
+		// keywords and column names are case insensitive
+		{"DATABASE_NAME = app AND NOT Process_ID = 1 Or database_name = x", record, true},
+		{"database_name NOT IN (x)", record, true},
+
+		// strings
+		{"message = 'relation \"foo\" does not exist'", record, true},
+		{`message = "relation ""foo"" does not exist"`, record, true},
+		{"message ~ 'RELATION'", record, false},
+
+		// severities are ordered as in client_min_messages
+		{"error_severity >= WARNING", record, true},
+		{"error_severity >= warning", record, true},
+		{"error_severity >= ERROR", record, true},
+		{"error_severity > ERROR", record, false},
+		{"error_severity < FATAL", record, true},
+		{"error_severity >= WARNING", logRecord, false},
+		{"error_severity >= ERROR", logRecord, false},
+		{"error_severity < NOTICE", logRecord, true},
+		{"error_severity > DEBUG1", logRecord, true},
+		{"error_severity in (log, error)", logRecord, true},
+		// unknown severities are compared as strings
+		{"error_severity = BOGUS", record, false},
+
+		// integer columns are compared numerically
+		{"process_id = 1234", record, true},
+		{"process_id = 01234", record, true},
+		{"process_id > 999", record, true},
+		{"process_id < 10000", record, true},
+		{"process_id = 1234.0", record, false},
+		{"process_id = -1", record, false},
+		{"virtual_transaction_id = '3/42'", record, true},
+		{"virtual_transaction_id > '3/9'", record, true},
+		{"virtual_transaction_id < '10/1'", record, true},
+		{"virtual_transaction_id < '3/100'", record, true},
+		// other columns are compared as strings, even if they look like numbers
+		{"application_name = '007'", record, true},
+		{"application_name = 7", record, false},
+		{"application_name < 10", record, true},
+		{"sql_state_code = 42P01", record, true},
+
+		// empty columns and columns not present in the record's format
+		{"user_name = ''", record, true},
+		{"query_id = ''", shortRecord, true},
+		{"backend_type = 'client backend'", shortRecord, false},
+		{"process_id < 1", shortRecord, true},
+	}
+	for _, tc := range testCases {
+		f, err := compileRecordFilter(tc.expr)
+		if err != nil {
+			t.Errorf("compileRecordFilter(%q): %s", tc.expr, err)
+			continue
+		}
+		if f.String() != tc.expr {
+			t.Errorf("String() = %q; expected %q", f.String(), tc.expr)
+		}
+		got := f.Match(tc.record)
+		if got != tc.expected {
+			t.Errorf("filter %q matched %v; expected %v", tc.expr, got, tc.expected)
+		}
+	}
+}
+
+func TestCompileRecordFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"database_name",
+		"database_name =",
+		"no_such_column = x",
+		"database_name == x",
+		"database_name <> x",
+		"database_name = 'app",
+		`database_name = "app`,
+		"database_name = x;",
+		"database_name ~ '('",
+		"database_name in ()",
+		"database_name in (a, b",
+		"database_name in (a b)",
+		"database_name in a",
+		"database_name not = a",
+		"database_name = a and",
+		"database_name = a or or database_name = b",
+		"(database_name = a",
+		"database_name = a)",
+		"database_name = a database_name = b",
+		"= a",
+		"'database_name' = a",
+		"not",
+		"database_name = (a)",
+	} {
+		_, err := compileRecordFilter(expr)
+		if err == nil {
+			t.Errorf("compileRecordFilter(%q) did not return an error", expr)
+		}
+	}
+}
+
+func TestSeverityLevelOrder(t *testing.T) {
+	ordered := []string{"DEBUG5", "DEBUG4", "DEBUG3", "DEBUG2", "DEBUG1", "LOG", "INFO", "NOTICE", "WARNING", "ERROR", "FATAL", "PANIC"}
+	for i := 1; i < len(ordered); i++ {
+		less, ok1 := shared.SeverityLevel(ordered[i-1])
+		more, ok2 := shared.SeverityLevel(ordered[i])
+		if !ok1 || !ok2 || less >= more {
+			t.Errorf("expected %s to rank below %s", ordered[i-1], ordered[i])
+		}
+	}
+	if _, ok := shared.SeverityLevel("error"); ok {
+		t.Errorf("SeverityLevel accepted a lower case severity")
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The components of a timestamp a log_filename conversion can capture.
+type logFilenameField int
+
+const (
+	lfNone logFilenameField = iota
+	lfYear
+	lfCentury
+	lfYearInCentury
+	lfMonth
+	lfMonthName
+	lfDayOfMonth
+	lfDayOfYear
+	lfHour
+	lfHour12
+	lfAMPM
+	lfMinute
+	lfSecond
+	lfEpoch
+)
+
+type logFilenameConversion struct {
+	glob  string
+	re    string
+	field logFilenameField
+}
+
+var (
+	shortMonthNames = []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+	longMonthNames  = []string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}
+
+	twoDigits   = logFilenameConversion{"[0-9][0-9]", `[0-9]{2}`, lfNone}
+	spaceDigits = logFilenameConversion{"[ 0-9][0-9]", `[ 0-9][0-9]`, lfNone}
+)
+
+// Conversions which are shorthands for a sequence of other conversions, as
+// implemented by PostgreSQL's pg_strftime().
+var logFilenameCompositeConversions = map[byte]string{
+	'c': "%a %b %e %T %Y",
+	'D': "%m/%d/%y",
+	'F': "%Y-%m-%d",
+	'R': "%H:%M",
+	'r': "%I:%M:%S %p",
+	'T': "%H:%M:%S",
+	'v': "%e-%b-%Y",
+	'X': "%H:%M:%S",
+	'x': "%m/%d/%y",
+	'+': "%a %b %e %H:%M:%S %Z %Y",
+}
+
+func withField(c logFilenameConversion, field logFilenameField) logFilenameConversion {
+	c.field = field
+	return c
+}
+
+var logFilenameConversions = map[byte]logFilenameConversion{
+	'a': {"[A-Z][a-z][a-z]", `(?:Sun|Mon|Tue|Wed|Thu|Fri|Sat)`, lfNone},
+	'A': {"[A-Z]*", `(?:Sunday|Monday|Tuesday|Wednesday|Thursday|Friday|Saturday)`, lfNone},
+	'b': {"[A-Z][a-z][a-z]", `(` + strings.Join(shortMonthNames, "|") + `)`, lfMonthName},
+	'h': {"[A-Z][a-z][a-z]", `(` + strings.Join(shortMonthNames, "|") + `)`, lfMonthName},
+	'B': {"[A-Z]*", `(` + strings.Join(longMonthNames, "|") + `)`, lfMonthName},
+	'C': withField(twoDigits, lfCentury),
+	'd': withField(twoDigits, lfDayOfMonth),
+	'e': withField(spaceDigits, lfDayOfMonth),
+	'G': {"[0-9][0-9][0-9][0-9]", `[0-9]{4}`, lfNone},
+	'g': twoDigits,
+	'H': withField(twoDigits, lfHour),
+	'I': withField(twoDigits, lfHour12),
+	'j': {"[0-9][0-9][0-9]", `([0-9]{3})`, lfDayOfYear},
+	'k': withField(spaceDigits, lfHour),
+	'l': withField(spaceDigits, lfHour12),
+	'M': withField(twoDigits, lfMinute),
+	'm': withField(twoDigits, lfMonth),
+	'n': {"\n", `\n`, lfNone},
+	'p': {"[AP]M", `(AM|PM)`, lfAMPM},
+	'S': withField(twoDigits, lfSecond),
+	's': {"*", `(-?[0-9]+)`, lfEpoch},
+	't': {"\t", `\t`, lfNone},
+	'U': twoDigits,
+	'u': {"[1-7]", `[1-7]`, lfNone},
+	'V': twoDigits,
+	'W': twoDigits,
+	'w': {"[0-6]", `[0-6]`, lfNone},
+	'Y': {"[0-9][0-9][0-9][0-9]", `([0-9]{4})`, lfYear},
+	'y': withField(twoDigits, lfYearInCentury),
+	'Z': {"*", `[A-Za-z0-9+-]*`, lfNone},
+	'z': {"[+-][0-9][0-9][0-9][0-9]", `[+-][0-9]{4}`, lfNone},
+	'%': {"%", `%`, lfNone},
+}
+
+// LogFilenamePattern is a parsed representation of PostgreSQL's
+// log_filename setting.  It supports the same set of strftime() conversions
+// as the server does.
+type LogFilenamePattern struct {
+	pattern string
+	glob    string
+	re      *regexp.Regexp
+	// the timestamp component captured by each subexpression of re
+	fields []logFilenameField
+}
+
+func ParseLogFilenamePattern(pattern string) (*LogFilenamePattern, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("log_filename pattern must not be empty")
+	}
+	if strings.ContainsRune(pattern, '/') {
+		return nil, fmt.Errorf("log_filename pattern %q must not contain a directory separator", pattern)
+	}
+
+	p := &LogFilenamePattern{
+		pattern: pattern,
+	}
+	var glob, re strings.Builder
+	err := p.compile(pattern, &glob, &re, 0)
+	if err != nil {
+		return nil, err
+	}
+	p.glob = glob.String()
+	p.re, err = regexp.Compile("^" + re.String() + "$")
+	if err != nil {
+		return nil, fmt.Errorf("could not compile log_filename pattern %q: %s", pattern, err)
+	}
+	return p, nil
+}
+
+func (p *LogFilenamePattern) compile(pattern string, glob, re *strings.Builder, depth int) error {
+	if depth > 2 {
+		panic("unexpected log_filename conversion nesting")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c != '%' {
+			p.compileLiteral(c, glob, re)
+			continue
+		}
+
+		// Like pg_strftime(), output a lone % at the end of the pattern as is.
+		i++
+		if i >= len(pattern) {
+			p.compileLiteral('%', glob, re)
+			break
+		}
+		c = pattern[i]
+		// pg_strftime() ignores the POSIX locale modifiers
+		if (c == 'E' || c == 'O') && i+1 < len(pattern) {
+			i++
+			c = pattern[i]
+		}
+
+		if composite, ok := logFilenameCompositeConversions[c]; ok {
+			if strings.ContainsRune(composite, '/') {
+				return fmt.Errorf("log_filename pattern %q must not contain conversion %%%c, which produces a directory separator", p.pattern, c)
+			}
+			err := p.compile(composite, glob, re, depth+1)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		conv, ok := logFilenameConversions[c]
+		if !ok {
+			// pg_strftime() outputs the character of an unknown conversion
+			// as is.
+			p.compileLiteral(c, glob, re)
+			continue
+		}
+		glob.WriteString(conv.glob)
+		if conv.field == lfNone {
+			re.WriteString(conv.re)
+		} else {
+			if !strings.HasPrefix(conv.re, "(") {
+				conv.re = "(" + conv.re + ")"
+			}
+			re.WriteString(conv.re)
+			p.fields = append(p.fields, conv.field)
+		}
+	}
+	return nil
+}
+
+func (p *LogFilenamePattern) compileLiteral(c byte, glob, re *strings.Builder) {
+	if strings.IndexByte(`*?[\`, c) != -1 {
+		glob.WriteByte('\\')
+	}
+	glob.WriteByte(c)
+	re.WriteString(regexp.QuoteMeta(string(c)))
+}
+
+// String returns the log_filename setting the pattern was parsed from.
+func (p *LogFilenamePattern) String() string {
+	return p.pattern
+}
+
+// Glob returns a pattern suitable for filepath.Match and filepath.Glob.  The
+// glob is not always exact; use Match to check whether a file name was
+// actually produced by this log_filename.
+func (p *LogFilenamePattern) Glob() string {
+	return p.glob
+}
+
+// Match reports whether filename (without a directory) could have been
+// produced from this log_filename.
+func (p *LogFilenamePattern) Match(filename string) bool {
+	return p.re.MatchString(filename)
+}
+
+// FilenameTime returns the point in time encoded in filename.  Components
+// missing from the pattern are assumed to be at their lowest value; for
+// example, with a pattern of "postgresql-%H.csv" the returned time is on
+// January 1st of year zero.  loc should be the server's log_timezone.
+func (p *LogFilenamePattern) FilenameTime(filename string, loc *time.Location) (time.Time, error) {
+	match := p.re.FindStringSubmatch(filename)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("file name %q does not match log_filename %q", filename, p.pattern)
+	}
+
+	year, month, day, yday := 0, 1, 1, 0
+	hour, minute, second := 0, 0, 0
+	century, yearInCentury := -1, -1
+	pm, hour12 := false, -1
+	for i, field := range p.fields {
+		value := match[i+1]
+		switch field {
+		case lfMonthName:
+			month = monthNameToNumber(value)
+			continue
+		case lfAMPM:
+			pm = value == "PM"
+			continue
+		case lfEpoch:
+			epoch, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid epoch %q in file name %q", value, filename)
+			}
+			return time.Unix(epoch, 0).In(loc), nil
+		}
+
+		n, err := strconv.Atoi(strings.TrimLeft(value, " "))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid number %q in file name %q", value, filename)
+		}
+		switch field {
+		case lfYear:
+			year = n
+		case lfCentury:
+			century = n
+		case lfYearInCentury:
+			yearInCentury = n
+		case lfMonth:
+			month = n
+		case lfDayOfMonth:
+			day = n
+		case lfDayOfYear:
+			yday = n
+		case lfHour:
+			hour = n
+		case lfHour12:
+			hour12 = n
+		case lfMinute:
+			minute = n
+		case lfSecond:
+			second = n
+		default:
+			panic(field)
+		}
+	}
+
+	if yearInCentury != -1 && !p.hasField(lfYear) {
+		if century != -1 {
+			year = century*100 + yearInCentury
+		} else if yearInCentury < 69 {
+			year = 2000 + yearInCentury
+		} else {
+			year = 1900 + yearInCentury
+		}
+	} else if century != -1 && !p.hasField(lfYear) {
+		year = century * 100
+	}
+	if hour12 != -1 && !p.hasField(lfHour) {
+		hour = hour12 % 12
+		if pm {
+			hour += 12
+		}
+	}
+	if yday > 0 && !p.hasField(lfMonth) && !p.hasField(lfMonthName) {
+		return time.Date(year, time.January, yday, hour, minute, second, 0, loc), nil
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, second, 0, loc), nil
+}
+
+func (p *LogFilenamePattern) hasField(field logFilenameField) bool {
+	for _, f := range p.fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func monthNameToNumber(name string) int {
+	for i := range shortMonthNames {
+		if name == shortMonthNames[i] || name == longMonthNames[i] {
+			return i + 1
+		}
+	}
+	panic(name)
+}
+
+// NamesAreMonotonic reports whether the file names produced by this pattern
+// sort chronologically by the time encoded in them, i.e. whether a name is
+// never reused and a later file never encodes an earlier time.  This is the
+// case when the pattern includes the year and, for each finer unit it
+// includes, every unit coarser than it.  Patterns such as "postgresql-%a.csv"
+// or "postgresql-%H.csv" reuse names, and their files can only be ordered by
+// looking at the files themselves.
+func (p *LogFilenamePattern) NamesAreMonotonic() bool {
+	if p.hasField(lfEpoch) {
+		return true
+	}
+	if !p.hasField(lfYear) && !p.hasField(lfYearInCentury) {
+		return false
+	}
+	hasMonth := p.hasField(lfMonth) || p.hasField(lfMonthName)
+	hasDay := p.hasField(lfDayOfYear) || (hasMonth && p.hasField(lfDayOfMonth))
+	hasHour := p.hasField(lfHour) || (p.hasField(lfHour12) && p.hasField(lfAMPM))
+	units := []bool{
+		hasMonth || hasDay,
+		hasDay,
+		hasHour,
+		p.hasField(lfMinute),
+		p.hasField(lfSecond),
+	}
+	for i := 1; i < len(units); i++ {
+		if units[i] && !units[i-1] {
+			return false
+		}
+	}
+	// Any component which isn't part of the chain above (e.g. a day of month
+	// without a month) makes names wrap around.
+	if p.hasField(lfDayOfMonth) && !hasMonth {
+		return false
+	}
+	if p.hasField(lfHour12) && !hasHour {
+		return false
+	}
+	return true
+}
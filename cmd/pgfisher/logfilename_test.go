@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLogFilenamePatternErrors(t *testing.T) {
+	for _, pattern := range []string{
+		"",
+		"log/postgresql-%Y.csv",
+		"postgresql-%D.csv",
+		"postgresql-%x.csv",
+		"postgresql-%Ex.csv",
+	} {
+		_, err := ParseLogFilenamePattern(pattern)
+		if err == nil {
+			t.Errorf("ParseLogFilenamePattern(%q) did not return an error", pattern)
+		}
+	}
+}
+
+func TestLogFilenamePatternGlob(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		glob    string
+	}{
+		{"postgresql-%Y-%m-%d_%H%M%S.log", "postgresql-[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]_[0-9][0-9][0-9][0-9][0-9][0-9].log"},
+		{"postgresql-%a.csv", "postgresql-[A-Z][a-z][a-z].csv"},
+		{"postgresql-%j.csv", "postgresql-[0-9][0-9][0-9].csv"},
+		{"postgresql-%F.csv", "postgresql-[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9].csv"},
+		{"postgresql-%s.csv", "postgresql-*.csv"},
+		{"100%%-%Y.csv", "100%-[0-9][0-9][0-9][0-9].csv"},
+		{"pg*[x]-%Y.csv", `pg\*\[x]-[0-9][0-9][0-9][0-9].csv`},
+		// unknown conversions and a trailing % are output as is
+		{"postgresql-%q.csv", "postgresql-q.csv"},
+		{"postgresql-%", "postgresql-%"},
+		// locale modifiers are ignored
+		{"postgresql-%EY.csv", "postgresql-[0-9][0-9][0-9][0-9].csv"},
+		{"postgresql-%E", "postgresql-E"},
+	}
+	for _, tc := range testCases {
+		p, err := ParseLogFilenamePattern(tc.pattern)
+		if err != nil {
+			t.Errorf("ParseLogFilenamePattern(%q): %s", tc.pattern, err)
+			continue
+		}
+		if p.Glob() != tc.glob {
+			t.Errorf("Glob() of %q = %q; expected %q", tc.pattern, p.Glob(), tc.glob)
+		}
+	}
+}
+
+func TestLogFilenamePatternMatch(t *testing.T) {
+	testCases := []struct {
+		pattern  string
+		filename string
+		match    bool
+	}{
+		{"postgresql-%Y-%m-%d.csv", "postgresql-2024-10-01.csv", true},
+		{"postgresql-%Y-%m-%d.csv", "postgresql-2024-10-01.log", false},
+		{"postgresql-%Y-%m-%d.csv", "postgresql-2024-1-01.csv", false},
+		{"postgresql-%a.csv", "postgresql-Tue.csv", true},
+		{"postgresql-%a.csv", "postgresql-Tux.csv", false},
+		{"postgresql-%b.csv", "postgresql-Oct.csv", true},
+		{"postgresql-%B.csv", "postgresql-October.csv", true},
+		{"postgresql-%e.csv", "postgresql- 1.csv", true},
+		{"postgresql-%q.csv", "postgresql-q.csv", true},
+		{"100%%.csv", "100%.csv", true},
+		{"postgresql-%s.csv", "postgresql-1727740800.csv", true},
+	}
+	for _, tc := range testCases {
+		p, err := ParseLogFilenamePattern(tc.pattern)
+		if err != nil {
+			t.Errorf("ParseLogFilenamePattern(%q): %s", tc.pattern, err)
+			continue
+		}
+		if p.Match(tc.filename) != tc.match {
+			t.Errorf("Match(%q) of %q = %v; expected %v", tc.filename, tc.pattern, !tc.match, tc.match)
+		}
+	}
+}
+
+func TestLogFilenamePatternFilenameTime(t *testing.T) {
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		pattern  string
+		filename string
+		expected time.Time
+	}{
+		{"postgresql-%Y-%m-%d_%H%M%S.log", "postgresql-2024-10-01_133005.log", time.Date(2024, 10, 1, 13, 30, 5, 0, helsinki)},
+		{"postgresql-%F.log", "postgresql-2024-10-01.log", time.Date(2024, 10, 1, 0, 0, 0, 0, helsinki)},
+		{"postgresql-%y%m%d.log", "postgresql-241001.log", time.Date(2024, 10, 1, 0, 0, 0, 0, helsinki)},
+		{"postgresql-%y%m%d.log", "postgresql-991001.log", time.Date(1999, 10, 1, 0, 0, 0, 0, helsinki)},
+		{"postgresql-%C%y.log", "postgresql-1968.log", time.Date(1968, 1, 1, 0, 0, 0, 0, helsinki)},
+		{"postgresql-%Y-%j.log", "postgresql-2024-275.log", time.Date(2024, 10, 1, 0, 0, 0, 0, helsinki)},
+		{"postgresql-%Y-%b-%e.log", "postgresql-2024-Oct- 1.log", time.Date(2024, 10, 1, 0, 0, 0, 0, helsinki)},
+		{"postgresql-%Y-%B.log", "postgresql-2024-October.log", time.Date(2024, 10, 1, 0, 0, 0, 0, helsinki)},
+		{"postgresql-%Y%m%d-%I%p.log", "postgresql-20241001-12AM.log", time.Date(2024, 10, 1, 0, 0, 0, 0, helsinki)},
+		{"postgresql-%Y%m%d-%I%p.log", "postgresql-20241001-01PM.log", time.Date(2024, 10, 1, 13, 0, 0, 0, helsinki)},
+		{"postgresql-%Y%m%d-%R.log", "postgresql-20241001-13:30.log", time.Date(2024, 10, 1, 13, 30, 0, 0, helsinki)},
+		{"postgresql-%s.log", "postgresql-1727778600.log", time.Date(2024, 10, 1, 13, 30, 0, 0, helsinki)},
+		{"postgresql-%H.log", "postgresql-13.log", time.Date(0, 1, 1, 13, 0, 0, 0, helsinki)},
+	}
+	for _, tc := range testCases {
+		p, err := ParseLogFilenamePattern(tc.pattern)
+		if err != nil {
+			t.Errorf("ParseLogFilenamePattern(%q): %s", tc.pattern, err)
+			continue
+		}
+		got, err := p.FilenameTime(tc.filename, helsinki)
+		if err != nil {
+			t.Errorf("FilenameTime(%q) of %q: %s", tc.filename, tc.pattern, err)
+			continue
+		}
+		if !got.Equal(tc.expected) {
+			t.Errorf("FilenameTime(%q) of %q = %s; expected %s", tc.filename, tc.pattern, got, tc.expected)
+		}
+	}
+}
+
+func TestLogFilenamePatternNamesAreMonotonic(t *testing.T) {
+	testCases := []struct {
+		pattern   string
+		monotonic bool
+	}{
+		{"postgresql-%Y-%m-%d_%H%M%S.log", true},
+		{"postgresql-%Y-%m-%d.log", true},
+		{"postgresql-%Y-%j.log", true},
+		{"postgresql-%y%m%d.log", true},
+		{"postgresql-%s.log", true},
+		{"postgresql-%Y-%m-%d-%I%p.log", true},
+		{"postgresql-%a.log", false},
+		{"postgresql-%H.log", false},
+		{"postgresql-%d.log", false},
+		{"postgresql-%Y-%d.log", false},
+		{"postgresql-%Y-%m-%d-%I.log", false},
+		{"postgresql-%Y-%H.log", false},
+	}
+	for _, tc := range testCases {
+		p, err := ParseLogFilenamePattern(tc.pattern)
+		if err != nil {
+			t.Errorf("ParseLogFilenamePattern(%q): %s", tc.pattern, err)
+			continue
+		}
+		if p.NamesAreMonotonic() != tc.monotonic {
+			t.Errorf("NamesAreMonotonic() of %q = %v; expected %v", tc.pattern, !tc.monotonic, tc.monotonic)
+		}
+	}
+}
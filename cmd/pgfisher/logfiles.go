@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+// logFile describes a log file in logPath at the time it was looked at.
+type logFile struct {
+	name     string
+	nameTime time.Time
+	modTime  time.Time
+	dev      uint64
+	ino      uint64
+
+	// Set for files which were written to but not created, and which have
+	// not been looked at yet.  See fsnotifyWatcherLoop.
+	written bool
+}
+
+func statLogFile(name string) (logFile, error) {
+	fi, err := os.Stat(filepath.Join(logPath, name))
+	if err != nil {
+		return logFile{}, err
+	}
+	nameTime, err := logFilename.FilenameTime(name, logTimezone)
+	if err != nil {
+		return logFile{}, err
+	}
+	dev, ino := fileID(fi)
+	return logFile{
+		name:     name,
+		nameTime: nameTime,
+		modTime:  fi.ModTime(),
+		dev:      dev,
+		ino:      ino,
+	}, nil
+}
+
+// listLogFiles returns the files in logPath whose names match logFilename,
+// in no particular order.
+func listLogFiles() []logFile {
+	pathGlob := filepath.Join(logPath, logFilename.Glob())
+	matches, _ := filepath.Glob(pathGlob)
+	var files []logFile
+	for _, match := range matches {
+		if !logFilename.Match(filepath.Base(match)) {
+			continue
+		}
+		file, err := statLogFile(filepath.Base(match))
+		if err != nil {
+			// could have been removed since the glob was evaluated
+			log.Printf("could not stat file %q: %s", match, err)
+			continue
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// sameFile reports whether a and b describe the same incarnation of a log
+// file.
+func (a logFile) sameFile(b logFile) bool {
+	if a.name != b.name {
+		return false
+	}
+	if a.ino == 0 && b.ino == 0 {
+		return true
+	}
+	return a.dev == b.dev && a.ino == b.ino
+}
+
+// logFileLess reports whether the server wrote to a before it wrote to b.  If
+// the names produced by log_filename are monotonic, the time encoded in the
+// file name decides.  Otherwise the same name can be used again after
+// wrapping around (e.g. "%a" after a week), and only the modification time
+// tells the files apart.  The inode number is the last resort.
+func logFileLess(a, b logFile) bool {
+	if logFilename.NamesAreMonotonic() {
+		if !a.nameTime.Equal(b.nameTime) {
+			return a.nameTime.Before(b.nameTime)
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+	}
+	if !a.modTime.Equal(b.modTime) {
+		return a.modTime.Before(b.modTime)
+	}
+	return a.ino < b.ino
+}
+
+func sortLogFiles(files []logFile) {
+	sort.SliceStable(files, func(i, j int) bool {
+		return logFileLess(files[i], files[j])
+	})
+}
+
+// The maximum number of bytes from the beginning of a log file to include in
+// its fingerprint.
+const fingerprintSize = 1024
+
+func fileFingerprint(fh *os.File, length int64) (string, error) {
+	buf := make([]byte, length)
+	_, err := fh.ReadAt(buf, 0)
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New64a()
+	h.Write(buf)
+	return fmt.Sprintf("%016x", h.Sum64()), nil
+}
+
+func resetLogFileIdentity(streamPos *shared.LogStreamPosition) {
+	streamPos.Device = 0
+	streamPos.Inode = 0
+	streamPos.Fingerprint = ""
+	streamPos.FingerprintLength = 0
+}
+
+// checkLogFileIdentity compares the file open in fh against the identity
+// recorded in streamPos.  If the file has been replaced or truncated since,
+// e.g. because of log_truncate_on_rotation, streamPos is reset to the
+// beginning of the file and true is returned.  Either way, the identity in
+// streamPos is brought up to date.
+func checkLogFileIdentity(fh *os.File, streamPos *shared.LogStreamPosition) (bool, error) {
+	fi, err := fh.Stat()
+	if err != nil {
+		return false, fmt.Errorf("could not stat file %q: %s", streamPos.Filename, err)
+	}
+	dev, ino := fileID(fi)
+
+	reason := ""
+	if streamPos.Inode != 0 && (streamPos.Device != dev || streamPos.Inode != ino) {
+		reason = "has been replaced"
+	} else if fi.Size() < streamPos.Offset {
+		reason = "has been truncated"
+	} else if streamPos.FingerprintLength > 0 {
+		fingerprint, err := fileFingerprint(fh, streamPos.FingerprintLength)
+		if err != nil {
+			return false, fmt.Errorf("could not read file %q: %s", streamPos.Filename, err)
+		}
+		if fingerprint != streamPos.Fingerprint {
+			reason = "has been rewritten"
+		}
+	}
+
+	reset := false
+	if reason != "" {
+		log.Printf("file %q %s; starting over from its beginning", streamPos.Filename, reason)
+		streamPos.Offset = 0
+		resetLogFileIdentity(streamPos)
+		reset = true
+	}
+
+	streamPos.Device = dev
+	streamPos.Inode = ino
+	if streamPos.FingerprintLength < fingerprintSize && streamPos.Offset > streamPos.FingerprintLength {
+		length := streamPos.Offset
+		if length > fingerprintSize {
+			length = fingerprintSize
+		}
+		streamPos.Fingerprint, err = fileFingerprint(fh, length)
+		if err != nil {
+			return false, fmt.Errorf("could not read file %q: %s", streamPos.Filename, err)
+		}
+		streamPos.FingerprintLength = length
+	}
+	return reset, nil
+}
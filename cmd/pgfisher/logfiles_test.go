@@ -0,0 +1,376 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+// Sets logPath, logFilename and logTimezone for the duration of the test.
+func setLogFileGlobals(t *testing.T, pattern string) {
+	parsed, err := ParseLogFilenamePattern(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logPath = t.TempDir()
+	logFilename = parsed
+	logTimezone = time.UTC
+	t.Cleanup(func() {
+		logPath = ""
+		logFilename = nil
+		logTimezone = nil
+	})
+}
+
+func writeLogFile(t *testing.T, name string, contents string) {
+	err := os.WriteFile(filepath.Join(logPath, name), []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendLogFile(t *testing.T, name string, contents string) {
+	fh, err := os.OpenFile(filepath.Join(logPath, name), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	_, err = fh.WriteString(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Replaces the file called name with a new one, as with rename(2).
+func replaceLogFile(t *testing.T, name string, contents string) {
+	tmp := filepath.Join(logPath, "new.tmp")
+	err := os.WriteFile(tmp, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(tmp, filepath.Join(logPath, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Truncates the file called name in place and writes contents into it, as
+// with log_truncate_on_rotation.
+func truncateLogFile(t *testing.T, name string, contents string) {
+	fh, err := os.OpenFile(filepath.Join(logPath, name), os.O_TRUNC|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	_, err = fh.WriteString(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkTestLogFileIdentity(t *testing.T, pos *shared.LogStreamPosition) bool {
+	fh, err := os.Open(filepath.Join(logPath, pos.Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	reset, err := checkLogFileIdentity(fh, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reset
+}
+
+func skipWithoutFileIDs(t *testing.T, name string) {
+	file, err := statLogFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.ino == 0 {
+		t.Skip("file identities are not supported on this platform")
+	}
+}
+
+func TestCheckLogFileIdentity(t *testing.T) {
+	const name = "postgresql-Mon.log"
+	const original = "[1] LOG:  first\n[2] LOG:  second\n"
+	testCases := []struct {
+		name   string
+		change func(t *testing.T)
+		// whether the file is expected to be read again from its beginning
+		expectedReset bool
+	}{
+		{"unchanged", func(t *testing.T) {}, false},
+		{"appended to", func(t *testing.T) {
+			appendLogFile(t, name, "[3] LOG:  third\n")
+		}, false},
+		{"truncated", func(t *testing.T) {
+			truncateLogFile(t, name, "[4] LOG:  x\n")
+		}, true},
+		{"truncated and written past the offset", func(t *testing.T) {
+			truncateLogFile(t, name, "[4] LOG:  after truncation\n[5] LOG:  and more\n")
+		}, true},
+		{"replaced", func(t *testing.T) {
+			replaceLogFile(t, name, original+"[3] LOG:  third\n")
+		}, true},
+	}
+	for _, tc := range testCases {
+		setLogFileGlobals(t, "postgresql-%a.log")
+		writeLogFile(t, name, original)
+		skipWithoutFileIDs(t, name)
+
+		pos := shared.LogStreamPosition{Filename: name, Offset: int64(len(original))}
+		if checkTestLogFileIdentity(t, &pos) {
+			t.Errorf("%s: the file was reset before it was changed", tc.name)
+		}
+		if pos.Inode == 0 || pos.FingerprintLength != int64(len(original)) {
+			t.Errorf("%s: got identity %d, %d; expected the inode and a fingerprint of %d bytes",
+				tc.name, pos.Inode, pos.FingerprintLength, len(original))
+		}
+
+		tc.change(t)
+		reset := checkTestLogFileIdentity(t, &pos)
+		if reset != tc.expectedReset {
+			t.Errorf("%s: got reset %v; expected %v", tc.name, reset, tc.expectedReset)
+		}
+		expectedOffset := int64(len(original))
+		if tc.expectedReset {
+			expectedOffset = 0
+		}
+		if pos.Offset != expectedOffset {
+			t.Errorf("%s: got offset %d; expected %d", tc.name, pos.Offset, expectedOffset)
+		}
+
+		// The identity now describes the file as it is.
+		previous := pos
+		if checkTestLogFileIdentity(t, &pos) {
+			t.Errorf("%s: the file was reset twice", tc.name)
+		}
+		if pos != previous {
+			t.Errorf("%s: got position %+v after checking again; expected %+v", tc.name, pos, previous)
+		}
+	}
+}
+
+func TestStartPosition(t *testing.T) {
+	const name = "postgresql-Mon.log"
+	const original = "[1] LOG:  first\n[2] LOG:  second\n"
+	testCases := []struct {
+		name string
+		// changes the file after it was read up to the end of original
+		change func(t *testing.T)
+		// the offset startPosition is expected to return, and the one
+		// expected after checkLogFileIdentity
+		expectedStart  int64
+		expectedOffset int64
+	}{
+		// The server has started writing to the file again after the week
+		// wrapped around, without truncating it.
+		{"reused", func(t *testing.T) {
+			appendLogFile(t, name, "[3] LOG:  a week later\n")
+		}, int64(len(original)), int64(len(original))},
+		{"replaced", func(t *testing.T) {
+			replaceLogFile(t, name, original+"[3] LOG:  a week later\n")
+		}, 0, 0},
+		// The identity matches, but the contents have changed.
+		{"truncated", func(t *testing.T) {
+			truncateLogFile(t, name, "[3] LOG:  a week later, overwriting\n")
+		}, int64(len(original)), 0},
+	}
+	for _, tc := range testCases {
+		setLogFileGlobals(t, "postgresql-%a.log")
+		writeLogFile(t, name, original)
+		skipWithoutFileIDs(t, name)
+
+		pgf := &PGFisher{readFiles: make(map[string]shared.LogStreamPosition)}
+		pos := shared.LogStreamPosition{Filename: name, Offset: int64(len(original))}
+		checkTestLogFileIdentity(t, &pos)
+		pgf.rememberReadFile(pos)
+
+		tc.change(t)
+		file, err := statLogFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := pgf.startPosition(file)
+		if start.Filename != name || start.Offset != tc.expectedStart {
+			t.Errorf("%s: startPosition() = %q, %d; expected %q, %d", tc.name, start.Filename, start.Offset, name, tc.expectedStart)
+		}
+		checkTestLogFileIdentity(t, &start)
+		if start.Offset != tc.expectedOffset {
+			t.Errorf("%s: got offset %d after checking the identity; expected %d", tc.name, start.Offset, tc.expectedOffset)
+		}
+	}
+
+	// A file which hasn't been read from starts at the beginning.
+	setLogFileGlobals(t, "postgresql-%a.log")
+	writeLogFile(t, "postgresql-Tue.log", original)
+	pgf := &PGFisher{readFiles: make(map[string]shared.LogStreamPosition)}
+	file, err := statLogFile("postgresql-Tue.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start := pgf.startPosition(file); start.Offset != 0 {
+		t.Errorf("startPosition() of an unread file = %d; expected 0", start.Offset)
+	}
+
+	// Files which were read before pgfisher was started are resumed at
+	// their end.
+	pgf.rememberFileAsRead(file)
+	appendLogFile(t, "postgresql-Tue.log", "[3] LOG:  a week later\n")
+	file, err = statLogFile("postgresql-Tue.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start := pgf.startPosition(file); file.ino != 0 && start.Offset != int64(len(original)) {
+		t.Errorf("startPosition() of a file read before starting = %d; expected %d", start.Offset, len(original))
+	}
+}
+
+func TestSortLogFiles(t *testing.T) {
+	base := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	// The names leave out the "postgresql-" prefix and the ".log" suffix.
+	type testFile struct {
+		name string
+		// the modification time, relative to base
+		modTime time.Duration
+	}
+	testCases := []struct {
+		name    string
+		pattern string
+		files   []testFile
+		// the names of the files in the expected order
+		expected []string
+	}{
+		{
+			name:    "monotonic",
+			pattern: "postgresql-%Y-%m-%d_%H%M%S.log",
+			files: []testFile{
+				{"2024-10-02_000000", 2 * time.Hour},
+				{"2024-10-01_000000", time.Hour},
+				{"2024-10-01_120000", 90 * time.Minute},
+			},
+			expected: []string{"2024-10-01_000000", "2024-10-01_120000", "2024-10-02_000000"},
+		},
+		{
+			// the day comes first, so the names sort differently as strings
+			name:    "day first",
+			pattern: "postgresql-%d-%m-%Y.log",
+			files: []testFile{
+				{"01-11-2024", 0},
+				{"02-10-2024", 0},
+				{"31-10-2024", 0},
+			},
+			expected: []string{"02-10-2024", "31-10-2024", "01-11-2024"},
+		},
+		{
+			// the time in the name decides, even if a file was modified
+			// after a later one
+			name:    "modified late",
+			pattern: "postgresql-%d-%m-%Y.log",
+			files: []testFile{
+				{"01-11-2024", time.Hour},
+				{"02-10-2024", 2 * time.Hour},
+			},
+			expected: []string{"02-10-2024", "01-11-2024"},
+		},
+		{
+			name:    "month names",
+			pattern: "postgresql-%Y-%b.log",
+			files: []testFile{
+				{"2024-Oct", 0},
+				{"2025-Jan", 0},
+				{"2024-Nov", 0},
+				{"2024-Dec", 0},
+			},
+			expected: []string{"2024-Oct", "2024-Nov", "2024-Dec", "2025-Jan"},
+		},
+		{
+			name:    "epoch",
+			pattern: "postgresql-%s.log",
+			files: []testFile{
+				{"1000", 0},
+				{"999", 0},
+				{"10000", 0},
+			},
+			expected: []string{"999", "1000", "10000"},
+		},
+		{
+			// names are reused every week; only the modification time tells
+			// the order
+			name:    "day of the week",
+			pattern: "postgresql-%a.log",
+			files: []testFile{
+				{"Mon", 3 * time.Hour},
+				{"Tue", 4 * time.Hour},
+				{"Fri", time.Hour},
+				{"Sun", 2 * time.Hour},
+			},
+			expected: []string{"Fri", "Sun", "Mon", "Tue"},
+		},
+		{
+			// the hour without AM/PM is reused twice a day
+			name:    "12-hour clock",
+			pattern: "postgresql-%Y-%m-%d_%I.log",
+			files: []testFile{
+				{"2024-10-01_01", 13 * time.Hour},
+				{"2024-10-01_12", 12 * time.Hour},
+				{"2024-10-01_02", 2 * time.Hour},
+			},
+			expected: []string{"2024-10-01_02", "2024-10-01_12", "2024-10-01_01"},
+		},
+	}
+	for _, tc := range testCases {
+		setLogFileGlobals(t, tc.pattern)
+		prefix, suffix := "postgresql-", ".log"
+		for _, f := range tc.files {
+			name := prefix + f.name + suffix
+			writeLogFile(t, name, "")
+			modTime := base.Add(f.modTime)
+			err := os.Chtimes(filepath.Join(logPath, name), modTime, modTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		files := listLogFiles()
+		sortLogFiles(files)
+		var got []string
+		for _, f := range files {
+			got = append(got, strings.TrimSuffix(strings.TrimPrefix(f.name, prefix), suffix))
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: got order %q; expected %q", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestLogFileLess(t *testing.T) {
+	setLogFileGlobals(t, "postgresql-%Y-%m-%d.log")
+	day1 := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	testCases := []struct {
+		name     string
+		a, b     logFile
+		expected bool
+	}{
+		{"earlier name", logFile{name: "b", nameTime: day1, modTime: day2}, logFile{name: "a", nameTime: day2, modTime: day1}, true},
+		{"later name", logFile{name: "a", nameTime: day2, modTime: day1}, logFile{name: "b", nameTime: day1, modTime: day2}, false},
+		// the same time in different names, e.g. after log_filename
+		// was changed
+		{"same time", logFile{name: "a", nameTime: day1, modTime: day2}, logFile{name: "b", nameTime: day1, modTime: day1}, true},
+		// the same file, replaced
+		{"same name", logFile{name: "a", nameTime: day1, modTime: day2, ino: 1}, logFile{name: "a", nameTime: day1, modTime: day1, ino: 2}, false},
+		{"same modification time", logFile{name: "a", nameTime: day1, modTime: day1, ino: 1}, logFile{name: "a", nameTime: day1, modTime: day1, ino: 2}, true},
+	}
+	for _, tc := range testCases {
+		if got := logFileLess(tc.a, tc.b); got != tc.expected {
+			t.Errorf("%s: got %v; expected %v", tc.name, got, tc.expected)
+		}
+	}
+}
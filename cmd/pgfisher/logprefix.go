@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+const defaultLogLinePrefix = "%m [%p] "
+
+type logPrefixEscape struct {
+	re    string
+	attno int
+}
+
+// The log_line_prefix escapes, and the csvlog column each one corresponds
+// to.  An attno of -1 means the value is not stored anywhere.
+var logPrefixEscapes = map[byte]logPrefixEscape{
+	'a': {`.*?`, shared.ApplicationNameAttno},
+	'u': {`.*?`, shared.UserNameAttno},
+	'd': {`.*?`, shared.DatabaseNameAttno},
+	'r': {`.*?`, shared.ConnectionFromAttno},
+	'h': {`.*?`, shared.ConnectionFromAttno},
+	'L': {`.*?`, -1},
+	'b': {`.*?`, shared.BackendTypeAttno},
+	'p': {`[0-9]*`, shared.ProcessIDAttno},
+	'P': {`[0-9]*`, shared.LeaderPidAttno},
+	't': {`[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2} \S+`, shared.LogTimeAttno},
+	'm': {`[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2}\.[0-9]{3} \S+`, shared.LogTimeAttno},
+	'n': {`[0-9]+\.[0-9]{3}`, shared.LogTimeAttno},
+	'i': {`.*?`, shared.CommandTagAttno},
+	'e': {`[0-9A-Z]{5}`, shared.SQLStateAttno},
+	'c': {`[0-9a-f]*\.[0-9a-f]*`, shared.SessionIDAttno},
+	'l': {`[0-9]*`, shared.SessionLineNumAttno},
+	's': {`[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2} \S+`, shared.SessionStartTimeAttno},
+	'v': {`[0-9]*/[0-9]*|`, shared.VirtualTransactionIDAttno},
+	'x': {`[0-9]*`, shared.TransactionIDAttno},
+	'Q': {`-?[0-9]*`, shared.QueryIDAttno},
+}
+
+var (
+	primarySeverities   = []string{"DEBUG1", "DEBUG2", "DEBUG3", "DEBUG4", "DEBUG5", "LOG", "INFO", "NOTICE", "WARNING", "ERROR", "FATAL", "PANIC"}
+	secondarySeverities = []string{"DETAIL", "HINT", "QUERY", "CONTEXT", "LOCATION", "STATEMENT"}
+	// The column the message of each secondary severity is stored in
+	secondarySeverityAttnos = map[string]int{
+		"DETAIL":    shared.DetailAttno,
+		"HINT":      shared.HintAttno,
+		"QUERY":     shared.InternalQueryAttno,
+		"CONTEXT":   shared.ContextAttno,
+		"LOCATION":  shared.LocationAttno,
+		"STATEMENT": shared.QueryAttno,
+	}
+
+	// With log_error_verbosity = verbose, the SQLSTATE is written at the
+	// beginning of the message.  Every SQLSTATE contains at least one digit.
+	verboseSQLStateRe = regexp.MustCompile(`^([0-9A-Z]{5}): `)
+)
+
+// logPrefixParser is a compiled log_line_prefix setting, used for parsing the
+// lines of log files written with log_destination = stderr.
+type logPrefixParser struct {
+	prefix string
+	re     *regexp.Regexp
+	// the column each subexpression of re is stored in, not including the
+	// last two (severity and message)
+	attnos []int
+	// true if the corresponding subexpression is %n, which needs to be
+	// converted to a timestamp
+	epoch []bool
+}
+
+// A single line of a stderr log file which was produced by the server.
+type logPrefixLine struct {
+	// The columns set from the prefix
+	record   []string
+	severity string
+	message  string
+}
+
+func compileLogLinePrefix(prefix string) (*logPrefixParser, error) {
+	p := &logPrefixParser{
+		prefix: prefix,
+	}
+	var re strings.Builder
+	re.WriteString("^")
+	optionalGroups := 0
+	for i := 0; i < len(prefix); i++ {
+		c := prefix[i]
+		if c != '%' {
+			re.WriteString(regexp.QuoteMeta(string(c)))
+			continue
+		}
+
+		// optional padding, e.g. %-10u
+		i++
+		padded := false
+		for i < len(prefix) && (prefix[i] == '-' || (prefix[i] >= '0' && prefix[i] <= '9')) {
+			padded = true
+			i++
+		}
+		if i >= len(prefix) {
+			return nil, fmt.Errorf("log_line_prefix %q ends with an incomplete escape", prefix)
+		}
+		c = prefix[i]
+		switch c {
+		case '%':
+			re.WriteString("%")
+			continue
+		case 'q':
+			// Everything after %q is only present for session processes.
+			re.WriteString("(?:")
+			optionalGroups++
+			continue
+		}
+		escape, ok := logPrefixEscapes[c]
+		if !ok {
+			return nil, fmt.Errorf("log_line_prefix %q contains unsupported escape %%%c", prefix, c)
+		}
+		if padded {
+			re.WriteString(" *")
+		}
+		if escape.attno == -1 {
+			re.WriteString("(?:" + escape.re + ")")
+		} else {
+			re.WriteString("(" + escape.re + ")")
+			p.attnos = append(p.attnos, escape.attno)
+			p.epoch = append(p.epoch, c == 'n')
+		}
+		if padded {
+			re.WriteString(" *")
+		}
+	}
+	for ; optionalGroups > 0; optionalGroups-- {
+		re.WriteString(")?")
+	}
+
+	var severities []string
+	severities = append(severities, primarySeverities...)
+	severities = append(severities, secondarySeverities...)
+	re.WriteString("(" + strings.Join(severities, "|") + "):  (.*)$")
+
+	var err error
+	p.re, err = regexp.Compile(re.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not compile log_line_prefix %q: %s", prefix, err)
+	}
+	return p, nil
+}
+
+// parseLine parses a single line (without the trailing newline) of a stderr
+// log file.  Returns false if the line doesn't start with the prefix.
+func (p *logPrefixParser) parseLine(line string) (logPrefixLine, bool) {
+	match := p.re.FindStringSubmatch(line)
+	if match == nil {
+		return logPrefixLine{}, false
+	}
+	record := make([]string, shared.QueryIDAttno+1)
+	// csvlog always includes the transaction ID
+	record[shared.TransactionIDAttno] = "0"
+	for i, attno := range p.attnos {
+		value := strings.TrimSpace(match[i+1])
+		if value == "" {
+			continue
+		}
+		if p.epoch[i] {
+			value = epochToLogTime(value)
+		}
+		record[attno] = value
+	}
+	return logPrefixLine{
+		record:   record,
+		severity: match[len(match)-2],
+		message:  match[len(match)-1],
+	}, true
+}
+
+// includesLogTime reports whether the prefix includes the time the message
+// was logged at.
+func (p *logPrefixParser) includesLogTime() bool {
+	for _, attno := range p.attnos {
+		if attno == shared.LogTimeAttno {
+			return true
+		}
+	}
+	return false
+}
+
+// includesProcessID reports whether the prefix includes the process ID.
+func (p *logPrefixParser) includesProcessID() bool {
+	for _, attno := range p.attnos {
+		if attno == shared.ProcessIDAttno {
+			return true
+		}
+	}
+	return false
+}
+
+// Converts the value of %n to the format csvlog uses for log_time.
+func epochToLogTime(value string) string {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	t := time.UnixMilli(int64(seconds * 1000)).UTC()
+	return t.Format("2006-01-02 15:04:05.000 MST")
+}
+
+// stderrRecord builds a record out of the lines of a single message.
+type stderrRecord struct {
+	record []string
+	// the column continuation lines are appended to
+	lastAttno int
+}
+
+func newStderrRecord(line logPrefixLine) *stderrRecord {
+	r := &stderrRecord{
+		record: line.record,
+	}
+	if attno, ok := secondarySeverityAttnos[line.severity]; ok {
+		// We've missed the beginning of the message.  This can happen when
+		// starting to read from the middle of a file.
+		r.record[attno] = line.message
+		r.lastAttno = attno
+		return r
+	}
+
+	message := line.message
+	if r.record[shared.SQLStateAttno] == "" {
+		if m := verboseSQLStateRe.FindStringSubmatch(message); m != nil && strings.ContainsAny(m[1], "0123456789") {
+			r.record[shared.SQLStateAttno] = m[1]
+			message = message[len(m[0]):]
+		}
+	}
+	r.record[shared.ErrorSeverityAttno] = line.severity
+	r.record[shared.MessageAttno] = message
+	r.lastAttno = shared.MessageAttno
+	return r
+}
+
+// newUnprefixedStderrRecord creates a record for a line which was not
+// written by the server's logging functions, e.g. the output of a crashing
+// library.  Only the message is set.
+func newUnprefixedStderrRecord(line string) *stderrRecord {
+	record := make([]string, shared.QueryIDAttno+1)
+	record[shared.TransactionIDAttno] = "0"
+	record[shared.MessageAttno] = line
+	return &stderrRecord{
+		record:    record,
+		lastAttno: shared.MessageAttno,
+	}
+}
+
+// belongsTo reports whether line can be a secondary line (e.g. a DETAIL) of
+// the message in r.  The lines of messages logged by different processes at
+// the same time can be interleaved, so if the prefix includes the process ID,
+// it has to match.
+func (r *stderrRecord) belongsTo(line logPrefixLine, prefix *logPrefixParser) bool {
+	if _, secondary := secondarySeverityAttnos[line.severity]; !secondary {
+		return false
+	}
+	if prefix.includesProcessID() {
+		return line.record[shared.ProcessIDAttno] == r.record[shared.ProcessIDAttno]
+	}
+	return true
+}
+
+func (r *stderrRecord) addSecondary(line logPrefixLine) {
+	attno := secondarySeverityAttnos[line.severity]
+	r.record[attno] = line.message
+	r.lastAttno = attno
+}
+
+func (r *stderrRecord) addContinuation(line string) {
+	r.record[r.lastAttno] += "\n" + line
+}
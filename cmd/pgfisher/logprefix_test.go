@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+func TestCompileLogLinePrefixErrors(t *testing.T) {
+	for _, prefix := range []string{
+		"%m %",
+		"%m %-10",
+		"%m %z ",
+	} {
+		_, err := compileLogLinePrefix(prefix)
+		if err == nil {
+			t.Errorf("compileLogLinePrefix(%q) did not return an error", prefix)
+		}
+	}
+}
+
+func TestLogPrefixParseLine(t *testing.T) {
+	testCases := []struct {
+		prefix   string
+		line     string
+		ok       bool
+		columns  map[int]string
+		severity string
+		message  string
+	}{
+		{
+			prefix:   defaultLogLinePrefix,
+			line:     "2024-10-01 13:00:00.123 EEST [1234] LOG:  database system is ready to accept connections",
+			ok:       true,
+			columns:  map[int]string{shared.LogTimeAttno: "2024-10-01 13:00:00.123 EEST", shared.ProcessIDAttno: "1234"},
+			severity: "LOG",
+			message:  "database system is ready to accept connections",
+		},
+		{
+			prefix: defaultLogLinePrefix,
+			line:   "some output of a library",
+			ok:     false,
+		},
+		{
+			prefix:   "%t [%p]: [%l-1] user=%u,db=%d,app=%a,client=%h ",
+			line:     "2024-10-01 13:00:00 EEST [1234]: [3-1] user=app,db=appdb,app=psql,client=10.0.0.1 ERROR:  relation \"foo\" does not exist at character 15",
+			ok:       true,
+			columns:  map[int]string{shared.LogTimeAttno: "2024-10-01 13:00:00 EEST", shared.ProcessIDAttno: "1234", shared.SessionLineNumAttno: "3", shared.UserNameAttno: "app", shared.DatabaseNameAttno: "appdb", shared.ApplicationNameAttno: "psql", shared.ConnectionFromAttno: "10.0.0.1"},
+			severity: "ERROR",
+			message:  "relation \"foo\" does not exist at character 15",
+		},
+		{
+			prefix:   "%m [%p] %q%u@%d ",
+			line:     "2024-10-01 13:00:00.123 EEST [1234] app@appdb STATEMENT:  SELECT * FROM foo",
+			ok:       true,
+			columns:  map[int]string{shared.ProcessIDAttno: "1234", shared.UserNameAttno: "app", shared.DatabaseNameAttno: "appdb"},
+			severity: "STATEMENT",
+			message:  "SELECT * FROM foo",
+		},
+		{
+			// %q: not a session process
+			prefix:   "%m [%p] %q%u@%d ",
+			line:     "2024-10-01 13:00:00.123 EEST [1234] LOG:  checkpoint starting: time",
+			ok:       true,
+			columns:  map[int]string{shared.ProcessIDAttno: "1234", shared.UserNameAttno: "", shared.DatabaseNameAttno: ""},
+			severity: "LOG",
+			message:  "checkpoint starting: time",
+		},
+		{
+			prefix:   "%n [%-8p] %e %c %v %x %Q %b ",
+			line:     "1727776800.123 [1234    ] 42P01 66fbc8a0.4d2 3/42 745 -123 client backend ERROR:  relation \"foo\" does not exist",
+			ok:       true,
+			columns:  map[int]string{shared.LogTimeAttno: "2024-10-01 10:00:00.123 UTC", shared.ProcessIDAttno: "1234", shared.SQLStateAttno: "42P01", shared.SessionIDAttno: "66fbc8a0.4d2", shared.VirtualTransactionIDAttno: "3/42", shared.TransactionIDAttno: "745", shared.QueryIDAttno: "-123", shared.BackendTypeAttno: "client backend"},
+			severity: "ERROR",
+			message:  "relation \"foo\" does not exist",
+		},
+		{
+			prefix:   "%s %i %r %L %P 100%% ",
+			line:     "2024-10-01 12:59:00 EEST SELECT 10.0.0.1(5432) 10.0.0.2 1230 100% DEBUG1:  parallel worker",
+			ok:       true,
+			columns:  map[int]string{shared.SessionStartTimeAttno: "2024-10-01 12:59:00 EEST", shared.CommandTagAttno: "SELECT", shared.ConnectionFromAttno: "10.0.0.1(5432)", shared.LeaderPidAttno: "1230"},
+			severity: "DEBUG1",
+			message:  "parallel worker",
+		},
+	}
+	for _, tc := range testCases {
+		p, err := compileLogLinePrefix(tc.prefix)
+		if err != nil {
+			t.Errorf("compileLogLinePrefix(%q): %s", tc.prefix, err)
+			continue
+		}
+		parsed, ok := p.parseLine(tc.line)
+		if ok != tc.ok {
+			t.Errorf("parseLine(%q) with prefix %q returned %v; expected %v", tc.line, tc.prefix, ok, tc.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		for attno, value := range tc.columns {
+			if parsed.record[attno] != value {
+				t.Errorf("parseLine(%q) with prefix %q: column %d = %q; expected %q", tc.line, tc.prefix, attno, parsed.record[attno], value)
+			}
+		}
+		if parsed.severity != tc.severity || parsed.message != tc.message {
+			t.Errorf("parseLine(%q) with prefix %q = %s, %q; expected %s, %q", tc.line, tc.prefix, parsed.severity, parsed.message, tc.severity, tc.message)
+		}
+	}
+}
+
+func TestCompileLogLinePrefixIsDeterministic(t *testing.T) {
+	first, err := compileLogLinePrefix(defaultLogLinePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		p, err := compileLogLinePrefix(defaultLogLinePrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.re.String() != first.re.String() {
+			t.Fatalf("compiled %q into %q and %q", defaultLogLinePrefix, first.re, p.re)
+		}
+	}
+}
+
+func TestNewStderrRecordVerboseSQLState(t *testing.T) {
+	p, err := compileLogLinePrefix(defaultLogLinePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		line     string
+		sqlstate string
+		message  string
+	}{
+		{"2024-10-01 13:00:00.123 EEST [1234] ERROR:  42P01: relation \"foo\" does not exist", "42P01", "relation \"foo\" does not exist"},
+		{"2024-10-01 13:00:00.123 EEST [1234] LOG:  00000: checkpoint starting: time", "00000", "checkpoint starting: time"},
+		// no digits, so not a SQLSTATE
+		{"2024-10-01 13:00:00.123 EEST [1234] LOG:  ABCDE: something", "", "ABCDE: something"},
+	}
+	for _, tc := range testCases {
+		parsed, ok := p.parseLine(tc.line)
+		if !ok {
+			t.Errorf("could not parse %q", tc.line)
+			continue
+		}
+		r := newStderrRecord(parsed)
+		if r.record[shared.SQLStateAttno] != tc.sqlstate || r.record[shared.MessageAttno] != tc.message {
+			t.Errorf("newStderrRecord(%q) = %q, %q; expected %q, %q", tc.line, r.record[shared.SQLStateAttno], r.record[shared.MessageAttno], tc.sqlstate, tc.message)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	csv "github.com/johto/go-csvt"
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+const (
+	logFormatCSV    = "csv"
+	logFormatJSON   = "json"
+	logFormatStderr = "stderr"
+)
+
+// logReader reads records in the csvlog column layout from a log file.
+type logReader interface {
+	// Read returns the next record along with the number of bytes it took up
+	// in the file.  A record which has not been completely written yet is
+	// never returned; io.EOF is returned instead.  The number of bytes
+	// returned along with io.EOF were consumed without returning a record,
+	// e.g. by timeRangeLogReader, and still count towards the position.
+	Read() ([]string, int64, error)
+	// Format returns the log_destination the reader reads.
+	Format() string
+}
+
+// Returns the log_destination the file called filename was written by.
+func logFormatForFile(filename string) string {
+	if logFormat != "" {
+		return logFormat
+	}
+	switch filepath.Ext(filename) {
+	case ".csv":
+		return logFormatCSV
+	case ".json":
+		return logFormatJSON
+	default:
+		return logFormatStderr
+	}
+}
+
+// If final is true, the file is not going to be written to anymore.
+func newLogReader(r io.Reader, filename string, final bool) logReader {
+	switch format := logFormatForFile(filename); format {
+	case logFormatCSV:
+		reader := csv.NewReader(r)
+		reader.RequireTrailingNewline = true
+		return &csvLogReader{reader: reader}
+	case logFormatJSON:
+		return &jsonLogReader{reader: bufio.NewReader(r)}
+	case logFormatStderr:
+		return &stderrLogReader{
+			reader: bufio.NewReader(r),
+			prefix: logLinePrefix,
+			final:  final,
+		}
+	default:
+		panic(format)
+	}
+}
+
+type csvLogReader struct {
+	reader *csv.Reader
+}
+
+func (r *csvLogReader) Read() ([]string, int64, error) {
+	r.reader.ByteOffset = 0
+	record, err := r.reader.Read()
+	if err != nil {
+		return nil, 0, err
+	}
+	return record, r.reader.ByteOffset, nil
+}
+
+func (r *csvLogReader) Format() string {
+	return logFormatCSV
+}
+
+// Reads jsonlog files, which have one JSON object per line.
+type jsonLogReader struct {
+	reader *bufio.Reader
+}
+
+func (r *jsonLogReader) Read() ([]string, int64, error) {
+	var bytesRead int64
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		if err == io.EOF {
+			// incomplete line; wait for the rest of it
+			return nil, 0, io.EOF
+		} else if err != nil {
+			return nil, 0, err
+		}
+		bytesRead += int64(len(line))
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		record, err := shared.ParseJSONLogRecord(line)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s at line %q", err, line)
+		}
+		return record, bytesRead, nil
+	}
+}
+
+func (r *jsonLogReader) Format() string {
+	return logFormatJSON
+}
+
+// Reads stderr log files, stitching messages spanning several lines back
+// together.  Since a message can always be followed by more lines belonging
+// to it, the last message in a file is only returned once the file is known
+// to be final.
+type stderrLogReader struct {
+	reader *bufio.Reader
+	prefix *logPrefixParser
+	final  bool
+
+	pending          *stderrRecord
+	pendingBytesRead int64
+}
+
+func (r *stderrLogReader) Read() ([]string, int64, error) {
+	for {
+		line, err := r.reader.ReadString('\n')
+		if err == io.EOF {
+			if r.final && r.pending != nil {
+				return r.takePending(nil, 0)
+			}
+			return nil, 0, io.EOF
+		} else if err != nil {
+			return nil, 0, err
+		}
+		bytesRead := int64(len(line))
+		line = strings.TrimSuffix(line, "\n")
+		line = strings.TrimSuffix(line, "\r")
+
+		if r.pending != nil && strings.HasPrefix(line, "\t") {
+			r.pending.addContinuation(line[1:])
+			r.pendingBytesRead += bytesRead
+			continue
+		}
+
+		parsed, ok := r.prefix.parseLine(line)
+		if !ok {
+			if record, n, err := r.takePending(newUnprefixedStderrRecord(line), bytesRead); record != nil {
+				return record, n, err
+			}
+			continue
+		}
+		if r.pending != nil && r.pending.belongsTo(parsed, r.prefix) {
+			r.pending.addSecondary(parsed)
+			r.pendingBytesRead += bytesRead
+			continue
+		}
+		if record, n, err := r.takePending(newStderrRecord(parsed), bytesRead); record != nil {
+			return record, n, err
+		}
+	}
+}
+
+func (r *stderrLogReader) Format() string {
+	return logFormatStderr
+}
+
+// Replaces the pending record with next, and returns the previously pending
+// record, if any.
+func (r *stderrLogReader) takePending(next *stderrRecord, nextBytesRead int64) ([]string, int64, error) {
+	pending, pendingBytesRead := r.pending, r.pendingBytesRead
+	r.pending, r.pendingBytesRead = next, nextBytesRead
+	if pending == nil {
+		return nil, 0, nil
+	}
+	return pending.record, pendingBytesRead, nil
+}
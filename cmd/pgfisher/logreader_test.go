@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+type readResult struct {
+	// the expected value of a column of the record
+	attno int
+	value string
+	// the expected number of bytes the record took up
+	bytesRead int64
+}
+
+// Reads all records from reader, and checks them against expected.
+func checkLogReader(t *testing.T, name string, reader logReader, expected []readResult) {
+	t.Helper()
+	for i, e := range expected {
+		record, n, err := reader.Read()
+		if err != nil {
+			t.Errorf("%s: record %d: %s", name, i, err)
+			return
+		}
+		if e.attno >= len(record) || record[e.attno] != e.value {
+			t.Errorf("%s: record %d: unexpected record %q; expected column %d to be %q", name, i, record, e.attno, e.value)
+		}
+		if n != e.bytesRead {
+			t.Errorf("%s: record %d: read %d bytes; expected %d", name, i, n, e.bytesRead)
+		}
+	}
+	record, _, err := reader.Read()
+	if err != io.EOF {
+		t.Errorf("%s: expected io.EOF after %d records; got %q, %v", name, len(expected), record, err)
+	}
+}
+
+func TestLogFormatForFile(t *testing.T) {
+	testCases := []struct {
+		filename string
+		format   string
+	}{
+		{"postgresql-2024-10-01.csv", logFormatCSV},
+		{"postgresql-2024-10-01.json", logFormatJSON},
+		{"postgresql-2024-10-01.log", logFormatStderr},
+		{"postgresql-2024-10-01", logFormatStderr},
+	}
+	for _, tc := range testCases {
+		if format := logFormatForFile(tc.filename); format != tc.format {
+			t.Errorf("logFormatForFile(%q) = %q; expected %q", tc.filename, format, tc.format)
+		}
+	}
+}
+
+func TestCSVLogReader(t *testing.T) {
+	line1 := `2024-10-01 13:00:00.000 EEST,"app","appdb",1234,"10.0.0.1:5432",66fbc8a0.4d2,1,"SELECT",2024-10-01 12:59:00 EEST,3/42,0,LOG,00000,"statement: SELECT 1",,,,,,,,,"psql",client backend,,0` + "\n"
+	line2 := `2024-10-01 13:00:01.000 EEST,"app","appdb",1234,"10.0.0.1:5432",66fbc8a0.4d2,2,"SELECT",2024-10-01 12:59:00 EEST,3/42,0,ERROR,42P01,"relation ""foo""` + "\n" + `does not exist",,,,,,"SELECT * FROM foo",15,,"psql",client backend,,0` + "\n"
+	// not completely written yet
+	line3 := `2024-10-01 13:00:02.000 EEST,"app","appdb",1234,"10.0.0.1:5432",66fbc8a0.4d2,3,"SELECT"`
+
+	reader := newLogReader(strings.NewReader(line1+line2+line3), "postgresql.csv", false)
+	checkLogReader(t, "csvlog", reader, []readResult{
+		{shared.MessageAttno, "statement: SELECT 1", int64(len(line1))},
+		{shared.MessageAttno, "relation \"foo\"\ndoes not exist", int64(len(line2))},
+	})
+}
+
+func TestJSONLogReader(t *testing.T) {
+	line1 := `{"timestamp":"2024-10-01 13:00:00.000 EEST","pid":1234,"error_severity":"LOG","message":"statement: SELECT 1"}` + "\n"
+	line2 := `{"timestamp":"2024-10-01 13:00:01.000 EEST","pid":1234,"error_severity":"ERROR","message":"relation \"foo\"\ndoes not exist"}` + "\n"
+	// not completely written yet
+	line3 := `{"timestamp":"2024-10-01 13:00:02.000 EEST","pid":1234`
+
+	reader := newLogReader(strings.NewReader(line1+"\n"+line2+line3), "postgresql.json", false)
+	checkLogReader(t, "jsonlog", reader, []readResult{
+		{shared.MessageAttno, "statement: SELECT 1", int64(len(line1))},
+		// the empty line is counted towards the second record
+		{shared.MessageAttno, "relation \"foo\"\ndoes not exist", int64(len(line2)) + 1},
+	})
+
+	reader = newLogReader(strings.NewReader("{\"message\":\n"), "postgresql.json", false)
+	_, _, err := reader.Read()
+	if err == nil || err == io.EOF {
+		t.Errorf("expected an error for an invalid line; got %v", err)
+	}
+}
+
+func TestStderrLogReader(t *testing.T) {
+	prefix, err := compileLogLinePrefix(defaultLogLinePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logLinePrefix = prefix
+	defer func() { logLinePrefix = nil }()
+
+	lines := []string{
+		"2024-10-01 13:00:00.000 EEST [1234] ERROR:  relation \"foo\" does not exist at character 15\n",
+		"2024-10-01 13:00:00.000 EEST [1234] STATEMENT:  SELECT *\n",
+		"\tFROM foo\n",
+		"2024-10-01 13:00:01.000 EEST [1234] LOG:  duration: 1.000 ms\n",
+		"some output of a library\n",
+		// interleaved messages of two processes
+		"2024-10-01 13:00:02.000 EEST [1234] ERROR:  division by zero\n",
+		"2024-10-01 13:00:02.000 EEST [5678] STATEMENT:  SELECT 2\n",
+		"2024-10-01 13:00:02.000 EEST [1234] STATEMENT:  SELECT 1/0\n",
+		"2024-10-01 13:00:03.000 EEST [5678] WARNING:  there is no transaction in progress\n",
+		"2024-10-01 13:00:03.000 EEST [5678] HINT:  Start one.\n",
+	}
+	var data string
+	for _, line := range lines {
+		data += line
+	}
+	length := func(lines ...string) int64 {
+		n := 0
+		for _, line := range lines {
+			n += len(line)
+		}
+		return int64(n)
+	}
+	expected := []readResult{
+		{shared.QueryAttno, "SELECT *\nFROM foo", length(lines[0:3]...)},
+		{shared.MessageAttno, "duration: 1.000 ms", length(lines[3])},
+		{shared.MessageAttno, "some output of a library", length(lines[4])},
+		// the STATEMENT of another process must not be attached
+		{shared.QueryAttno, "", length(lines[5])},
+		{shared.ProcessIDAttno, "5678", length(lines[6])},
+		// the statement of a message whose beginning was already returned
+		{shared.QueryAttno, "SELECT 1/0", length(lines[7])},
+	}
+
+	// The last message is only returned once the file is final.
+	reader := newLogReader(strings.NewReader(data), "postgresql.log", false)
+	checkLogReader(t, "stderr", reader, expected)
+
+	reader = newLogReader(strings.NewReader(data), "postgresql.log", true)
+	checkLogReader(t, "final stderr", reader, append(expected,
+		readResult{shared.HintAttno, "Start one.", length(lines[8:]...)},
+	))
+}
+
+func TestStderrLogReaderWithoutProcessID(t *testing.T) {
+	prefix, err := compileLogLinePrefix("%m ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logLinePrefix = prefix
+	defer func() { logLinePrefix = nil }()
+
+	// Without %p, there's no telling interleaved messages apart.
+	data := "2024-10-01 13:00:02.000 EEST ERROR:  division by zero\n" +
+		"2024-10-01 13:00:02.000 EEST STATEMENT:  SELECT 1/0\n"
+	reader := newLogReader(strings.NewReader(data), "postgresql.log", true)
+	checkLogReader(t, "stderr", reader, []readResult{
+		{shared.QueryAttno, "SELECT 1/0", int64(len(data))},
+	})
+}
@@ -1,29 +1,34 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"regexp"
 	"strconv"
-	"strings"
+	"syscall"
 	"time"
 
 	shared "github.com/johto/pgfisher/internal/plugin_interface"
+	"github.com/johto/pgfisher/internal/plugins/statements"
 	bolt "go.etcd.io/bbolt"
 )
 
+const defaultLogFilename = "postgresql-%Y-%m-%d.csv"
+
 var (
-	logPath string
-	// These should be read via flags
-	logGlob = "postgresql-%Y-%m-%d.csv"
-
-	// Extremely naive log_filename parser
-	re             = regexp.MustCompile(`%[mdHMS]`)
-	LogGlobPattern = re.ReplaceAllLiteralString(strings.Replace(logGlob, "%Y", "%H%H", -1), "[0-9][0-9]")
-	fakeFileDest   = strings.NewReplacer("%Y", "2006", "%m", "01", "%d", "02", "%H", "15", "%M", "04", "%S", "05").Replace(logGlob)
+	logPath     string
+	logFilename *LogFilenamePattern
+	// Empty if the format should be chosen based on each file's suffix
+	logFormat     string
+	logLinePrefix *logPrefixParser
+	// The csvlog format of the server version set with server_version, if
+	// any.  Only used until the format of the records has been detected.
+	csvLogSchema *shared.CSVLogSchema
+	logTimezone  *time.Location
 )
 
 func printUsage(w io.Writer) {
@@ -34,7 +39,9 @@ func printUsage(w io.Writer) {
 Commands:
 
   tail                  tails the log stream
+  replay                reads log files once from beginning to end
   initdb                initializes a database file
+  top                   shows the statements which took the most time
 
 Options:
   --help                display this help and exit
@@ -47,19 +54,76 @@ See "%[1]s COMMAND --help" for usage of a specific command.
 func printTailUsage(w io.Writer) {
 	programName := filepath.Base(os.Args[0])
 	fmt.Fprintf(w, `Usage:
-  %[1]s tail DB_PATH LOG_PATH
-`, programName)
+  %[1]s tail [OPTION]... DB_PATH LOG_PATH
+
+Options:
+  --config FILE         read settings from a TOML file; the options below
+                        override its settings
+  --log-filename PATTERN
+                        the log_filename setting of the server (default %[2]q)
+  --format FORMAT       the format of the log files, "csv", "json" or "stderr"
+                        (default: based on the suffix of each file)
+  --log-line-prefix PREFIX
+                        the log_line_prefix setting of the server, used for
+                        stderr log files (default %[3]q)
+  --log-timezone ZONE   the log_timezone setting of the server, e.g.
+                        "Europe/Helsinki" (default: the local time zone)
+  --server-version VERSION
+                        the major version of the server, e.g. "9.6" or "14";
+                        the format is detected again from the csvlog records
+                        if they don't match (default: detected)
+  --poll-interval DURATION
+                        how often to check for new data at the end of a file
+                        (default 1s)
+  --persist-interval-bytes BYTES
+                        how many bytes to read between persisting the position
+                        into the database (default 33554432)
+  --fsnotify-queue-size SIZE
+                        how many newly created log files can be waiting to be
+                        read (default 32)
+  --pipeline-queue-size SIZE
+                        how many records can be read ahead of the plugins
+                        (default 1024)
+  --shutdown-timeout DURATION
+                        how long to wait for the plugins to finish when asked
+                        to shut down before exiting; half of it is spent
+                        waiting for external plugins at most (default 10s)
+  --metrics-address ADDRESS
+                        the address to serve Prometheus metrics on, or ""
+                        to not serve them (default ":9488")
+  --plugin NAME[=ARGS]  run the plugin registered as NAME, passing it ARGS;
+                        NAME can also be the path of a Go plugin ending in
+                        %[4]q.  Can be given more than once.
+  --plugin %[5]sCOMMAND
+                        run COMMAND as an external plugin; arguments are
+                        separated by whitespace, which can be quoted with
+                        single or double quotes or a backslash as in the
+                        shell; see README.md
+`, programName, defaultLogFilename, defaultLogLinePrefix, goPluginSuffix, externalPluginPrefix)
 }
 
 func commandTail(args []string) {
-	if len(args) != 2 {
+	config, args, configErrs, err := parseTailArgs("tail", args, nil)
+	if err != nil || len(args) != 2 {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
 		printTailUsage(os.Stderr)
 		os.Exit(1)
 	}
 	dbPath := args[0]
 	logPath = args[1]
 
-	_, err := os.Stat(dbPath)
+	errs := append(configErrs, applyConfig(config)...)
+	errs = append(errs, applyPluginConfig(config)...)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Println(err)
+		}
+		log.Fatalf("invalid configuration")
+	}
+
+	_, err = os.Stat(dbPath)
 	if err != nil && os.IsNotExist(err) {
 		programName := filepath.Base(os.Args[0])
 		log.Fatalf(`database file %s does not exist; use "%s initdb" to create it`, dbPath, programName)
@@ -69,47 +133,317 @@ func commandTail(args []string) {
 	if err != nil {
 		log.Fatalf("could not open database: %s", err)
 	}
-	pgf := NewPGFisher(dbh, ":9488")
-	pgf.MainLoop()
+	pgf := NewPGFisher(dbh, config)
+	go handleShutdownSignals(pgf, config.Tail.ShutdownTimeout.Duration)
+
+	err = pgf.MainLoop()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("shut down cleanly")
+}
+
+// Asks pgf to shut down when receiving SIGINT or SIGTERM, and exits if it
+// doesn't do so within timeout.  Runs in its own goroutine.
+func handleShutdownSignals(pgf *PGFisher, timeout time.Duration) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signalChan
+	log.Printf("received signal %s; shutting down", sig)
+	pgf.Shutdown()
+
+	select {
+	case sig = <-signalChan:
+		log.Fatalf("received signal %s while shutting down; exiting immediately", sig)
+	case <-time.After(timeout):
+		log.Fatalf("could not shut down within %s; exiting", timeout)
+	}
+}
+
+func printReplayUsage(w io.Writer) {
+	programName := filepath.Base(os.Args[0])
+	fmt.Fprintf(w, `Usage:
+  %[1]s replay [OPTION]... DB_PATH LOG_PATH [FILE]...
+
+Reads the given files in LOG_PATH, or all files matching the log_filename
+pattern, once from beginning to end.  Exits once the end of the last file has
+been reached.  Unless --no-persist is given, the position after the last
+record is persisted into the database as with the tail command, and the
+database is initialized if it doesn't exist yet.  The state of plugins which
+keep it in the database is written either way.
+
+Options:
+  --since TIME          only pass records logged at or after TIME to the
+                        plugins, e.g. "2024-10-01 00:00"; TIME is in the
+                        server's log_timezone unless it includes a zone
+  --until TIME          only pass records logged before TIME to the plugins
+  --no-persist          don't write the position into the database; the
+                        plugins still write their state into it
+
+All options of the tail command are accepted as well; see "%[1]s tail --help".
+`, programName)
+}
+
+func commandReplay(args []string) {
+	var sinceArg, untilArg string
+	var noPersist bool
+	config, args, configErrs, err := parseTailArgs("replay", args, func(flags *flag.FlagSet) {
+		flags.StringVar(&sinceArg, "since", "", "")
+		flags.StringVar(&untilArg, "until", "", "")
+		flags.BoolVar(&noPersist, "no-persist", false, "")
+	})
+	if err != nil || len(args) < 2 {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+		printReplayUsage(os.Stderr)
+		os.Exit(1)
+	}
+	dbPath := args[0]
+	logPath = args[1]
+	files := args[2:]
+
+	errs := append(configErrs, applyConfig(config)...)
+	errs = append(errs, applyPluginConfig(config)...)
+	var since, until time.Time
+	if sinceArg != "" {
+		since, err = parseTimeArg(sinceArg, logTimezone)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid --since: %s", err))
+		}
+	}
+	if untilArg != "" {
+		until, err = parseTimeArg(untilArg, logTimezone)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid --until: %s", err))
+		}
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Println(err)
+		}
+		log.Fatalf("invalid configuration")
+	}
+
+	if len(files) == 0 {
+		files = selectReplayFiles(since, until)
+		if len(files) == 0 {
+			log.Fatalf("could not find any log files to replay in directory %s", logPath)
+		}
+	}
+
+	dbh, err := bolt.Open(dbPath, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Fatalf("could not open database: %s", err)
+	}
+	pgf := NewPGFisher(dbh, config)
+	pgf.noPersist = noPersist
+	if !noPersist && !pgf.dbh.IsInitialized() {
+		pgf.dbh.InitializeDatabase(&shared.LogStreamPosition{
+			Filename: files[0],
+		})
+	}
+	go handleShutdownSignals(pgf, config.Tail.ShutdownTimeout.Duration)
+
+	err = pgf.Replay(files, since, until)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("shut down cleanly")
 }
 
 func printInitDBUsage(w io.Writer) {
 	programName := filepath.Base(os.Args[0])
 	fmt.Fprintf(w, `Usage:
   %[1]s initdb DB_PATH LOG_FILE START_OFFSET
+  %[1]s initdb [OPTION]... --since TIME DB_PATH LOG_PATH
+  %[1]s initdb [OPTION]... --from-now DB_PATH LOG_PATH
+  %[1]s initdb [OPTION]... --from-beginning DB_PATH LOG_PATH
+
+Initializes a database file so that tailing starts from START_OFFSET in
+LOG_FILE, or from a position found in the files in LOG_PATH.
+
+Options:
+  --since TIME          start from the first record logged at or after TIME,
+                        e.g. "2024-10-01 00:00"; TIME is in the server's
+                        log_timezone unless it includes a zone
+  --from-now            start from the end of the newest log file
+  --from-beginning      start from the beginning of the oldest log file
+
+The options of the tail command describing the log files, such as
+--log-filename and --format, are accepted as well; see "%[1]s tail --help".
 `, programName)
 }
 
 func commandInitDB(args []string) {
-	if len(args) != 3 {
+	var sinceArg string
+	var fromNow, fromBeginning bool
+	config, args, configErrs, err := parseTailArgs("initdb", args, func(flags *flag.FlagSet) {
+		flags.StringVar(&sinceArg, "since", "", "")
+		flags.BoolVar(&fromNow, "from-now", false, "")
+		flags.BoolVar(&fromBeginning, "from-beginning", false, "")
+	})
+	modes := 0
+	for _, set := range []bool{sinceArg != "", fromNow, fromBeginning} {
+		if set {
+			modes++
+		}
+	}
+	if err == nil && modes > 1 {
+		err = fmt.Errorf("only one of --since, --from-now and --from-beginning can be given")
+	}
+	if err != nil || (modes == 0 && len(args) != 3) || (modes == 1 && len(args) != 2) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
 		printInitDBUsage(os.Stderr)
 		os.Exit(1)
 	}
 	dbPath := args[0]
-	logFile := args[1]
-	startOffset, err := strconv.ParseInt(args[2], 10, 64)
-	if err != nil {
-		log.Fatalf("invalid START_OFFSET: %s", err)
-	}
 
 	_, err = os.Stat(dbPath)
 	if err == nil {
 		log.Fatalf(`database file %s already exists`, dbPath)
 	}
 
+	var streamPos shared.LogStreamPosition
+	if modes == 0 {
+		// Nothing in the configuration is needed, but a broken
+		// configuration file is still an error.
+		if len(configErrs) > 0 {
+			for _, err := range configErrs {
+				log.Println(err)
+			}
+			log.Fatalf("invalid configuration")
+		}
+		startOffset, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			log.Fatalf("invalid START_OFFSET: %s", err)
+		}
+		streamPos = shared.LogStreamPosition{
+			Filename:       args[1],
+			Offset:         startOffset,
+			BytesReadTotal: 0,
+		}
+	} else {
+		logPath = args[1]
+		errs := append(configErrs, applyConfig(config)...)
+		var since time.Time
+		if sinceArg != "" {
+			since, err = parseTimeArg(sinceArg, logTimezone)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid --since: %s", err))
+			}
+		}
+		if len(errs) > 0 {
+			for _, err := range errs {
+				log.Println(err)
+			}
+			log.Fatalf("invalid configuration")
+		}
+
+		if fromBeginning {
+			streamPos, err = findFirstPosition()
+		} else if fromNow {
+			streamPos, err = findStartPosition(endOfTime)
+		} else {
+			streamPos, err = findStartPosition(since)
+		}
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		log.Printf("starting from offset %d in file %s", streamPos.Offset, streamPos.Filename)
+	}
+
 	boltdb, err := bolt.Open(dbPath, 0644, &bolt.Options{Timeout: time.Second})
 	if err != nil {
 		log.Fatalf("could not open database: %s", err)
 	}
 	fisherdb := NewPGFisherDatabase(boltdb)
 
-	streamPos := shared.LogStreamPosition{
-		Filename:       logFile,
-		Offset:         startOffset,
-		BytesReadTotal: 0,
+	fisherdb.InitializeDatabase(&streamPos)
+}
+
+func printTopUsage(w io.Writer) {
+	programName := filepath.Base(os.Args[0])
+	fmt.Fprintf(w, `Usage:
+  %[1]s top [OPTION]... DB_PATH
+  %[1]s top [OPTION]... --url URL
+
+Shows the statements which took the most time, as collected by the %[2]s
+plugin.  The database file is locked while pgfisher is running, so use --url
+to ask a running pgfisher instead.
+
+Options:
+  --url URL             the address of the metrics server of a running
+                        pgfisher, e.g. "http://localhost:9488"
+  --plugin-name NAME    the name the plugin is configured under (default %[2]q)
+  --order ORDER         sort by "total", "mean" or "max" time, or by "calls"
+                        (default "total")
+  --limit N             how many statements to show (default %[3]d)
+  --since TIME          only include the windows beginning at or after TIME,
+                        e.g. "2024-10-01 00:00", in the local time zone unless
+                        TIME includes a zone
+  --until TIME          only include the windows beginning before TIME
+`, programName, statements.PluginName, statements.DefaultLimit)
+}
+
+func commandTop(args []string) {
+	flags := flag.NewFlagSet("top", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	url := flags.String("url", "", "")
+	pluginName := flags.String("plugin-name", statements.PluginName, "")
+	order := flags.String("order", statements.OrderTotal, "")
+	limit := flags.Int("limit", statements.DefaultLimit, "")
+	sinceArg := flags.String("since", "", "")
+	untilArg := flags.String("until", "", "")
+	err := flags.Parse(args)
+	if err == nil && *url == "" && flags.NArg() != 1 {
+		err = fmt.Errorf("DB_PATH is required unless --url is given")
+	} else if err == nil && *url != "" && flags.NArg() != 0 {
+		err = fmt.Errorf("DB_PATH can't be given together with --url")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		printTopUsage(os.Stderr)
+		os.Exit(1)
 	}
 
-	fisherdb.InitializeDatabase(&streamPos)
+	opts := statements.TopOptions{
+		Order: *order,
+		Limit: *limit,
+	}
+	err = statements.CheckOrder(opts.Order)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if opts.Limit <= 0 {
+		log.Fatalf("invalid --limit %d; must be positive", opts.Limit)
+	}
+	if *sinceArg != "" {
+		opts.Since, err = parseTimeArg(*sinceArg, time.Local)
+		if err != nil {
+			log.Fatalf("invalid --since: %s", err)
+		}
+	}
+	if *untilArg != "" {
+		opts.Until, err = parseTimeArg(*untilArg, time.Local)
+		if err != nil {
+			log.Fatalf("invalid --until: %s", err)
+		}
+	}
+
+	var top []*statements.StatementStats
+	if *url != "" {
+		top, err = fetchTopStatements(*url, *pluginName, opts)
+	} else {
+		top, err = readTopStatements(flags.Arg(0), *pluginName, opts)
+	}
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	printTopStatements(os.Stdout, top)
 }
 
 func main() {
@@ -133,9 +467,15 @@ func main() {
 	case "tail":
 		printCommandUsage = printTailUsage
 		executeCommand = commandTail
+	case "replay":
+		printCommandUsage = printReplayUsage
+		executeCommand = commandReplay
 	case "initdb":
 		printCommandUsage = printInitDBUsage
 		executeCommand = commandInitDB
+	case "top":
+		printCommandUsage = printTopUsage
+		executeCommand = commandTop
 	default:
 		fmt.Fprintf(os.Stderr, "unknown command %s\n", command)
 		os.Exit(1)
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+)
+
+// A record read by the reader stage of the pipeline.
+type queuedRecord struct {
+	record    []string
+	bytesRead int64
+	// Only set in the last item sent, in which case record is nil.
+	err error
+	// When the record was put into the queue
+	queuedAt time.Time
+}
+
+// startRecordReader starts the reader stage of the pipeline: a goroutine which
+// reads and parses records ahead of them being processed, and puts them into
+// a queue of up to pipeline_queue_size records.  The last item in the queue
+// contains the error which stopped the reader, usually io.EOF.  Closing stop
+// makes the goroutine exit early.  done is closed once the goroutine won't
+// use reader anymore.
+//
+// Processing the records, and therefore updating the position in the log
+// stream, is left to the caller, so the position never moves past a record
+// before the plugins are done with it.
+func (pgf *PGFisher) startRecordReader(reader logReader, stop <-chan struct{}) (queue <-chan queuedRecord, done <-chan struct{}) {
+	queueChan := make(chan queuedRecord, pgf.config.Tail.PipelineQueueSize)
+	doneChan := make(chan struct{})
+	go func() {
+		defer close(doneChan)
+		for {
+			startTime := time.Now()
+			record, bytesRead, err := reader.Read()
+			if err == nil {
+				pgf.pipelineStageSeconds.WithLabelValues("read").Observe(time.Since(startTime).Seconds())
+			}
+
+			item := queuedRecord{
+				record:    record,
+				bytesRead: bytesRead,
+				err:       err,
+				queuedAt:  time.Now(),
+			}
+			select {
+			case queueChan <- item:
+				pgf.pipelineQueueLength.Set(float64(len(queueChan)))
+			case <-stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return queueChan, doneChan
+}
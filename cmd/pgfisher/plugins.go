@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"plugin"
+	"strings"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The suffix of the files loadGoPlugin can load.
+const goPluginSuffix = ".so"
+
+// Returns the name a plugin loaded from path is registered under if its
+// configuration doesn't say otherwise, e.g. "errors" for
+// "/usr/lib/pgfisher/errors.so".
+func goPluginName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), goPluginSuffix)
+}
+
+// loadGoPlugin loads a plugin built with "go build -buildmode=plugin".  The
+// plugin can either register itself in an init function, or export a function
+// called PGFisherPluginInit, which is then registered under name.
+func loadGoPlugin(name string, path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not load plugin %s: %s", path, err)
+	}
+	sym, err := p.Lookup("PGFisherPluginInit")
+	if err != nil {
+		if _, ok := shared.LookupPlugin(name); ok {
+			return nil
+		}
+		return fmt.Errorf("plugin %s neither exports PGFisherPluginInit nor registers a plugin called %q", path, name)
+	}
+	initFunc, ok := sym.(func(shared.PluginInitArgs) (shared.Plugin, error))
+	if !ok {
+		return fmt.Errorf("PGFisherPluginInit in plugin %s has unexpected type %T", path, sym)
+	}
+	if _, ok := shared.LookupPlugin(name); ok {
+		return fmt.Errorf("plugin %s can't be registered as %q: the name is already in use", path, name)
+	}
+	shared.RegisterPlugin(name, initFunc)
+	return nil
+}
+
+// How long to wait for asynchronous plugins to process the records passed to
+// them before persisting the position in the log stream.  If they don't finish
+// in time, the position isn't persisted until the next attempt.
+const defaultAsyncPluginWaitTimeout = 10 * time.Second
+
+// Returns how long to wait for the asynchronous plugins.  When shutting down,
+// there is no next attempt, and handleShutdownSignals exits once
+// shutdown_timeout has passed, so only half of it is used for waiting, leaving
+// the rest for persisting the position and closing everything.
+func (pgf *PGFisher) asyncPluginWaitTimeout() time.Duration {
+	select {
+	case <-pgf.shutdownChan:
+		timeout := pgf.config.Tail.ShutdownTimeout.Duration / 2
+		if timeout < defaultAsyncPluginWaitTimeout {
+			return timeout
+		}
+	default:
+	}
+	return defaultAsyncPluginWaitTimeout
+}
+
+// asyncPlugin is implemented by plugins which process records in the
+// background, i.e. external plugins.  Their Process only queues the record, so
+// errors are reported separately.
+type asyncPlugin interface {
+	// Blocks until every record passed to Process has been processed, or
+	// until timeout has passed.  Returns false on timeout.
+	waitProcessed(timeout time.Duration) bool
+	// Returns the errors from processing records since the last call.
+	takeFailures() []error
+}
+
+// A plugin which has been initialized, and how to handle its errors.
+type runningPlugin struct {
+	name    string
+	plugin  shared.Plugin
+	onError string
+	// nil if all records are passed to the plugin
+	filter *recordFilter
+	// nil unless the plugin implements shared.BatchProcessor
+	batchProcessor shared.BatchProcessor
+	// nil unless the plugin implements asyncPlugin
+	async  asyncPlugin
+	config PluginConfig
+	// The records collected for the next batch
+	batch      [][]string
+	batchBytes int64
+	batchStart time.Time
+	// The position of the last record in batch
+	batchPos shared.LogStreamPosition
+	// Set after an error if onError is pluginOnErrorDisable.  A disabled
+	// plugin isn't called again.
+	disabled bool
+}
+
+func (pgf *PGFisher) loadPlugins() error {
+	for _, pc := range pgf.config.Plugins {
+		// already checked by applyConfig
+		initFunc, _ := shared.LookupPlugin(pc.Name)
+		args := shared.PluginInitArgs{
+			Name:               pc.Name,
+			DBH:                pgf.dbh.BoltDBHandle(),
+			PrometheusRegistry: pgf.prometheusRegistry,
+			Args:               pc.Args,
+			Config:             pc.Config,
+			Bucket:             pgf.dbh.CreatePluginBucket(pc.Name),
+			LogTimezone:        logTimezone,
+			HTTPMux:            pgf.httpMux,
+		}
+		var filter *recordFilter
+		if pc.Filter != "" {
+			var err error
+			// already checked by applyConfig
+			filter, err = compileRecordFilter(pc.Filter)
+			if err != nil {
+				return err
+			}
+		}
+		p, err := initFunc(args)
+		if err != nil {
+			return fmt.Errorf("could not initialize plugin %q: %s", pc.Name, err)
+		}
+		batchProcessor, _ := p.(shared.BatchProcessor)
+		async, _ := p.(asyncPlugin)
+		pgf.plugins = append(pgf.plugins, &runningPlugin{
+			name:           pc.Name,
+			plugin:         p,
+			onError:        pc.OnError,
+			filter:         filter,
+			batchProcessor: batchProcessor,
+			async:          async,
+			config:         pc,
+		})
+	}
+	return nil
+}
+
+// Handles an error returned by the plugin's function called function.
+func (pgf *PGFisher) pluginFailed(p *runningPlugin, function string, err error) {
+	pgf.pluginErrorsTotal.WithLabelValues(p.name).Inc()
+	switch p.onError {
+	case pluginOnErrorSkip:
+		log.Printf("the %s function of plugin %q failed: %s", function, p.name, err)
+	case pluginOnErrorDisable:
+		log.Printf("the %s function of plugin %q failed: %s; disabling the plugin", function, p.name, err)
+		p.disabled = true
+	default:
+		log.Fatalf("the %s function of plugin %q failed: %s", function, p.name, err)
+	}
+}
+
+// Passes record to every plugin whose filter it matches, in the order they
+// were configured in.
+func (pgf *PGFisher) processRecord(streamPos *shared.LogStreamPosition, record []string) {
+	for _, p := range pgf.plugins {
+		if p.disabled {
+			continue
+		}
+		if p.filter != nil && !p.filter.Match(record) {
+			pgf.recordsFilteredTotal.WithLabelValues(p.name).Inc()
+			continue
+		}
+		if p.batchProcessor != nil {
+			pgf.addToBatch(p, streamPos, record)
+			continue
+		}
+		err := p.plugin.Process(streamPos, record)
+		if err != nil {
+			pgf.pluginFailed(p, "Process", err)
+		}
+		pgf.reportAsyncFailures(p)
+	}
+	pgf.pluginsIdle = false
+}
+
+// Handles the errors an asynchronous plugin has reported since the last call
+// like errors returned by Process.
+func (pgf *PGFisher) reportAsyncFailures(p *runningPlugin) {
+	if p.async == nil {
+		return
+	}
+	for _, err := range p.async.takeFailures() {
+		if p.disabled {
+			break
+		}
+		pgf.pluginFailed(p, "Process", err)
+	}
+}
+
+// Waits for the asynchronous plugins to process every record passed to them,
+// so that the position in the log stream can be persisted.  Returns false if
+// one of them didn't finish within timeout.
+func (pgf *PGFisher) waitForAsyncPlugins(timeout time.Duration) bool {
+	for _, p := range pgf.plugins {
+		if p.async == nil || p.disabled {
+			continue
+		}
+		if !p.async.waitProcessed(timeout) {
+			log.Printf("plugin %q has not processed all records after %s; not persisting the position", p.name, timeout)
+			return false
+		}
+		pgf.reportAsyncFailures(p)
+	}
+	return true
+}
+
+func (pgf *PGFisher) addToBatch(p *runningPlugin, streamPos *shared.LogStreamPosition, record []string) {
+	if len(p.batch) == 0 {
+		p.batchStart = time.Now()
+	}
+	p.batch = append(p.batch, record)
+	for _, value := range record {
+		p.batchBytes += int64(len(value))
+	}
+	p.batchPos = *streamPos
+	if len(p.batch) >= p.config.BatchMaxRecords ||
+		p.batchBytes >= p.config.BatchMaxBytes ||
+		time.Since(p.batchStart) >= p.config.BatchMaxLatency.Duration {
+		pgf.flushBatch(p)
+	}
+}
+
+// Passes the records collected so far to the plugin.
+func (pgf *PGFisher) flushBatch(p *runningPlugin) {
+	if len(p.batch) == 0 {
+		return
+	}
+	batch := p.batch
+	p.batch = nil
+	p.batchBytes = 0
+	err := p.batchProcessor.ProcessBatch(&p.batchPos, batch)
+	if err != nil {
+		pgf.pluginFailed(p, "ProcessBatch", err)
+	}
+}
+
+// Flushes the batches of all plugins, or only the ones which have reached
+// their batch_max_latency if onlyExpired is true.
+func (pgf *PGFisher) flushBatches(onlyExpired bool) {
+	for _, p := range pgf.plugins {
+		if p.disabled || len(p.batch) == 0 {
+			continue
+		}
+		if onlyExpired && time.Since(p.batchStart) < p.config.BatchMaxLatency.Duration {
+			continue
+		}
+		pgf.flushBatch(p)
+	}
+}
+
+// Returns how long until the next batch reaches its batch_max_latency, or
+// false if there are no batches waiting.
+func (pgf *PGFisher) nextBatchExpiry() (time.Duration, bool) {
+	var next time.Duration
+	found := false
+	for _, p := range pgf.plugins {
+		if p.disabled || len(p.batch) == 0 {
+			continue
+		}
+		remaining := p.config.BatchMaxLatency.Duration - time.Since(p.batchStart)
+		if !found || remaining < next {
+			next = remaining
+			found = true
+		}
+	}
+	return next, found
+}
+
+func (pgf *PGFisher) notifyFileSwitched(previous shared.LogStreamPosition, streamPos *shared.LogStreamPosition) {
+	for _, p := range pgf.plugins {
+		switcher, ok := p.plugin.(shared.FileSwitcher)
+		if !ok || p.disabled {
+			continue
+		}
+		err := switcher.FileSwitched(previous, streamPos)
+		if err != nil {
+			pgf.pluginFailed(p, "FileSwitched", err)
+		}
+	}
+}
+
+// Tells the plugins we've reached the end of the log stream, unless they
+// already know.
+func (pgf *PGFisher) notifyIdle(streamPos *shared.LogStreamPosition) {
+	if pgf.pluginsIdle {
+		return
+	}
+	pgf.pluginsIdle = true
+	for _, p := range pgf.plugins {
+		pgf.reportAsyncFailures(p)
+		notifier, ok := p.plugin.(shared.IdleNotifier)
+		if !ok || p.disabled {
+			continue
+		}
+		err := notifier.Idle(streamPos)
+		if err != nil {
+			pgf.pluginFailed(p, "Idle", err)
+		}
+	}
+}
+
+// Called in the transaction persisting streamPos.  Any error is fatal
+// regardless of the plugin's on_error setting, since the transaction can't
+// be committed without the plugin's state.
+func (pgf *PGFisher) checkpointPlugins(tx *bolt.Tx, streamPos *shared.LogStreamPosition) error {
+	for _, p := range pgf.plugins {
+		checkpointer, ok := p.plugin.(shared.Checkpointer)
+		if !ok || p.disabled {
+			continue
+		}
+		err := checkpointer.Checkpoint(tx, streamPos)
+		if err != nil {
+			return fmt.Errorf("plugin %q: %s", p.name, err)
+		}
+	}
+	return nil
+}
+
+// Closes all plugins, even if some of them fail.  Returns the first error.
+func (pgf *PGFisher) closePlugins() error {
+	var firstErr error
+	for _, p := range pgf.plugins {
+		closer, ok := p.plugin.(shared.Closer)
+		if !ok || p.disabled {
+			continue
+		}
+		err := closer.Close()
+		if err != nil {
+			err = fmt.Errorf("the Close function of plugin %q failed: %s", p.name, err)
+			log.Print(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+// The formats accepted by parseTimeArg, most specific first.
+var timeArgLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTimeArg parses a point in time given on the command line, such as
+// "2024-10-01 00:00".  Times without a time zone are in loc.
+func parseTimeArg(value string, loc *time.Location) (time.Time, error) {
+	for _, layout := range timeArgLayouts {
+		t, err := time.ParseInLocation(layout, value, loc)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q; expected e.g. \"2006-01-02 15:04:05\"", value)
+}
+
+// selectReplayFiles returns the names of the files in logPath which might
+// contain records logged between since and until, in the order they should be
+// read in.  Either time can be zero, meaning no limit.
+func selectReplayFiles(since time.Time, until time.Time) []string {
+	files := listLogFiles()
+	sortLogFiles(files)
+
+	var names []string
+	for _, file := range files {
+		// A file can't contain records written after it was last modified,
+		// and with monotonic names, records written before the time in its
+		// name.
+		if !since.IsZero() && file.modTime.Before(since) {
+			continue
+		}
+		if !until.IsZero() && logFilename.NamesAreMonotonic() && !file.nameTime.Before(until) {
+			continue
+		}
+		names = append(names, file.name)
+	}
+	return names
+}
+
+// timeRangeLogReader skips the records of a logReader whose log_time is not
+// in [since, until).  Either time can be zero, meaning no limit.  Records
+// whose log_time can't be parsed are never skipped.
+type timeRangeLogReader struct {
+	logReader
+	since time.Time
+	until time.Time
+}
+
+func (r *timeRangeLogReader) Read() ([]string, int64, error) {
+	// The bytes of the skipped records are included in the next record
+	// returned, so that the position in the log stream stays correct.
+	var skippedBytes int64
+	for {
+		record, bytesRead, err := r.logReader.Read()
+		if err == io.EOF {
+			// The skipped records at the end of the file have still been
+			// read.
+			return nil, skippedBytes + bytesRead, err
+		} else if err != nil {
+			return record, bytesRead, err
+		}
+		logTime, err := shared.ParseLogTimestamp(record[shared.LogTimeAttno], logTimezone)
+		if err == nil &&
+			((!r.since.IsZero() && logTime.Before(r.since)) ||
+				(!r.until.IsZero() && !logTime.Before(r.until))) {
+			skippedBytes += bytesRead
+			continue
+		}
+		return record, skippedBytes + bytesRead, nil
+	}
+}
+
+// Replay reads files in logPath from their beginning to their end, and
+// passes the records to the plugins.  Returns nil once all files have been
+// read or Shutdown has been called, and everything has been shut down
+// cleanly.
+func (pgf *PGFisher) Replay(files []string, since time.Time, until time.Time) error {
+	err := pgf.loadPlugins()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	pgf.startMetricsServer()
+
+	var streamPos shared.LogStreamPosition
+	if !pgf.noPersist {
+		// only to keep BytesReadTotal
+		streamPos = pgf.dbh.ReadLogStreamPosition()
+	}
+	for i, filename := range files {
+		previous := streamPos
+		streamPos.Filename = filename
+		streamPos.Offset = 0
+		resetLogFileIdentity(&streamPos)
+		if i > 0 {
+			pgf.notifyFileSwitched(previous, &streamPos)
+		}
+		log.Printf("replaying file %q", filename)
+
+		filepath := path.Join(logPath, filename)
+		fh, err := os.Open(filepath)
+		if err != nil {
+			log.Fatalf("could not open file %q: %s", filepath, err)
+		}
+		// records the identity of the file
+		err = pgf.checkLogFileIdentity(fh, &streamPos)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		var reader logReader = newLogReader(fh, filename, true)
+		if !since.IsZero() || !until.IsZero() {
+			reader = &timeRangeLogReader{reader, since, until}
+		}
+		err = pgf.readFromFileUntilError(reader, &streamPos)
+		if err == errShutdown {
+			fh.Close()
+			return pgf.shutdown(&streamPos)
+		} else if err != io.EOF {
+			log.Fatal(err.Error())
+		}
+		err = fh.Close()
+		if err != nil {
+			log.Fatalf("could not close file %q: %s", filename, err)
+		}
+		pgf.persistLogStreamPosition(&streamPos)
+	}
+
+	log.Printf("reached the end of the last file")
+	return pgf.shutdown(&streamPos)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+func TestParseTimeArg(t *testing.T) {
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		value string
+		// the zero time if an error is expected
+		expected time.Time
+	}{
+		{"2024-10-01T13:00:00.5Z", time.Date(2024, 10, 1, 13, 0, 0, 5e8, time.UTC)},
+		{"2024-10-01T13:00:00+02:00", time.Date(2024, 10, 1, 11, 0, 0, 0, time.UTC)},
+		{"2024-10-01 13:00:00", time.Date(2024, 10, 1, 13, 0, 0, 0, helsinki)},
+		{"2024-10-01 13:00", time.Date(2024, 10, 1, 13, 0, 0, 0, helsinki)},
+		{"2024-10-01", time.Date(2024, 10, 1, 0, 0, 0, 0, helsinki)},
+		{"2024-10-01 13", time.Time{}},
+		{"yesterday", time.Time{}},
+		{"", time.Time{}},
+	}
+	for _, tc := range testCases {
+		got, err := parseTimeArg(tc.value, helsinki)
+		if tc.expected.IsZero() {
+			if err == nil {
+				t.Errorf("parseTimeArg(%q) = %s; expected an error", tc.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTimeArg(%q): %s", tc.value, err)
+		} else if !got.Equal(tc.expected) {
+			t.Errorf("parseTimeArg(%q) = %s; expected %s", tc.value, got, tc.expected)
+		}
+	}
+}
+
+// Returns the records of a fixed list, each taking up 100 bytes.
+type fakeLogReader struct {
+	logTimes []string
+}
+
+func (r *fakeLogReader) Read() ([]string, int64, error) {
+	if len(r.logTimes) == 0 {
+		return nil, 0, io.EOF
+	}
+	record := shared.LatestCSVLogSchema().NewRecord(map[int]string{
+		shared.LogTimeAttno: r.logTimes[0],
+	})
+	r.logTimes = r.logTimes[1:]
+	return record, 100, nil
+}
+
+func (r *fakeLogReader) Format() string {
+	return logFormatCSV
+}
+
+func TestTimeRangeLogReader(t *testing.T) {
+	since := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 10, 1, 13, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		logTimes []string
+		since    time.Time
+		until    time.Time
+		// the log_time of each record returned, then "EOF"
+		expected []string
+		// the bytes returned with each record and with io.EOF
+		expectedBytes []int64
+	}{
+		{
+			name:          "no limits",
+			logTimes:      []string{"2024-10-01 11:00:00 UTC", "2024-10-01 14:00:00 UTC"},
+			expected:      []string{"2024-10-01 11:00:00 UTC", "2024-10-01 14:00:00 UTC", "EOF"},
+			expectedBytes: []int64{100, 100, 0},
+		},
+		{
+			name:          "skipped at the beginning and the end",
+			logTimes:      []string{"2024-10-01 11:00:00 UTC", "2024-10-01 11:59:59.999 UTC", "2024-10-01 12:00:00 UTC", "2024-10-01 12:59:59.999 UTC", "2024-10-01 13:00:00 UTC", "2024-10-01 14:00:00 UTC"},
+			since:         since,
+			until:         until,
+			expected:      []string{"2024-10-01 12:00:00 UTC", "2024-10-01 12:59:59.999 UTC", "EOF"},
+			expectedBytes: []int64{300, 100, 200},
+		},
+		{
+			name:          "everything skipped",
+			logTimes:      []string{"2024-10-01 11:00:00 UTC", "2024-10-01 14:00:00 UTC"},
+			since:         since,
+			until:         until,
+			expected:      []string{"EOF"},
+			expectedBytes: []int64{200},
+		},
+		{
+			name:          "only since",
+			logTimes:      []string{"2024-10-01 11:00:00 UTC", "2024-10-01 14:00:00 UTC"},
+			since:         since,
+			expected:      []string{"2024-10-01 14:00:00 UTC", "EOF"},
+			expectedBytes: []int64{200, 0},
+		},
+		{
+			name:          "only until",
+			logTimes:      []string{"2024-10-01 11:00:00 UTC", "2024-10-01 14:00:00 UTC"},
+			until:         until,
+			expected:      []string{"2024-10-01 11:00:00 UTC", "EOF"},
+			expectedBytes: []int64{100, 100},
+		},
+		{
+			name:          "unparseable log_time is never skipped",
+			logTimes:      []string{"2024-10-01 11:00:00 UTC", "", "2024-10-01 14:00:00 UTC"},
+			since:         since,
+			until:         until,
+			expected:      []string{"", "EOF"},
+			expectedBytes: []int64{200, 100},
+		},
+	}
+	for _, tc := range testCases {
+		reader := &timeRangeLogReader{&fakeLogReader{tc.logTimes}, tc.since, tc.until}
+		var got []string
+		var gotBytes []int64
+		for {
+			record, bytesRead, err := reader.Read()
+			gotBytes = append(gotBytes, bytesRead)
+			if err == io.EOF {
+				got = append(got, "EOF")
+				break
+			} else if err != nil {
+				t.Fatalf("%s: %s", tc.name, err)
+			}
+			got = append(got, record[shared.LogTimeAttno])
+		}
+		if len(got) != len(tc.expected) || len(gotBytes) != len(tc.expectedBytes) {
+			t.Errorf("%s: got %q, %v; expected %q, %v", tc.name, got, gotBytes, tc.expected, tc.expectedBytes)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.expected[i] || gotBytes[i] != tc.expectedBytes[i] {
+				t.Errorf("%s: got %q, %v; expected %q, %v", tc.name, got, gotBytes, tc.expected, tc.expectedBytes)
+				break
+			}
+		}
+	}
+}
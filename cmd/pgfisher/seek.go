@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+// Once the binary search has narrowed the range down to this many bytes, the
+// records in it are read one by one.
+const seekScanBytes = 64 * 1024
+
+// Later than the log_time of any record; passing this to findStartPosition
+// finds the end of the log stream.
+var endOfTime = time.Unix(1<<62, 0)
+
+// Matches the beginning of the first line of a csvlog record: log_time,
+// user_name, database_name and process_id.
+var csvRecordStartRe = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2}(\.[0-9]+)? [^,]*,("([^"]|"")*")?,("([^"]|"")*")?,[0-9]*,`)
+
+// findStartPosition returns the position of the first record in logPath
+// logged at or after since.  If there is no such record, the position is at
+// the end of the last log file.
+func findStartPosition(since time.Time) (shared.LogStreamPosition, error) {
+	files := listLogFiles()
+	if len(files) == 0 {
+		return shared.LogStreamPosition{}, fmt.Errorf("could not find any log files in directory %s", logPath)
+	}
+	sortLogFiles(files)
+
+	// Records are written in order, so the first file which was modified
+	// at or after since contains the record we're looking for, if any.
+	file := files[len(files)-1]
+	for _, f := range files {
+		if !f.modTime.Before(since) {
+			file = f
+			break
+		}
+	}
+	offset, err := seekLogFile(file.name, since)
+	if err != nil {
+		return shared.LogStreamPosition{}, err
+	}
+	return shared.LogStreamPosition{
+		Filename: file.name,
+		Offset:   offset,
+	}, nil
+}
+
+// findFirstPosition returns the position at the beginning of the first log
+// file in logPath.
+func findFirstPosition() (shared.LogStreamPosition, error) {
+	files := listLogFiles()
+	if len(files) == 0 {
+		return shared.LogStreamPosition{}, fmt.Errorf("could not find any log files in directory %s", logPath)
+	}
+	sortLogFiles(files)
+	return shared.LogStreamPosition{
+		Filename: files[0].name,
+	}, nil
+}
+
+// seekLogFile returns the offset of the first record in the log file called
+// filename whose log_time is at or after since, or the offset right after the
+// last complete record if there is no such record.  The records are assumed
+// to be in log_time order, which the server guarantees within a file.
+func seekLogFile(filename string, since time.Time) (int64, error) {
+	fh, err := os.Open(filepath.Join(logPath, filename))
+	if err != nil {
+		return 0, fmt.Errorf("could not open file %q: %s", filename, err)
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("could not stat file %q: %s", filename, err)
+	}
+	size := fi.Size()
+
+	if logFormatForFile(filename) == logFormatStderr && !logLinePrefix.includesLogTime() {
+		return 0, fmt.Errorf("can't search file %q by time: log_line_prefix %q doesn't include the time", filename, logLinePrefix.prefix)
+	}
+
+	// lo is always the beginning of a record logged before since (or of the
+	// file), and the record we're looking for never starts before it.
+	lo := int64(0)
+	hi := size
+	for hi-lo > seekScanBytes {
+		mid := lo + (hi-lo)/2
+		start, logTime, found, err := nextTimedRecord(fh, filename, mid, size)
+		if err != nil {
+			return 0, err
+		}
+		if found && start < hi && logTime.Before(since) {
+			lo = start
+		} else {
+			hi = mid
+		}
+	}
+
+	offset := lo
+	reader := newLogReader(io.NewSectionReader(fh, lo, size-lo), filename, true)
+	for {
+		record, bytesRead, err := reader.Read()
+		if err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("could not read file %q at offset %d: %s", filename, offset, err)
+		}
+		logTime, err := shared.ParseLogTimestamp(record[shared.LogTimeAttno], logTimezone)
+		if err == nil && !logTime.Before(since) {
+			return offset, nil
+		}
+		offset += bytesRead
+	}
+}
+
+// nextTimedRecord finds the first record beginning at or after offset whose
+// log_time can be parsed.  found is false if there is no such record.
+func nextTimedRecord(fh *os.File, filename string, offset int64, size int64) (start int64, logTime time.Time, found bool, err error) {
+	start, found, err = nextRecordStart(fh, logFormatForFile(filename), offset, size)
+	if err != nil || !found {
+		return 0, time.Time{}, false, err
+	}
+	reader := newLogReader(io.NewSectionReader(fh, start, size-start), filename, true)
+	for {
+		record, bytesRead, err := reader.Read()
+		if err == io.EOF {
+			return 0, time.Time{}, false, nil
+		} else if err != nil {
+			return 0, time.Time{}, false, fmt.Errorf("could not read file %q at offset %d: %s", filename, start, err)
+		}
+		logTime, err := shared.ParseLogTimestamp(record[shared.LogTimeAttno], logTimezone)
+		if err == nil {
+			return start, logTime, true, nil
+		}
+		start += bytesRead
+	}
+}
+
+// nextRecordStart returns the offset of the first line beginning at or after
+// offset which looks like the first line of a record in format.
+func nextRecordStart(fh *os.File, format string, offset int64, size int64) (int64, bool, error) {
+	if offset == 0 {
+		return 0, true, nil
+	}
+	// Start from the byte before offset, so that if offset is already at
+	// the beginning of a line, only the newline before it is skipped.
+	reader := bufio.NewReader(io.NewSectionReader(fh, offset-1, size-offset+1))
+	skipped, err := reader.ReadString('\n')
+	if err == io.EOF {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	pos := offset - 1 + int64(len(skipped))
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// an incomplete line can't be relied on
+			return 0, false, nil
+		} else if err != nil {
+			return 0, false, err
+		}
+		if isRecordStart(format, strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")) {
+			return pos, true, nil
+		}
+		pos += int64(len(line))
+	}
+}
+
+// isRecordStart reports whether line (without the trailing newline) looks
+// like the first line of a record in format.  A csvlog line inside a quoted
+// field could in theory be mistaken for one, but that would require it to
+// start with something looking exactly like the first columns of a record.
+func isRecordStart(format string, line string) bool {
+	switch format {
+	case logFormatCSV:
+		return csvRecordStartRe.MatchString(line)
+	case logFormatJSON:
+		// Newlines are always escaped in jsonlog.
+		return strings.HasPrefix(line, "{")
+	case logFormatStderr:
+		parsed, ok := logLinePrefix.parseLine(line)
+		if !ok {
+			return false
+		}
+		_, secondary := secondarySeverityAttnos[parsed.severity]
+		return !secondary
+	default:
+		panic(format)
+	}
+}
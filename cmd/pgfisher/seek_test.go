@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsRecordStart(t *testing.T) {
+	prefix, err := compileLogLinePrefix(defaultLogLinePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logLinePrefix = prefix
+	defer func() { logLinePrefix = nil }()
+
+	testCases := []struct {
+		format   string
+		line     string
+		expected bool
+	}{
+		{logFormatCSV, `2024-10-01 13:00:00.000 EEST,"app","appdb",1234,"10.0.0.1:5432",66fbc8a0.4d2,1,"SELECT"`, true},
+		{logFormatCSV, `2024-10-01 13:00:00 EEST,"app","appdb",1234,`, true},
+		// not a session process
+		{logFormatCSV, `2024-10-01 13:00:00.000 EEST,,,1234,,66fbc8a0.4d2,1,,`, true},
+		{logFormatCSV, `2024-10-01 13:00:00.000 EEST,"a ""quoted"" user","appdb",1234,`, true},
+		// the continuation of a quoted field
+		{logFormatCSV, `does not exist",,,,,,"SELECT * FROM foo",15,,"psql",client backend,,0`, false},
+		{logFormatCSV, `2024-10-01 13:00:00.000 EEST is when it happened`, false},
+		{logFormatCSV, `2024-10-01 13:00:00.000 EEST,"app","appdb",pid,`, false},
+		{logFormatCSV, ``, false},
+
+		{logFormatJSON, `{"timestamp":"2024-10-01 13:00:00.000 EEST","pid":1234}`, true},
+		{logFormatJSON, `"message":"x"}`, false},
+		{logFormatJSON, ``, false},
+
+		{logFormatStderr, `2024-10-01 13:00:00.000 EEST [1234] ERROR:  relation "foo" does not exist`, true},
+		{logFormatStderr, `2024-10-01 13:00:00.000 EEST [1234] LOG:  checkpoint starting: time`, true},
+		// secondary lines belong to the record before them
+		{logFormatStderr, `2024-10-01 13:00:00.000 EEST [1234] STATEMENT:  SELECT * FROM foo`, false},
+		{logFormatStderr, `2024-10-01 13:00:00.000 EEST [1234] DETAIL:  Key (id)=(1) already exists.`, false},
+		{logFormatStderr, "\tFROM foo", false},
+		{logFormatStderr, `some output of a library`, false},
+	}
+	for _, tc := range testCases {
+		if got := isRecordStart(tc.format, tc.line); got != tc.expected {
+			t.Errorf("isRecordStart(%q, %q) = %v; expected %v", tc.format, tc.line, got, tc.expected)
+		}
+	}
+}
+
+// A log file generated for the tests of seekLogFile.
+type seekTestFile struct {
+	contents string
+	// the offset and log_time of each record
+	offsets  []int64
+	logTimes []time.Time
+}
+
+// Writes records with log_times starting at start, several records per
+// second, each with a bit of padding to make the file large enough for the
+// binary search to have some work to do.  Every tenth record spans several
+// lines.
+func newSeekTestFile(format string, start time.Time, numRecords int) seekTestFile {
+	var f seekTestFile
+	var b strings.Builder
+	padding := strings.Repeat("x", 80)
+	for i := 0; i < numRecords; i++ {
+		logTime := start.Add(time.Duration(i/3) * time.Second)
+		ts := logTime.Format("2006-01-02 15:04:05.000 MST")
+		f.offsets = append(f.offsets, int64(b.Len()))
+		f.logTimes = append(f.logTimes, logTime)
+		multiLine := i%10 == 0
+		switch format {
+		case logFormatCSV:
+			message := fmt.Sprintf("message %d %s", i, padding)
+			if multiLine {
+				// a line inside the quoted field which looks like the
+				// beginning of a record, except for the quote
+				message += "\n\"" + ts + `,"app","appdb",1,`
+			}
+			fmt.Fprintf(&b, "%s,\"app\",\"appdb\",%d,,,%d,,,,0,LOG,00000,\"%s\",,,,,,,,,\"psql\",client backend,,0\n",
+				ts, 1000+i%7, i, strings.ReplaceAll(message, `"`, `""`))
+		case logFormatJSON:
+			fmt.Fprintf(&b, "{\"timestamp\":\"%s\",\"pid\":%d,\"error_severity\":\"LOG\",\"message\":\"message %d %s\"}\n",
+				ts, 1000+i%7, i, padding)
+		case logFormatStderr:
+			fmt.Fprintf(&b, "%s [%d] LOG:  message %d %s\n", ts, 1000+i%7, i, padding)
+			if multiLine {
+				fmt.Fprintf(&b, "\tcontinued\n")
+				fmt.Fprintf(&b, "%s [%d] STATEMENT:  SELECT %d\n", ts, 1000+i%7, i)
+			}
+		default:
+			panic(format)
+		}
+	}
+	f.contents = b.String()
+	return f
+}
+
+// Returns the offset of the first record logged at or after since.
+func (f seekTestFile) expectedOffset(since time.Time) int64 {
+	for i, logTime := range f.logTimes {
+		if !logTime.Before(since) {
+			return f.offsets[i]
+		}
+	}
+	return int64(len(f.contents))
+}
+
+func TestSeekLogFile(t *testing.T) {
+	prefix, err := compileLogLinePrefix(defaultLogLinePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logPath = t.TempDir()
+	logLinePrefix = prefix
+	logTimezone = time.UTC
+	defer func() {
+		logPath = ""
+		logLinePrefix = nil
+		logTimezone = nil
+	}()
+
+	start := time.Date(2024, 10, 1, 13, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		filename string
+		format   string
+	}{
+		{"postgresql.csv", logFormatCSV},
+		{"postgresql.json", logFormatJSON},
+		{"postgresql.log", logFormatStderr},
+	} {
+		// 3000 records take up a few hundred kilobytes.
+		f := newSeekTestFile(tc.format, start, 3000)
+		if len(f.contents) < 4*seekScanBytes {
+			t.Fatalf("%s: the file is too small to be searched: %d bytes", tc.filename, len(f.contents))
+		}
+		// An incomplete record at the end is never returned.
+		contents := f.contents + strings.SplitAfter(f.contents, "\n")[0][:20]
+		err := os.WriteFile(filepath.Join(logPath, tc.filename), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, since := range []time.Time{
+			start.Add(-time.Hour),
+			start,
+			start.Add(time.Millisecond),
+			start.Add(1 * time.Second),
+			start.Add(333 * time.Second),
+			start.Add(333*time.Second + 500*time.Millisecond),
+			start.Add(500 * time.Second),
+			start.Add(998 * time.Second),
+			start.Add(999 * time.Second),
+			start.Add(999*time.Second + time.Millisecond),
+			start.Add(time.Hour),
+			endOfTime,
+		} {
+			expected := f.expectedOffset(since)
+			offset, err := seekLogFile(tc.filename, since)
+			if err != nil {
+				t.Errorf("%s: seekLogFile(%s): %s", tc.filename, since, err)
+			} else if offset != expected {
+				t.Errorf("%s: seekLogFile(%s) = %d; expected %d", tc.filename, since, offset, expected)
+			}
+		}
+	}
+}
+
+func TestSeekLogFileWithoutLogTime(t *testing.T) {
+	prefix, err := compileLogLinePrefix("[%p] ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logPath = t.TempDir()
+	logLinePrefix = prefix
+	defer func() {
+		logPath = ""
+		logLinePrefix = nil
+	}()
+	err = os.WriteFile(filepath.Join(logPath, "postgresql.log"), []byte("[1234] LOG:  message\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = seekLogFile("postgresql.log", time.Now())
+	if err == nil {
+		t.Errorf("seekLogFile did not return an error for a log_line_prefix without the time")
+	}
+}
+
+func TestFindStartPosition(t *testing.T) {
+	pattern, err := ParseLogFilenamePattern("postgresql-%Y-%m-%d.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logPath = t.TempDir()
+	logFilename = pattern
+	logTimezone = time.UTC
+	defer func() {
+		logPath = ""
+		logFilename = nil
+		logTimezone = nil
+	}()
+
+	// Each file contains a day's worth of records, and was last modified
+	// when the last one was written.
+	day1 := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	files := []struct {
+		name string
+		f    seekTestFile
+	}{
+		{"postgresql-2024-10-01.csv", newSeekTestFile(logFormatCSV, day1, 30)},
+		{"postgresql-2024-10-02.csv", newSeekTestFile(logFormatCSV, day2, 30)},
+	}
+	for _, file := range files {
+		path := filepath.Join(logPath, file.name)
+		err := os.WriteFile(path, []byte(file.f.contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modTime := file.f.logTimes[len(file.f.logTimes)-1]
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, err := findFirstPosition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Filename != files[0].name || first.Offset != 0 {
+		t.Errorf("findFirstPosition() = %q, %d; expected %q, 0", first.Filename, first.Offset, files[0].name)
+	}
+
+	testCases := []struct {
+		since    time.Time
+		file     int
+		expected int64
+	}{
+		{day1.Add(-time.Hour), 0, 0},
+		{day1.Add(5 * time.Second), 0, files[0].f.expectedOffset(day1.Add(5 * time.Second))},
+		// after the last record of the first file
+		{day1.Add(time.Hour), 1, 0},
+		{day2.Add(5 * time.Second), 1, files[1].f.expectedOffset(day2.Add(5 * time.Second))},
+		// after everything: the end of the last file
+		{day2.Add(time.Hour), 1, int64(len(files[1].f.contents))},
+	}
+	for _, tc := range testCases {
+		pos, err := findStartPosition(tc.since)
+		if err != nil {
+			t.Errorf("findStartPosition(%s): %s", tc.since, err)
+			continue
+		}
+		if pos.Filename != files[tc.file].name || pos.Offset != tc.expected {
+			t.Errorf("findStartPosition(%s) = %q, %d; expected %q, %d", tc.since, pos.Filename, pos.Offset, files[tc.file].name, tc.expected)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -8,37 +11,76 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	csv "github.com/johto/go-csvt"
-	plugin "github.com/johto/pgfisher/internal/plugin"
 	shared "github.com/johto/pgfisher/internal/plugin_interface"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	bolt "go.etcd.io/bbolt"
 )
 
+// Returned by the read loop functions when asked to shut down.
+var errShutdown = errors.New("shutting down")
+
 type PGFisher struct {
-	dbh                *PGFisherDatabase
+	config *Config
+	dbh    *PGFisherDatabase
+	// If set, the position in the log stream is never written into the
+	// database.
+	noPersist bool
+
+	// nil if metrics are disabled
 	prometheusListener net.Listener
 	prometheusRegistry *prometheus.Registry
-
-	plugin shared.Plugin
+	// The mux of metricsServer, on which plugins can register handlers
+	// as well.  nil if metrics are disabled.
+	httpMux       *http.ServeMux
+	metricsServer *http.Server
+
+	// Closed when the main loop should stop reading.
+	shutdownChan chan struct{}
+	shutdownOnce sync.Once
+
+	plugins []*runningPlugin
+	// Whether the plugins have been told that we're waiting for more data,
+	// and no records have been processed since.
+	pluginsIdle          bool
+	pluginErrorsTotal    *prometheus.CounterVec
+	recordsFilteredTotal *prometheus.CounterVec
+	pipelineQueueLength  prometheus.Gauge
+	pipelineStageSeconds *prometheus.HistogramVec
 
 	// Channel used by directoryWatcherLoop to communicate the next file the
-	// main loop should use.
-	newFilenameChan chan string
+	// main loop should use, and the position to start reading it from.
+	nextFileChan chan shared.LogStreamPosition
+
+	// The positions the main loop left files at.  If the server starts
+	// writing to one of them again, it's resumed from there; see
+	// startPosition.
+	readFilesLock sync.Mutex
+	readFiles     map[string]shared.LogStreamPosition
+
+	// The number of columns in the csvlog records read most recently; see
+	// checkCSVRecordLength.
+	csvNumColumns int
 
 	bytesReadTotal            prometheus.Counter
 	bytesReadSinceLastPersist int64
+	logFileResetsTotal        prometheus.Counter
 }
 
-func NewPGFisher(dbh *bolt.DB, prometheusAddr string) *PGFisher {
-	listener, err := net.Listen("tcp", prometheusAddr)
-	if err != nil {
-		log.Fatalf("could not start listening on %s: %s", prometheusAddr, err)
+func NewPGFisher(dbh *bolt.DB, config *Config) *PGFisher {
+	var listener net.Listener
+	var httpMux *http.ServeMux
+	if prometheusAddr := config.Metrics.ListenAddress; prometheusAddr != "" {
+		var err error
+		listener, err = net.Listen("tcp", prometheusAddr)
+		if err != nil {
+			log.Fatalf("could not start listening on %s: %s", prometheusAddr, err)
+		}
+		httpMux = http.NewServeMux()
 	}
 	registry := prometheus.NewPedanticRegistry()
 
@@ -59,50 +101,92 @@ func NewPGFisher(dbh *bolt.DB, prometheusAddr string) *PGFisher {
 	)
 	registry.MustRegister(bytesReadTotal)
 
+	logFileResetsTotal := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgfisher_log_file_resets_total",
+			Help: "The number of times a log file was found truncated or replaced and read again from its beginning.",
+		},
+	)
+	registry.MustRegister(logFileResetsTotal)
+
+	pluginErrorsTotal := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pgfisher_plugin_errors_total",
+			Help: "The number of errors returned by each plugin.",
+		},
+		[]string{"plugin"},
+	)
+	registry.MustRegister(pluginErrorsTotal)
+
+	recordsFilteredTotal := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pgfisher_records_filtered_total",
+			Help: "The number of records not passed to each plugin because they didn't match its filter.",
+		},
+		[]string{"plugin"},
+	)
+	registry.MustRegister(recordsFilteredTotal)
+
+	pipelineQueueLength := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pgfisher_pipeline_queue_length",
+			Help: "The number of records read and waiting to be processed.",
+		},
+	)
+	registry.MustRegister(pipelineQueueLength)
+
+	pipelineStageSeconds := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pgfisher_pipeline_stage_duration_seconds",
+			Help:    "The time spent on each record in each stage of the pipeline: reading and parsing it, waiting in the queue, and processing it in the plugins.",
+			Buckets: prometheus.ExponentialBuckets(0.000001, 4, 12),
+		},
+		[]string{"stage"},
+	)
+	registry.MustRegister(pipelineStageSeconds)
+
 	pgf := &PGFisher{
+		config:                    config,
 		dbh:                       NewPGFisherDatabase(dbh),
 		prometheusListener:        listener,
 		prometheusRegistry:        registry,
-		newFilenameChan:           make(chan string, 1),
+		httpMux:                   httpMux,
+		shutdownChan:              make(chan struct{}),
+		nextFileChan:              make(chan shared.LogStreamPosition, 1),
+		readFiles:                 make(map[string]shared.LogStreamPosition),
 		bytesReadTotal:            bytesReadTotal,
 		bytesReadSinceLastPersist: 0,
+		logFileResetsTotal:        logFileResetsTotal,
+		pluginErrorsTotal:         pluginErrorsTotal,
+		recordsFilteredTotal:      recordsFilteredTotal,
+		pipelineQueueLength:       pipelineQueueLength,
+		pipelineStageSeconds:      pipelineStageSeconds,
 	}
 	return pgf
 }
 
-func (pgf *PGFisher) MainLoop() {
-	pgf.newFilenameChan = make(chan string, 1)
+// MainLoop tails the log stream until Shutdown is called.  Returns nil if
+// everything was shut down cleanly.
+func (pgf *PGFisher) MainLoop() error {
+	pgf.nextFileChan = make(chan shared.LogStreamPosition, 1)
 
-	err := pgf.loadPlugin()
+	err := pgf.loadPlugins()
 	if err != nil {
-		log.Fatalf("could not initialize plugin: %s", err)
+		log.Fatal(err.Error())
 	}
-
-	go func() {
-		muxer := http.NewServeMux()
-		handler := promhttp.HandlerFor(
-			pgf.prometheusRegistry,
-			promhttp.HandlerOpts{
-				ErrorLog: log.Default(),
-			},
-		)
-		muxer.Handle("/metrics", handler)
-		s := &http.Server{
-			Handler: muxer,
-		}
-		log.Fatal(s.Serve(pgf.prometheusListener))
-	}()
+	pgf.startMetricsServer()
 
 	streamPos := pgf.dbh.ReadLogStreamPosition()
-	epollFilenameChan, files := pgf.doInitialRead(streamPos.Filename)
+	epollFileChan, currentFile, files := pgf.doInitialRead(streamPos.Filename)
 	if streamPos.Filename == "" {
 		if len(files) == 0 {
 			log.Fatalf("could not find any suitable log files in directory %s", logPath)
 		}
-		streamPos.Filename = files[0]
+		currentFile = files[0]
+		streamPos.Filename = currentFile.name
 		files = files[1:]
 	}
-	go pgf.directoryWatcherLoop(epollFilenameChan, files)
+	go pgf.directoryWatcherLoop(epollFileChan, currentFile, files)
 
 	log.Printf("starting to tail from file %q, position %d", streamPos.Filename, streamPos.Offset)
 
@@ -114,7 +198,15 @@ func (pgf *PGFisher) MainLoop() {
 		}
 
 		err = pgf.readFromFileUntilEOF(fh, &streamPos)
-		if err != nil {
+		if err == errShutdown {
+			// make sure the persisted fingerprint is up to date
+			err = pgf.checkLogFileIdentity(fh, &streamPos)
+			if err != nil {
+				log.Print(err)
+			}
+			fh.Close()
+			return pgf.shutdown(&streamPos)
+		} else if err != nil {
 			log.Fatal(err.Error())
 		}
 
@@ -127,50 +219,128 @@ func (pgf *PGFisher) MainLoop() {
 	}
 }
 
-func (pgf *PGFisher) loadPlugin() error {
+func (pgf *PGFisher) startMetricsServer() {
+	if pgf.prometheusListener == nil {
+		return
+	}
+	handler := promhttp.HandlerFor(
+		pgf.prometheusRegistry,
+		promhttp.HandlerOpts{
+			ErrorLog: log.Default(),
+		},
+	)
+	pgf.httpMux.Handle("/metrics", handler)
+	pgf.metricsServer = &http.Server{
+		Handler: pgf.httpMux,
+	}
+	go func() {
+		err := pgf.metricsServer.Serve(pgf.prometheusListener)
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+}
+
+// Shutdown asks the main loop to stop reading after the record currently
+// being processed.  Safe to call from any goroutine, any number of times.
+func (pgf *PGFisher) Shutdown() {
+	pgf.shutdownOnce.Do(func() {
+		close(pgf.shutdownChan)
+	})
+}
+
+// Called by the main loop once it has stopped reading.  streamPos is the
+// position right after the last record processed.
+func (pgf *PGFisher) shutdown(streamPos *shared.LogStreamPosition) error {
+	log.Printf("shutting down at file %q, position %d", streamPos.Filename, streamPos.Offset)
+
+	// Checkpoints the plugins, after flushing their batches so that the
+	// position doesn't move past records a plugin hasn't processed yet.  This
+	// is done first, since handleShutdownSignals exits once shutdown_timeout
+	// has passed, and nothing else may keep the final position from being
+	// persisted.
+	pgf.persistLogStreamPosition(streamPos)
+
+	// The plugins' HTTP handlers read the database, so the server has to be
+	// shut down before the plugins and the database are closed.  A slow
+	// scrape only gets a part of the time left.
 	var err error
-	args := shared.PluginInitArgs{
-		DBH:                pgf.dbh.BoltDBHandle(),
-		PrometheusRegistry: pgf.prometheusRegistry,
-		Args:               "",
+	if pgf.metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), pgf.config.Tail.ShutdownTimeout.Duration/4)
+		defer cancel()
+		httpErr := pgf.metricsServer.Shutdown(ctx)
+		if httpErr != nil {
+			err = fmt.Errorf("could not shut down the metrics server: %s", httpErr)
+		}
+	}
+
+	closeErr := pgf.closePlugins()
+	if closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	dbErr := pgf.dbh.Close()
+	if dbErr != nil && err == nil {
+		err = fmt.Errorf("could not close database: %s", dbErr)
 	}
-	pgf.plugin, err = plugin.PGFisherPluginInit(args)
 	return err
 }
 
 func (pgf *PGFisher) readFromFileUntilEOF(fh *os.File, streamPos *shared.LogStreamPosition) error {
 	tailfTimer := time.NewTimer(time.Hour)
-	nextFilename := ""
+	var nextFile shared.LogStreamPosition
 
 	for {
-		fh.Seek(streamPos.Offset, os.SEEK_SET)
-		reader := csv.NewReader(fh)
-		reader.RequireTrailingNewline = true
-		err := pgf.readFromFileUntilError(reader, streamPos)
+		// Make sure the file wasn't truncated from under us since we last
+		// looked at it.
+		err := pgf.checkLogFileIdentity(fh, streamPos)
 		if err != nil {
-			if err == io.EOF && nextFilename != "" {
-				log.Printf("read loop: switching over to file %s", nextFilename)
-				streamPos.Filename = nextFilename
-				streamPos.Offset = 0
+			return err
+		}
+
+		fh.Seek(streamPos.Offset, os.SEEK_SET)
+		reader := newLogReader(fh, streamPos.Filename, nextFile.Filename != "")
+		err = pgf.readFromFileUntilError(reader, streamPos)
+		if err == errShutdown {
+			return err
+		} else if err != nil {
+			if err == io.EOF && nextFile.Filename != "" {
+				log.Printf("read loop: switching over to file %s", nextFile.Filename)
+				previous := *streamPos
+				pgf.rememberReadFile(previous)
+				*streamPos = nextFile
+				streamPos.BytesReadTotal = previous.BytesReadTotal
+				pgf.notifyFileSwitched(previous, streamPos)
 				return nil
 			}
 
 			// If we hit EOF, consider changing to the next file in the select
 			// below.
-			var optNewFilenameChan <-chan string
-			if nextFilename == "" && err == io.EOF {
-				optNewFilenameChan = pgf.newFilenameChan
+			var optNextFileChan <-chan shared.LogStreamPosition
+			if nextFile.Filename == "" && err == io.EOF {
+				optNextFileChan = pgf.nextFileChan
+			}
+			if err == io.EOF {
+				pgf.flushBatches(true)
+				pgf.notifyIdle(streamPos)
 			}
 
-			// TODO: make configurable
-			tailfTimer.Reset(time.Second)
+			// Wake up in time to flush the next batch.
+			timeout := pgf.config.Tail.PollInterval.Duration
+			if expiry, ok := pgf.nextBatchExpiry(); ok && expiry < timeout {
+				timeout = expiry
+			}
+			tailfTimer.Reset(timeout)
 			select {
-			case nextFilename = <-optNewFilenameChan:
-				log.Printf("read loop: will switch over to file %s when possible", nextFilename)
+			case nextFile = <-optNextFileChan:
+				log.Printf("read loop: will switch over to file %s when possible", nextFile.Filename)
 				// Don't switch over until we get the next io.EOF, or we
 				// might miss lines at the very end of the file.
 
 			case <-tailfTimer.C:
+
+			case <-pgf.shutdownChan:
+				return errShutdown
 			}
 			// Try again
 			continue
@@ -178,40 +348,128 @@ func (pgf *PGFisher) readFromFileUntilEOF(fh *os.File, streamPos *shared.LogStre
 	}
 }
 
-func (pgf *PGFisher) readFromFileUntilError(reader *csv.Reader, streamPos *shared.LogStreamPosition) error {
+func (pgf *PGFisher) readFromFileUntilError(reader logReader, streamPos *shared.LogStreamPosition) error {
+	stop := make(chan struct{})
+	queue, done := pgf.startRecordReader(reader, stop)
+	defer func() {
+		// The caller is free to use the file once we return.
+		close(stop)
+		<-done
+	}()
+
 	for {
-		reader.ByteOffset = 0
-		record, err := reader.Read()
-		if err != nil {
-			return err
+		var item queuedRecord
+		select {
+		case item = <-queue:
+		case <-pgf.shutdownChan:
+			return errShutdown
 		}
-		bytesRead := reader.ByteOffset
-		if len(record) < 23 {
-			log.Fatalf("unexpected record length %d", len(record))
+		pgf.pipelineQueueLength.Set(float64(len(queue)))
+		if item.err != nil {
+			if item.err == io.EOF {
+				// Bytes the reader consumed without returning a record, such
+				// as the records skipped by timeRangeLogReader.
+				pgf.advanceLogStreamPosition(streamPos, item.bytesRead)
+			}
+			return item.err
 		}
-
-		err = pgf.plugin.Process(streamPos, record)
-		if err != nil {
-			log.Fatalf("the plugin's Process function failed: %s", err)
+		pgf.pipelineStageSeconds.WithLabelValues("queue").Observe(time.Since(item.queuedAt).Seconds())
+		record, bytesRead := item.record, item.bytesRead
+
+		// The jsonlog and stderr readers always produce records in the
+		// latest format.
+		if reader.Format() == logFormatCSV {
+			err := pgf.checkCSVRecordLength(streamPos.Filename, record)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
 		}
 
-		streamPos.Offset += bytesRead
-		streamPos.BytesReadTotal += bytesRead
-		pgf.bytesReadTotal.Add(float64(bytesRead))
-		pgf.bytesReadSinceLastPersist += bytesRead
-		if pgf.bytesReadSinceLastPersist >= 1024*1024*32 {
+		startTime := time.Now()
+		pgf.processRecord(streamPos, record)
+		pgf.pipelineStageSeconds.WithLabelValues("process").Observe(time.Since(startTime).Seconds())
+
+		pgf.advanceLogStreamPosition(streamPos, bytesRead)
+		if pgf.bytesReadSinceLastPersist >= pgf.config.Tail.PersistIntervalBytes {
 			pgf.persistLogStreamPosition(streamPos)
 		}
+
+		select {
+		case <-pgf.shutdownChan:
+			return errShutdown
+		default:
+		}
+	}
+}
+
+// Checks that the record is in the csvlog format of a supported server
+// version.  The format is the one of the server version set with
+// server_version, or detected from the first record, and is detected again
+// whenever the number of columns changes, as it does when the server is
+// upgraded, possibly in the middle of a file.
+func (pgf *PGFisher) checkCSVRecordLength(filename string, record []string) error {
+	if len(record) == pgf.csvNumColumns {
+		return nil
+	}
+	if pgf.csvNumColumns == 0 && csvLogSchema != nil && len(record) == csvLogSchema.NumColumns {
+		pgf.csvNumColumns = len(record)
+		return nil
+	}
+	schema, err := shared.CSVLogSchemaForColumnCount(len(record))
+	if err != nil {
+		return fmt.Errorf("file %q: %s", filename, err)
+	}
+	version := shared.FormatServerVersion(schema.MinServerVersion)
+	if len(record) > schema.NumColumns {
+		log.Printf("file %q: the records have %d columns, more than in the csvlog format of any supported server version; using the format of server version %s or later and ignoring the rest", filename, len(record), version)
+	} else {
+		log.Printf("file %q: detected the csvlog format of server version %s or later", filename, version)
+	}
+	pgf.csvNumColumns = len(record)
+	return nil
+}
+
+func (pgf *PGFisher) checkLogFileIdentity(fh *os.File, streamPos *shared.LogStreamPosition) error {
+	previous := *streamPos
+	reset, err := checkLogFileIdentity(fh, streamPos)
+	if err != nil {
+		return err
+	}
+	if reset {
+		pgf.logFileResetsTotal.Inc()
+		pgf.notifyFileSwitched(previous, streamPos)
 	}
+	return nil
+}
+
+func (pgf *PGFisher) advanceLogStreamPosition(streamPos *shared.LogStreamPosition, bytesRead int64) {
+	streamPos.Offset += bytesRead
+	streamPos.BytesReadTotal += bytesRead
+	pgf.bytesReadTotal.Add(float64(bytesRead))
+	pgf.bytesReadSinceLastPersist += bytesRead
 }
 
 func (pgf *PGFisher) persistLogStreamPosition(pos *shared.LogStreamPosition) {
-	pgf.dbh.PersistLogStreamPosition(pos)
+	// The position must not move past any records still waiting in a batch,
+	// or still being processed by an external plugin.
+	pgf.flushBatches(false)
+	if !pgf.waitForAsyncPlugins(pgf.asyncPluginWaitTimeout()) {
+		pgf.bytesReadSinceLastPersist = 0
+		return
+	}
+	checkpointFunc := func(tx *bolt.Tx) error {
+		return pgf.checkpointPlugins(tx, pos)
+	}
+	if pgf.noPersist {
+		pgf.dbh.CheckpointPlugins(checkpointFunc)
+	} else {
+		pgf.dbh.PersistLogStreamPosition(pos, checkpointFunc)
+	}
 	pgf.bytesReadSinceLastPersist = 0
 }
 
 // runs in its own goroutine
-func (pgf *PGFisher) fsnotifyWatcherLoop(fsw *fsnotify.Watcher, pathGlob string, newFilenameChan chan<- string) {
+func (pgf *PGFisher) fsnotifyWatcherLoop(fsw *fsnotify.Watcher, pathGlob string, newFileChan chan<- logFile) {
 	for {
 		select {
 		case event := <-fsw.Events:
@@ -221,9 +479,26 @@ func (pgf *PGFisher) fsnotifyWatcherLoop(fsw *fsnotify.Watcher, pathGlob string,
 				if err != nil {
 					log.Panic(err)
 				}
-				if match {
+				if match && logFilename.Match(filepath.Base(path)) {
 					log.Printf("fsnotify: newly created file %q matches the glob", path)
-					newFilenameChan <- filepath.Base(path)
+					file, err := statLogFile(filepath.Base(path))
+					if err != nil {
+						log.Printf("fsnotify: could not stat file %q: %s", path, err)
+						continue
+					}
+					newFileChan <- file
+				}
+			} else if event.Op&fsnotify.Write == fsnotify.Write && !logFilename.NamesAreMonotonic() {
+				// With log_truncate_on_rotation, the server truncates and
+				// starts writing to an old file instead of creating a new one.
+				// Forward writes to directoryWatcherLoop, which knows which
+				// files it's interested in.
+				path := event.Name
+				if logFilename.Match(filepath.Base(path)) {
+					newFileChan <- logFile{
+						name:    filepath.Base(path),
+						written: true,
+					}
 				}
 			}
 
@@ -233,31 +508,30 @@ func (pgf *PGFisher) fsnotifyWatcherLoop(fsw *fsnotify.Watcher, pathGlob string,
 	}
 }
 
-func (pgf *PGFisher) doInitialRead(initialFilename string) (<-chan string, []string) {
+// Returns a channel of files created from here on, the file called
+// initialFilename (if it exists), and the files which were written to after
+// it in the order they should be read in.
+func (pgf *PGFisher) doInitialRead(initialFilename string) (<-chan logFile, logFile, []logFile) {
 	// Set up a watcher before reading all files in the directory.  This way we
 	// ensure that we never miss any files created while we're starting up.
 	fsw, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatalf("could not create a new file system watcher: %s", err)
 	}
-	// TODO: how to size this channel?
-	epollFilenameChan := make(chan string, 32)
-	pathGlob := filepath.Join(logPath, LogGlobPattern)
-	go pgf.fsnotifyWatcherLoop(fsw, pathGlob, epollFilenameChan)
+	epollFileChan := make(chan logFile, pgf.config.Tail.FsnotifyQueueSize)
+	pathGlob := filepath.Join(logPath, logFilename.Glob())
+	go pgf.fsnotifyWatcherLoop(fsw, pathGlob, epollFileChan)
 	err = fsw.Add(logPath)
 	if err != nil {
 		log.Fatalf("could not start listening for file system notifications on %q: %s", logPath, err)
 	}
 
-	files, _ := filepath.Glob(pathGlob)
+	files := listLogFiles()
 	if files == nil {
-		log.Println("unable to find any log files, did you specify your glob correctly?")
-		log.Println(filepath.Join(logPath, LogGlobPattern))
+		log.Println("unable to find any log files, did you specify your log_filename correctly?")
+		log.Println(pathGlob)
 		os.Exit(1)
 	}
-	for i := range files {
-		files[i] = filepath.Base(files[i])
-	}
 
 	// Now drain all the events, incorporating any files created into the
 	// "files" slice.  This might result in duplicates, but that doesn't
@@ -265,65 +539,191 @@ func (pgf *PGFisher) doInitialRead(initialFilename string) (<-chan string, []str
 eventDrainLoop:
 	for {
 		select {
-		case filename := <-epollFilenameChan:
-			files = append(files, filename)
+		case file := <-epollFileChan:
+			if file.written {
+				// Only the name of a file written to is known; replace what
+				// listLogFiles saw with its current state.
+				stat, err := statLogFile(file.name)
+				if err != nil {
+					log.Printf("could not stat file %q: %s", file.name, err)
+					continue
+				}
+				file = stat
+				for i := range files {
+					if files[i].name == file.name {
+						files = append(files[:i], files[i+1:]...)
+						break
+					}
+				}
+			}
+			files = append(files, file)
 		default:
 			break eventDrainLoop
 		}
 	}
 
-	var initialFiles []string
+	sortLogFiles(files)
 
-	sort.Strings(files)
-	previousFile := ""
+	var initialFile logFile
+	var initialFiles []logFile
 	for _, file := range files {
-		// Skip files we've either already read or don't care about.  Note that
-		// we don't want initialFilename to appear in the list, since the main
-		// loop will start reading from it automatically.
-		if initialFilename != "" && path.Base(file) <= initialFilename {
+		// eliminate duplicates as we go
+		if len(initialFiles) > 0 && initialFiles[len(initialFiles)-1].sameFile(file) {
 			continue
 		}
-		// eliminate duplicates as we go
-		if previousFile == file {
+		// Skip files we've already read.  Note that we don't want
+		// initialFilename to appear in the list, since the main loop will
+		// start reading from it automatically.
+		if file.name == initialFilename {
+			initialFile = file
+			for _, f := range initialFiles {
+				pgf.rememberFileAsRead(f)
+			}
+			initialFiles = initialFiles[:0]
 			continue
 		}
-		previousFile = file
 		initialFiles = append(initialFiles, file)
 	}
-	return epollFilenameChan, initialFiles
+	if initialFilename != "" && initialFile.name == "" && logFilename.NamesAreMonotonic() {
+		// The file has been removed, but we can still tell which files came
+		// after it.
+		initialTime, err := logFilename.FilenameTime(initialFilename, logTimezone)
+		if err == nil {
+			for len(initialFiles) > 0 && !initialFiles[0].nameTime.After(initialTime) {
+				initialFiles = initialFiles[1:]
+			}
+		}
+	}
+	return epollFileChan, initialFile, initialFiles
 }
 
 // This loop feeds new filenames to the ReadCSVLoop.  Runs in its own
 // goroutine.
-func (pgf *PGFisher) directoryWatcherLoop(epollFilenameChan <-chan string, files []string) {
-	currentFilename := ""
+func (pgf *PGFisher) directoryWatcherLoop(epollFileChan <-chan logFile, currentFile logFile, files []logFile) {
 	for {
-		var nextFilename string
-		var nextFileChan chan string
+		var nextFile shared.LogStreamPosition
+		var nextFileChan chan shared.LogStreamPosition
 		if len(files) > 0 {
-			nextFilename = files[0]
-			nextFileChan = pgf.newFilenameChan
+			nextFile = pgf.startPosition(files[0])
+			nextFileChan = pgf.nextFileChan
 		} else {
 			nextFileChan = nil
 		}
 
 		select {
-		case nextFileChan <- nextFilename:
-			currentFilename = path.Base(nextFilename)
+		case nextFileChan <- nextFile:
+			currentFile = files[0]
 			files = files[1:]
 
-		case evfname := <-epollFilenameChan:
-			// Must sort after the file being currently read
-			if currentFilename != "" && path.Base(evfname) <= currentFilename {
-				log.Fatalf("newly created file %q does not sort after the current filename %q", evfname, currentFilename)
+		case file := <-epollFileChan:
+			if file.written {
+				file, ok := pgf.checkRewrittenFile(file.name, currentFile, files)
+				if ok {
+					log.Printf("file %q is being written to again; will resume reading it", file.name)
+					files = append(files, file)
+				}
+				continue
 			}
-			// Must sort after any of the files we've already queued
+
+			// A newly created file is always the latest one, even if its name
+			// doesn't suggest so.  We might still have seen it already while
+			// starting up, though.
+			duplicate := currentFile.sameFile(file)
 			for _, f := range files {
-				if path.Base(evfname) <= path.Base(f) {
-					log.Fatalf("newly created file %q does not sort after queued filename %q", evfname, f)
+				if f.sameFile(file) {
+					duplicate = true
 				}
 			}
-			files = append(files, evfname)
+			if duplicate {
+				continue
+			}
+			if logFilename.NamesAreMonotonic() && currentFile.name != "" && !logFileLess(currentFile, file) {
+				log.Printf("newly created file %q does not sort after the current file %q", file.name, currentFile.name)
+			}
+			files = append(files, file)
 		}
 	}
 }
+
+// Returns true if the server has switched over to writing to the existing
+// file called filename after the current file.  Writes to the current file
+// and any of the queued files are of no interest.
+func (pgf *PGFisher) checkRewrittenFile(filename string, currentFile logFile, files []logFile) (logFile, bool) {
+	if filename == currentFile.name {
+		return logFile{}, false
+	}
+	for _, f := range files {
+		if filename == f.name {
+			return logFile{}, false
+		}
+	}
+	if currentFile.name == "" {
+		return logFile{}, false
+	}
+
+	current, err := statLogFile(currentFile.name)
+	if err != nil {
+		return logFile{}, false
+	}
+	file, err := statLogFile(filename)
+	if err != nil {
+		return logFile{}, false
+	}
+	// Writes to the previous file can be reported late; only a file written
+	// to after the current one has been taken over by the server.
+	if !file.modTime.After(current.modTime) {
+		return logFile{}, false
+	}
+	return file, true
+}
+
+// Records the position the main loop left a file at.
+func (pgf *PGFisher) rememberReadFile(pos shared.LogStreamPosition) {
+	pgf.readFilesLock.Lock()
+	defer pgf.readFilesLock.Unlock()
+	pgf.readFiles[pos.Filename] = pos
+}
+
+// Records a file which was read before pgfisher was started as read up to its
+// current size.  Only needed if the server can start writing to it again.
+func (pgf *PGFisher) rememberFileAsRead(file logFile) {
+	if logFilename.NamesAreMonotonic() {
+		return
+	}
+	fh, err := os.Open(filepath.Join(logPath, file.name))
+	if err != nil {
+		log.Printf("could not open file %q: %s", file.name, err)
+		return
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		log.Printf("could not stat file %q: %s", file.name, err)
+		return
+	}
+	pos := shared.LogStreamPosition{
+		Filename: file.name,
+		Offset:   fi.Size(),
+	}
+	_, err = checkLogFileIdentity(fh, &pos)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pgf.rememberReadFile(pos)
+}
+
+// Returns the position to start reading file from.  A file which has been
+// read from before is resumed where it was left off, so that the records in
+// it aren't processed twice; if it has been truncated or rewritten since,
+// checkLogFileIdentity starts it over from its beginning.  A file which has
+// been replaced is read from the beginning.
+func (pgf *PGFisher) startPosition(file logFile) shared.LogStreamPosition {
+	pgf.readFilesLock.Lock()
+	defer pgf.readFilesLock.Unlock()
+	pos, ok := pgf.readFiles[file.name]
+	if !ok || pos.Device != file.dev || pos.Inode != file.ino {
+		return shared.LogStreamPosition{Filename: file.name}
+	}
+	return pos
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestShutdownWithSlowScrape(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	dbh, err := bolt.Open(dbPath, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := defaultConfig()
+	config.Metrics.ListenAddress = "127.0.0.1:0"
+	config.Tail.ShutdownTimeout.Duration = 2 * time.Second
+	pgf := NewPGFisher(dbh, config)
+	pgf.dbh.InitializeDatabase(&shared.LogStreamPosition{Filename: "postgresql.csv"})
+
+	// A scrape which doesn't finish until the end of the test
+	scraping := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	pgf.httpMux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(scraping)
+		<-release
+	})
+	pgf.startMetricsServer()
+	go http.Get("http://" + pgf.prometheusListener.Addr().String() + "/slow")
+	<-scraping
+
+	pgf.Shutdown()
+	start := time.Now()
+	err = pgf.shutdown(&shared.LogStreamPosition{Filename: "postgresql.csv", Offset: 1234})
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Errorf("shutdown did not report the metrics server failing to shut down")
+	}
+	// handleShutdownSignals would exit once the timeout has passed.
+	if elapsed >= config.Tail.ShutdownTimeout.Duration {
+		t.Errorf("shutdown took %s; expected less than %s", elapsed, config.Tail.ShutdownTimeout.Duration)
+	}
+
+	// The position was persisted regardless of the scrape.
+	dbh, err = bolt.Open(dbPath, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbh.Close()
+	pos := NewPGFisherDatabase(dbh).ReadLogStreamPosition()
+	if pos.Filename != "postgresql.csv" || pos.Offset != 1234 {
+		t.Errorf("persisted position %q, %d; expected %q, %d", pos.Filename, pos.Offset, "postgresql.csv", 1234)
+	}
+}
+
+func TestAsyncPluginWaitTimeout(t *testing.T) {
+	testCases := []struct {
+		shutdownTimeout time.Duration
+		shuttingDown    bool
+		expected        time.Duration
+	}{
+		{10 * time.Second, false, defaultAsyncPluginWaitTimeout},
+		{time.Second, false, defaultAsyncPluginWaitTimeout},
+		// leaves time for persisting the position once shutting down
+		{10 * time.Second, true, 5 * time.Second},
+		{time.Second, true, 500 * time.Millisecond},
+		{time.Minute, true, defaultAsyncPluginWaitTimeout},
+	}
+	for _, tc := range testCases {
+		config := defaultConfig()
+		config.Tail.ShutdownTimeout.Duration = tc.shutdownTimeout
+		pgf := &PGFisher{config: config, shutdownChan: make(chan struct{})}
+		if tc.shuttingDown {
+			pgf.Shutdown()
+		}
+		if got := pgf.asyncPluginWaitTimeout(); got != tc.expected {
+			t.Errorf("asyncPluginWaitTimeout() with shutdown_timeout %s, shutting down %v = %s; expected %s",
+				tc.shutdownTimeout, tc.shuttingDown, got, tc.expected)
+		}
+	}
+}
+
+func TestCheckCSVRecordLength(t *testing.T) {
+	v94 := 1 + shared.ApplicationNameAttno
+	v13 := 1 + shared.BackendTypeAttno
+	v14 := 1 + shared.QueryIDAttno
+	testCases := []struct {
+		name          string
+		serverVersion string
+		// the number of columns of each record, in order
+		numColumns []int
+		// whether checking each record fails
+		expectedErrors []bool
+	}{
+		{"detected", "", []int{v14, v14}, []bool{false, false}},
+		// the server was upgraded in the middle of the stream
+		{"upgraded", "", []int{v94, v94, v13, v14, v14}, []bool{false, false, false, false, false}},
+		{"configured", "13", []int{v13, v14, v14}, []bool{false, false, false}},
+		{"newer server version", "", []int{v14, v14 + 1, v14 + 1}, []bool{false, false, false}},
+		{"too short", "", []int{v14, v94 - 1, v14}, []bool{false, true, false}},
+	}
+	defer func() { csvLogSchema = nil }()
+	for _, tc := range testCases {
+		csvLogSchema = nil
+		if tc.serverVersion != "" {
+			version, err := shared.ParseServerVersion(tc.serverVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			schema, err := shared.CSVLogSchemaForServerVersion(version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csvLogSchema = &schema
+		}
+		pgf := &PGFisher{}
+		for i, n := range tc.numColumns {
+			err := pgf.checkCSVRecordLength("postgresql.csv", make([]string, n))
+			if (err != nil) != tc.expectedErrors[i] {
+				t.Errorf("%s: record %d with %d columns: got error %v", tc.name, i, n, err)
+			}
+		}
+	}
+}
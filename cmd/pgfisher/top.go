@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/johto/pgfisher/internal/plugins/statements"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Reads the top statements collected by the statements plugin called
+// pluginName from the database file at dbPath.
+func readTopStatements(dbPath string, pluginName string, opts statements.TopOptions) ([]*statements.StatementStats, error) {
+	_, err := os.Stat(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open database: %s", err)
+	}
+	dbh, err := bolt.Open(dbPath, 0644, &bolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: true,
+	})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("database file %s is in use; use --url to ask the pgfisher using it instead", dbPath)
+	} else if err != nil {
+		return nil, fmt.Errorf("could not open database: %s", err)
+	}
+	defer dbh.Close()
+
+	var top []*statements.StatementStats
+	err = dbh.View(func(tx *bolt.Tx) error {
+		top, err = statements.ReadTop(tx, pluginBucketName(pluginName), opts)
+		return err
+	})
+	return top, err
+}
+
+// Asks a running pgfisher for the top statements collected by the statements
+// plugin called pluginName.
+func fetchTopStatements(baseURL string, pluginName string, opts statements.TopOptions) ([]*statements.StatementStats, error) {
+	query := url.Values{}
+	query.Set("order", opts.Order)
+	query.Set("limit", strconv.Itoa(opts.Limit))
+	if !opts.Since.IsZero() {
+		query.Set("since", opts.Since.Format(time.RFC3339))
+	}
+	if !opts.Until.IsZero() {
+		query.Set("until", opts.Until.Format(time.RFC3339))
+	}
+	topURL := strings.TrimSuffix(baseURL, "/") + "/plugins/" + url.PathEscape(pluginName) + "/top?" + query.Encode()
+
+	resp, err := http.Get(topURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("request to %s failed: %s: %s", topURL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var top []*statements.StatementStats
+	err = json.NewDecoder(resp.Body).Decode(&top)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode the response from %s: %s", topURL, err)
+	}
+	return top, nil
+}
+
+func printTopStatements(w io.Writer, top []*statements.StatementStats) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "calls\ttotal ms\tmean ms\tstddev ms\tmin ms\tmax ms\tdatabase\tuser\tquery\n")
+	for _, s := range top {
+		fmt.Fprintf(tw, "%d\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%s\t%s\t%s\n",
+			s.Calls, s.TotalMS, s.MeanMS, s.StddevMS, s.MinMS, s.MaxMS, s.Database, s.User, s.Query)
+	}
+	tw.Flush()
+}
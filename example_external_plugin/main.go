@@ -0,0 +1,53 @@
+// This is an example of an external plugin, which pgfisher runs as a child
+// process.  Build it with:
+//
+//	go build -o example_external_plugin ./example_external_plugin
+//
+// and run pgfisher with --plugin exec:path/to/example_external_plugin.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	pgfplugin "github.com/johto/pgfisher/internal/plugin_interface"
+)
+
+// Counts the messages of each severity, and prints the counts when pgfisher
+// shuts down.
+type ExternalPlugin struct {
+	counts map[string]int
+}
+
+func initPlugin(args pgfplugin.PluginInitArgs) (pgfplugin.Plugin, error) {
+	plugin := &ExternalPlugin{
+		counts: make(map[string]int),
+	}
+	return plugin, nil
+}
+
+func (p *ExternalPlugin) Process(streamPos *pgfplugin.LogStreamPosition, record []string) error {
+	le, err := pgfplugin.NewLogEntry(record)
+	if err != nil {
+		return err
+	}
+	p.counts[le.ErrorSeverity()]++
+	// Standard output is reserved for the protocol.
+	fmt.Fprintf(os.Stderr, "%s:%d %s: %s\n", streamPos.Filename, streamPos.Offset, le.ErrorSeverity(), le.Message())
+	return nil
+}
+
+func (p *ExternalPlugin) Close() error {
+	for severity, count := range p.counts {
+		fmt.Fprintf(os.Stderr, "%s: %d\n", severity, count)
+	}
+	return nil
+}
+
+func main() {
+	err := pgfplugin.RunExternalPlugin(initPlugin, os.Stdin, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
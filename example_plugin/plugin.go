@@ -1,4 +1,9 @@
-package plugin
+// This is an example of a plugin which is loaded at runtime.  Build it with:
+//
+//	go build -buildmode=plugin -o example_plugin.so ./example_plugin
+//
+// and run pgfisher with --plugin path/to/example_plugin.so.
+package main
 
 import (
 	"fmt"
@@ -27,3 +32,6 @@ func (p *ExamplePlugin) Process(streamPos *pgfplugin.LogStreamPosition, record [
 	fmt.Printf("%s\n", le.Message())
 	return nil
 }
+
+// Not used when built as a plugin, but "go build ./..." insists on it.
+func main() {}
@@ -3,6 +3,7 @@ module github.com/johto/pgfisher
 go 1.22.2
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/fsnotify/fsnotify v1.7.0
 	github.com/johto/go-csvt v0.0.0-20170705123905-f671c8103082
 	github.com/johto/pgfisher/plugin_interface v0.0.0-20220111120346-eb2ddf567fa3
@@ -0,0 +1,126 @@
+package plugin_interface
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The functions in this file read settings out of PluginInitArgs.Config.  A
+// setting which is not present in the configuration gets the given default
+// value, and a setting of the wrong type is an error.
+
+// CheckConfigKeys returns an error if config contains any settings other than
+// the ones in known, to catch typos.
+func CheckConfigKeys(config map[string]interface{}, known ...string) error {
+	var unknown []string
+	for key := range config {
+		found := false
+		for _, k := range known {
+			if key == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown settings %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+func ConfigString(config map[string]interface{}, key string, def string) (string, error) {
+	value, ok := config[key]
+	if !ok {
+		return def, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("invalid value %v for setting %s; expected a string", value, key)
+	}
+	return s, nil
+}
+
+func ConfigInt(config map[string]interface{}, key string, def int64) (int64, error) {
+	value, ok := config[key]
+	if !ok {
+		return def, nil
+	}
+	switch n := value.(type) {
+	case int64:
+		return n, nil
+	case float64:
+		// The settings of external plugins are decoded from JSON.
+		if n == math.Trunc(n) {
+			return int64(n), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid value %v for setting %s; expected an integer", value, key)
+}
+
+// ConfigFloat accepts integers as well.
+func ConfigFloat(config map[string]interface{}, key string, def float64) (float64, error) {
+	value, ok := config[key]
+	if !ok {
+		return def, nil
+	}
+	f, ok := toFloat(value)
+	if !ok {
+		return 0, fmt.Errorf("invalid value %v for setting %s; expected a number", value, key)
+	}
+	return f, nil
+}
+
+// ConfigFloatList reads a list of numbers, e.g. histogram buckets.
+func ConfigFloatList(config map[string]interface{}, key string, def []float64) ([]float64, error) {
+	value, ok := config[key]
+	if !ok {
+		return def, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid value %v for setting %s; expected a list of numbers", value, key)
+	}
+	floats := make([]float64, len(list))
+	for i, v := range list {
+		floats[i], ok = toFloat(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid value %v for setting %s; expected a list of numbers", value, key)
+		}
+	}
+	return floats, nil
+}
+
+// ConfigDuration reads a duration written as a string, e.g. "1h30m".
+func ConfigDuration(config map[string]interface{}, key string, def time.Duration) (time.Duration, error) {
+	value, ok := config[key]
+	if !ok {
+		return def, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return 0, fmt.Errorf("invalid value %v for setting %s; expected a duration such as \"1h\"", value, key)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for setting %s: %s", s, key, err)
+	}
+	return d, nil
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,106 @@
+package plugin_interface
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds of messages the server logs the duration of a statement in.
+const (
+	// Only the duration was logged, because of log_duration.  The statement
+	// itself is logged separately, if at all.
+	DurationKindNone = ""
+	// A statement sent using the simple query protocol
+	DurationKindStatement = "statement"
+	// The parse, bind and execute steps of the extended query protocol
+	DurationKindParse        = "parse"
+	DurationKindBind         = "bind"
+	DurationKindExecute      = "execute"
+	DurationKindExecuteFetch = "execute fetch from"
+	// A function call using the fast-path interface
+	DurationKindFastpath = "fastpath function call"
+	// A plan logged by auto_explain
+	DurationKindPlan = "plan"
+)
+
+var durationMessageRe = regexp.MustCompile(`(?s)^duration: ([0-9]+(?:\.[0-9]+)?) ms(?:  (.*))?$`)
+
+// DurationMessage is a message logged because of log_min_duration_statement,
+// log_duration or auto_explain; see ParseDurationMessage.
+type DurationMessage struct {
+	Duration time.Duration
+	// One of the DurationKind constants
+	Kind string
+	// For the extended query protocol, the name of the prepared statement,
+	// or "<unnamed>" for the unnamed one, and the name of the portal, if
+	// any.
+	StatementName string
+	PortalName    string
+	// The text of the statement, the function called for
+	// DurationKindFastpath, or the plan for DurationKindPlan.  Empty for
+	// DurationKindNone.
+	Text string
+}
+
+// ParseDurationMessage parses the message of a record logged with a
+// duration, e.g.
+//
+//	duration: 1234.567 ms  statement: SELECT 1
+//	duration: 0.123 ms  execute S_1/C_2: SELECT * FROM t WHERE id = $1
+//
+// ok is false if message is not such a message.  Only messages written with
+// lc_messages set to English are recognized.
+func ParseDurationMessage(message string) (msg DurationMessage, ok bool) {
+	m := durationMessageRe.FindStringSubmatch(message)
+	if m == nil {
+		return DurationMessage{}, false
+	}
+	ms, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return DurationMessage{}, false
+	}
+	msg.Duration = time.Duration(ms * float64(time.Millisecond))
+	rest := m[2]
+	if rest == "" {
+		msg.Kind = DurationKindNone
+		return msg, true
+	}
+
+	if text, found := strings.CutPrefix(rest, "statement: "); found {
+		msg.Kind = DurationKindStatement
+		msg.Text = text
+		return msg, true
+	}
+	if text, found := strings.CutPrefix(rest, "plan:"); found {
+		msg.Kind = DurationKindPlan
+		msg.Text = strings.TrimLeft(text, "\n")
+		return msg, true
+	}
+	if text, found := strings.CutPrefix(rest, "fastpath function call: "); found {
+		msg.Kind = DurationKindFastpath
+		msg.Text = text
+		return msg, true
+	}
+	// "execute fetch from" has to be checked before "execute".
+	for _, kind := range []string{DurationKindParse, DurationKindBind, DurationKindExecuteFetch, DurationKindExecute} {
+		names, found := strings.CutPrefix(rest, kind+" ")
+		if !found {
+			continue
+		}
+		names, text, found := strings.Cut(names, ": ")
+		if !found {
+			// the statement text can be empty
+			names, found = strings.CutSuffix(names, ":")
+			if !found {
+				return DurationMessage{}, false
+			}
+		}
+		msg.Kind = kind
+		msg.StatementName, msg.PortalName, _ = strings.Cut(names, "/")
+		msg.Text = text
+		return msg, true
+	}
+	return DurationMessage{}, false
+}
@@ -0,0 +1,64 @@
+package plugin_interface
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDurationMessage(t *testing.T) {
+	testCases := []struct {
+		message  string
+		ok       bool
+		expected DurationMessage
+	}{
+		// log_duration
+		{"duration: 0.123 ms", true, DurationMessage{Duration: 123 * time.Microsecond, Kind: DurationKindNone}},
+		{"duration: 5 ms", true, DurationMessage{Duration: 5 * time.Millisecond, Kind: DurationKindNone}},
+
+		// simple query protocol
+		{"duration: 1234.567 ms  statement: SELECT 1", true, DurationMessage{Duration: 1234567 * time.Microsecond, Kind: DurationKindStatement, Text: "SELECT 1"}},
+		{"duration: 1.000 ms  statement: SELECT 1;\nSELECT 2", true, DurationMessage{Duration: time.Millisecond, Kind: DurationKindStatement, Text: "SELECT 1;\nSELECT 2"}},
+		{"duration: 1.000 ms  statement: ", true, DurationMessage{Duration: time.Millisecond, Kind: DurationKindStatement, Text: ""}},
+
+		// extended query protocol
+		{"duration: 0.050 ms  parse <unnamed>: SELECT * FROM t WHERE id = $1", true, DurationMessage{Duration: 50 * time.Microsecond, Kind: DurationKindParse, StatementName: "<unnamed>", Text: "SELECT * FROM t WHERE id = $1"}},
+		{"duration: 0.050 ms  parse S_1: SELECT * FROM t WHERE id = $1", true, DurationMessage{Duration: 50 * time.Microsecond, Kind: DurationKindParse, StatementName: "S_1", Text: "SELECT * FROM t WHERE id = $1"}},
+		{"duration: 0.020 ms  bind <unnamed>: SELECT 1", true, DurationMessage{Duration: 20 * time.Microsecond, Kind: DurationKindBind, StatementName: "<unnamed>", Text: "SELECT 1"}},
+		{"duration: 0.020 ms  bind S_1/C_2: SELECT 1", true, DurationMessage{Duration: 20 * time.Microsecond, Kind: DurationKindBind, StatementName: "S_1", PortalName: "C_2", Text: "SELECT 1"}},
+		{"duration: 0.123 ms  execute S_1/C_2: SELECT * FROM t WHERE id = $1", true, DurationMessage{Duration: 123 * time.Microsecond, Kind: DurationKindExecute, StatementName: "S_1", PortalName: "C_2", Text: "SELECT * FROM t WHERE id = $1"}},
+		{"duration: 0.123 ms  execute <unnamed>: SELECT 1", true, DurationMessage{Duration: 123 * time.Microsecond, Kind: DurationKindExecute, StatementName: "<unnamed>", Text: "SELECT 1"}},
+		{"duration: 0.123 ms  execute fetch from <unnamed>/C_1: SELECT * FROM t", true, DurationMessage{Duration: 123 * time.Microsecond, Kind: DurationKindExecuteFetch, StatementName: "<unnamed>", PortalName: "C_1", Text: "SELECT * FROM t"}},
+		// the text of an empty statement
+		{"duration: 0.010 ms  parse <unnamed>:", true, DurationMessage{Duration: 10 * time.Microsecond, Kind: DurationKindParse, StatementName: "<unnamed>", Text: ""}},
+		// a statement containing ": "
+		{"duration: 0.123 ms  execute S_1: SELECT 'a: b'", true, DurationMessage{Duration: 123 * time.Microsecond, Kind: DurationKindExecute, StatementName: "S_1", Text: "SELECT 'a: b'"}},
+
+		// fast-path function calls
+		{`duration: 0.042 ms  fastpath function call: "lo_open" (OID 952)`, true, DurationMessage{Duration: 42 * time.Microsecond, Kind: DurationKindFastpath, Text: `"lo_open" (OID 952)`}},
+
+		// auto_explain
+		{"duration: 12.345 ms  plan:\nQuery Text: SELECT 1\nResult  (cost=0.00..0.01 rows=1 width=4)", true, DurationMessage{Duration: 12345 * time.Microsecond, Kind: DurationKindPlan, Text: "Query Text: SELECT 1\nResult  (cost=0.00..0.01 rows=1 width=4)"}},
+		{"duration: 12.345 ms  plan:\n{\n  \"Query Text\": \"SELECT 1\"\n}", true, DurationMessage{Duration: 12345 * time.Microsecond, Kind: DurationKindPlan, Text: "{\n  \"Query Text\": \"SELECT 1\"\n}"}},
+
+		// not duration messages
+		{"statement: SELECT 1", false, DurationMessage{}},
+		{"duration: ms", false, DurationMessage{}},
+		{"duration: 1.5ms", false, DurationMessage{}},
+		{"duration: -1.5 ms", false, DurationMessage{}},
+		{"duration: 1.5 ms statement: SELECT 1", false, DurationMessage{}},
+		{"duration: 1.5 ms  something else: SELECT 1", false, DurationMessage{}},
+		{"duration: 1.5 ms  execute S_1", false, DurationMessage{}},
+		{"Dauer: 1.5 ms  Anweisung: SELECT 1", false, DurationMessage{}},
+		{"", false, DurationMessage{}},
+	}
+	for _, tc := range testCases {
+		msg, ok := ParseDurationMessage(tc.message)
+		if ok != tc.ok {
+			t.Errorf("ParseDurationMessage(%q) returned %v; expected %v", tc.message, ok, tc.ok)
+			continue
+		}
+		if msg != tc.expected {
+			t.Errorf("ParseDurationMessage(%q) = %+v; expected %+v", tc.message, msg, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package plugin_interface
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// The types of the messages of the external plugin protocol.  pgfisher starts
+// an external plugin as a child process and writes messages into its standard
+// input, one JSON object per line.  The first message is always an init
+// message, followed by any number of record messages.  The plugin replies by
+// writing ack messages into its standard output.  An ack acknowledges every
+// record up to and including the one with the sequence number Seq, and
+// pgfisher never persists a position in the log stream past a record which
+// hasn't been acknowledged.  If the plugin fails to process a record, it
+// replies with an error message instead, which acknowledges the record as well
+// and is handled according to the plugin's on_error setting, like an error
+// returned by Process.  Records which weren't acknowledged when the
+// plugin exited are sent again after it has been restarted.  When pgfisher
+// shuts down, it closes the plugin's standard input.  Anything the plugin
+// writes into its standard error goes to pgfisher's.
+const (
+	ExternalMessageInit   = "init"
+	ExternalMessageRecord = "record"
+	ExternalMessageAck    = "ack"
+	ExternalMessageError  = "error"
+)
+
+// ExternalMessage is a single message of the external plugin protocol.
+type ExternalMessage struct {
+	Type string `json:"type"`
+
+	// init: the corresponding fields of PluginInitArgs.  LogTimezone is the
+	// name of the time zone.
+	Name        string                 `json:"name,omitempty"`
+	Args        string                 `json:"args,omitempty"`
+	Config      map[string]interface{} `json:"config,omitempty"`
+	LogTimezone string                 `json:"logTimezone,omitempty"`
+
+	// record, ack and error: the sequence number of the record.  It's increased by
+	// one for every record, and records sent again after a restart keep their
+	// sequence numbers.
+	Seq uint64 `json:"seq,omitempty"`
+	// record: the arguments of Plugin.Process
+	Position *LogStreamPosition `json:"position,omitempty"`
+	Record   []string           `json:"record,omitempty"`
+	// error: why processing the record failed
+	Error string `json:"error,omitempty"`
+}
+
+// RunExternalPlugin implements the plugin side of the external plugin
+// protocol on top of a Plugin, so that a Go plugin can be run in a process of
+// its own.  r and w are normally os.Stdin and os.Stdout.  initFunc is called
+// when the init message arrives.  The plugin has no database handle or
+// Prometheus registry, and of the optional interfaces only Closer is
+// supported; it's called once pgfisher closes the standard input.  Every
+// record is acknowledged once Process has returned, with an error message if
+// Process returned an error.
+//
+// SIGINT and SIGTERM are ignored: they're usually sent to pgfisher's children
+// as well, but the plugin should keep running until pgfisher has finished
+// shutting down and closes the standard input.
+func RunExternalPlugin(initFunc PluginInitFunc, r io.Reader, w io.Writer) error {
+	signal.Ignore(os.Interrupt, syscall.SIGTERM)
+
+	reader := bufio.NewReader(r)
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+	var plugin Plugin
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+
+		var msg ExternalMessage
+		err = json.Unmarshal(line, &msg)
+		if err != nil {
+			return fmt.Errorf("could not parse message: %s", err)
+		}
+		switch msg.Type {
+		case ExternalMessageInit:
+			loc, err := time.LoadLocation(msg.LogTimezone)
+			if err != nil {
+				return err
+			}
+			plugin, err = initFunc(PluginInitArgs{
+				Name:        msg.Name,
+				Args:        msg.Args,
+				Config:      msg.Config,
+				LogTimezone: loc,
+			})
+			if err != nil {
+				return err
+			}
+		case ExternalMessageRecord:
+			if plugin == nil {
+				return fmt.Errorf("received a record before the init message")
+			}
+			reply := ExternalMessage{Type: ExternalMessageAck, Seq: msg.Seq}
+			err = plugin.Process(msg.Position, msg.Record)
+			if err != nil {
+				reply = ExternalMessage{Type: ExternalMessageError, Seq: msg.Seq, Error: err.Error()}
+			}
+			err = encoder.Encode(reply)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected message type %q", msg.Type)
+		}
+
+		// Acknowledge the records in batches, but don't keep pgfisher
+		// waiting.
+		if reader.Buffered() == 0 {
+			err = writer.Flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if closer, ok := plugin.(Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
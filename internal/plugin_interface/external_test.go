@@ -0,0 +1,101 @@
+package plugin_interface
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type failingTestPlugin struct {
+	processed []string
+	closed    bool
+}
+
+func (p *failingTestPlugin) Process(streamPos *LogStreamPosition, record []string) error {
+	if record[0] == "fail" {
+		return fmt.Errorf("could not process %q", record[0])
+	}
+	p.processed = append(p.processed, record[0])
+	return nil
+}
+
+func (p *failingTestPlugin) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestRunExternalPlugin(t *testing.T) {
+	var input bytes.Buffer
+	encoder := json.NewEncoder(&input)
+	messages := []ExternalMessage{
+		{Type: ExternalMessageInit, Name: "test", LogTimezone: "UTC"},
+		{Type: ExternalMessageRecord, Seq: 1, Position: &LogStreamPosition{Filename: "a.csv"}, Record: []string{"one"}},
+		{Type: ExternalMessageRecord, Seq: 2, Position: &LogStreamPosition{Filename: "a.csv", Offset: 10}, Record: []string{"fail"}},
+		{Type: ExternalMessageRecord, Seq: 3, Position: &LogStreamPosition{Filename: "a.csv", Offset: 20}, Record: []string{"three"}},
+	}
+	for _, msg := range messages {
+		err := encoder.Encode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plugin := &failingTestPlugin{}
+	var output bytes.Buffer
+	err := RunExternalPlugin(func(args PluginInitArgs) (Plugin, error) {
+		if args.Name != "test" {
+			t.Errorf("unexpected name %q", args.Name)
+		}
+		return plugin, nil
+	}, &input, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed record is reported, and the plugin keeps running.
+	expected := []ExternalMessage{
+		{Type: ExternalMessageAck, Seq: 1},
+		{Type: ExternalMessageError, Seq: 2, Error: `could not process "fail"`},
+		{Type: ExternalMessageAck, Seq: 3},
+	}
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("unexpected output %q", output.String())
+	}
+	for i, line := range lines {
+		var msg ExternalMessage
+		err := json.Unmarshal([]byte(line), &msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != expected[i].Type || msg.Seq != expected[i].Seq || msg.Error != expected[i].Error {
+			t.Errorf("message %d = %+v; expected %+v", i, msg, expected[i])
+		}
+	}
+	if strings.Join(plugin.processed, ",") != "one,three" {
+		t.Errorf("unexpected records processed %v", plugin.processed)
+	}
+	if !plugin.closed {
+		t.Errorf("the plugin was not closed")
+	}
+}
+
+func TestRunExternalPluginErrors(t *testing.T) {
+	initFunc := func(args PluginInitArgs) (Plugin, error) {
+		return &failingTestPlugin{}, nil
+	}
+	for _, input := range []string{
+		"not json\n",
+		`{"type":"record","seq":1,"record":["one"]}` + "\n",
+		`{"type":"init","logTimezone":"No/Such_Zone"}` + "\n",
+		`{"type":"init","logTimezone":"UTC"}` + "\n" + `{"type":"ack","seq":1}` + "\n",
+	} {
+		var output bytes.Buffer
+		err := RunExternalPlugin(initFunc, strings.NewReader(input), &output)
+		if err == nil {
+			t.Errorf("RunExternalPlugin(%q) did not return an error", input)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package plugin_interface
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// Fingerprint normalizes a statement the way pg_stat_statements does, so that
+// statements which only differ in their constants get the same fingerprint:
+//
+//   - constants (numbers, strings in any of the quoting styles, and bit
+//     strings) are replaced with parameters numbered after the statement's
+//     own parameters
+//   - lists of constants and parameters after IN are collapsed into "(...)"
+//   - comments are removed and whitespace is normalized
+//   - keywords and unquoted identifiers are folded to lower case, as the
+//     server does
+//
+// normalized is the normalized text, e.g. "select * from t where id in (...)
+// and name = $1", and fingerprint is a hash of it as a hexadecimal string.
+// Statements which can't be tokenized, e.g. because of an unterminated
+// string, are normalized as far as possible.  Assumes
+// standard_conforming_strings is on.
+func Fingerprint(sql string) (fingerprint string, normalized string) {
+	normalized = NormalizeQuery(sql)
+	h := fnv.New64a()
+	h.Write([]byte(normalized))
+	return fmt.Sprintf("%016x", h.Sum64()), normalized
+}
+
+// NormalizeQuery returns the normalized text of sql; see Fingerprint.
+func NormalizeQuery(sql string) string {
+	tokens := lexSQL(sql)
+	tokens = foldNegativeNumbers(tokens)
+
+	nextParam := 1
+	for _, t := range tokens {
+		if t.kind == sqlTokenParam {
+			n, err := strconv.Atoi(t.text[1:])
+			if err == nil && n >= nextParam {
+				nextParam = n + 1
+			}
+		}
+	}
+
+	var b strings.Builder
+	var prev sqlToken
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch t.kind {
+		case sqlTokenConstant:
+			if i > 0 && isAdjacentString(tokens[i-1], t) {
+				continue
+			}
+			t.text = "$" + strconv.Itoa(nextParam)
+			nextParam++
+		case sqlTokenIdentifier:
+			t.text = strings.ToLower(t.text)
+		}
+		if t.text == ";" && i == len(tokens)-1 {
+			break
+		}
+		if needsSpace(prev, t) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(t.text)
+		prev = t
+		if t.kind == sqlTokenIdentifier && t.text == "in" {
+			if end, ok := constantList(tokens, i+1); ok {
+				b.WriteString(" (...)")
+				i = end
+				prev = sqlToken{kind: sqlTokenPunctuation, text: ")"}
+			}
+		}
+	}
+	return b.String()
+}
+
+// If tokens[start:] begins with a parenthesized list of constants and
+// parameters, returns the index of the closing parenthesis.
+func constantList(tokens []sqlToken, start int) (int, bool) {
+	if start >= len(tokens) || tokens[start].text != "(" {
+		return 0, false
+	}
+	expectValue := true
+	for i := start + 1; i < len(tokens); i++ {
+		t := tokens[i]
+		if expectValue {
+			if t.kind != sqlTokenConstant && t.kind != sqlTokenParam {
+				return 0, false
+			}
+			for i+1 < len(tokens) && isAdjacentString(tokens[i], tokens[i+1]) {
+				i++
+			}
+			expectValue = false
+			continue
+		}
+		switch t.text {
+		case ",":
+			expectValue = true
+		case ")":
+			return i, true
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// Adjacent string constants are concatenated by the server, so they are a
+// single constant.
+func isAdjacentString(prev sqlToken, t sqlToken) bool {
+	return prev.kind == sqlTokenConstant && !prev.isNumber &&
+		t.kind == sqlTokenConstant && !t.isNumber
+}
+
+// Turns a minus sign followed by a number into a negative number, unless the
+// minus sign is a binary operator.
+func foldNegativeNumbers(tokens []sqlToken) []sqlToken {
+	var result []sqlToken
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind == sqlTokenOperator && t.text == "-" && i+1 < len(tokens) && tokens[i+1].isNumber {
+			unary := len(result) == 0
+			if !unary {
+				prev := result[len(result)-1]
+				unary = prev.kind == sqlTokenOperator ||
+					(prev.kind == sqlTokenPunctuation && prev.text != ")" && prev.text != "]") ||
+					(prev.kind == sqlTokenIdentifier && isSQLKeywordBeforeExpression(prev.text))
+			}
+			if unary {
+				number := tokens[i+1]
+				number.text = "-" + number.text
+				result = append(result, number)
+				i++
+				continue
+			}
+		}
+		result = append(result, t)
+	}
+	return result
+}
+
+// Keywords after which a minus sign can only be a unary one.
+func isSQLKeywordBeforeExpression(word string) bool {
+	switch strings.ToLower(word) {
+	case "select", "where", "and", "or", "not", "in", "values", "set", "when",
+		"then", "else", "limit", "offset", "by", "between", "having", "on",
+		"return", "returning", "distinct", "all", "any", "some", "like",
+		"ilike", "is":
+		return true
+	}
+	return false
+}
+
+// Keywords which are followed by a space before an opening parenthesis in the
+// normalized text, unlike function names.
+func isSQLKeywordBeforeParenthesis(word string) bool {
+	switch word {
+	case "from", "join", "as", "exists", "over", "union", "intersect",
+		"except", "with", "lateral", "using":
+		return true
+	}
+	return isSQLKeywordBeforeExpression(word)
+}
+
+// Reports whether a space is needed between prev and t in the normalized
+// text.
+func needsSpace(prev sqlToken, t sqlToken) bool {
+	if prev.text == "" {
+		return false
+	}
+	switch t.text {
+	case ",", ")", "]", ";", ".", "::", ":", "[":
+		return false
+	case "(":
+		switch prev.kind {
+		case sqlTokenOperator:
+			return true
+		case sqlTokenPunctuation:
+			return prev.text == ","
+		case sqlTokenIdentifier:
+			return isSQLKeywordBeforeParenthesis(prev.text)
+		default:
+			return false
+		}
+	}
+	switch prev.text {
+	case "(", "[", ".", "::", ":":
+		return false
+	}
+	return true
+}
+
+type sqlTokenKind int
+
+const (
+	sqlTokenIdentifier sqlTokenKind = iota
+	sqlTokenQuotedIdentifier
+	sqlTokenConstant
+	sqlTokenParam
+	sqlTokenOperator
+	sqlTokenPunctuation
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	// true for numeric constants
+	isNumber bool
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9') || c == '$'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// The characters operators can consist of.
+const sqlOperatorChars = "+-*/<>=~!@#%^&|`?"
+
+// lexSQL splits sql into tokens, dropping whitespace and comments.
+func lexSQL(sql string) []sqlToken {
+	var tokens []sqlToken
+	i := 0
+	for i < len(sql) {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			i++
+
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			// block comments nest
+			depth := 0
+			for i < len(sql) {
+				if strings.HasPrefix(sql[i:], "/*") {
+					depth++
+					i += 2
+				} else if strings.HasPrefix(sql[i:], "*/") {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+
+		case c == '\'':
+			i = skipQuoted(sql, i+1, '\'', false)
+			tokens = append(tokens, sqlToken{kind: sqlTokenConstant, text: "''"})
+
+		case (c == 'e' || c == 'E') && i+1 < len(sql) && sql[i+1] == '\'':
+			i = skipQuoted(sql, i+2, '\'', true)
+			tokens = append(tokens, sqlToken{kind: sqlTokenConstant, text: "''"})
+
+		case (c == 'b' || c == 'B' || c == 'x' || c == 'X' || c == 'n' || c == 'N') && i+1 < len(sql) && sql[i+1] == '\'':
+			i = skipQuoted(sql, i+2, '\'', false)
+			tokens = append(tokens, sqlToken{kind: sqlTokenConstant, text: "''"})
+
+		case (c == 'u' || c == 'U') && strings.HasPrefix(sql[i+1:], "&'"):
+			i = skipQuoted(sql, i+3, '\'', false)
+			tokens = append(tokens, sqlToken{kind: sqlTokenConstant, text: "''"})
+
+		case (c == 'u' || c == 'U') && strings.HasPrefix(sql[i+1:], "&\""):
+			start := i
+			i = skipQuoted(sql, i+3, '"', false)
+			tokens = append(tokens, sqlToken{kind: sqlTokenQuotedIdentifier, text: sql[start:i]})
+
+		case c == '"':
+			start := i
+			i = skipQuoted(sql, i+1, '"', false)
+			tokens = append(tokens, sqlToken{kind: sqlTokenQuotedIdentifier, text: sql[start:i]})
+
+		case c == '$' && i+1 < len(sql) && isDigit(sql[i+1]):
+			start := i
+			i++
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenParam, text: sql[start:i]})
+
+		case c == '$':
+			end, ok := skipDollarQuoted(sql, i)
+			if !ok {
+				tokens = append(tokens, sqlToken{kind: sqlTokenOperator, text: "$"})
+				i++
+				continue
+			}
+			i = end
+			tokens = append(tokens, sqlToken{kind: sqlTokenConstant, text: "''"})
+
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+			start := i
+			i = skipNumber(sql, i)
+			tokens = append(tokens, sqlToken{kind: sqlTokenConstant, text: sql[start:i], isNumber: true})
+
+		case isIdentStart(c):
+			start := i
+			for i < len(sql) && isIdentChar(sql[i]) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenIdentifier, text: sql[start:i]})
+
+		case c == ':' && i+1 < len(sql) && sql[i+1] == ':':
+			tokens = append(tokens, sqlToken{kind: sqlTokenPunctuation, text: "::"})
+			i += 2
+
+		case strings.IndexByte("(),;[].:", c) != -1:
+			tokens = append(tokens, sqlToken{kind: sqlTokenPunctuation, text: string(c)})
+			i++
+
+		case strings.IndexByte(sqlOperatorChars, c) != -1:
+			start := i
+			for i < len(sql) && strings.IndexByte(sqlOperatorChars, sql[i]) != -1 &&
+				!strings.HasPrefix(sql[i:], "--") && !strings.HasPrefix(sql[i:], "/*") {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenOperator, text: sql[start:i]})
+
+		default:
+			tokens = append(tokens, sqlToken{kind: sqlTokenOperator, text: string(c)})
+			i++
+		}
+	}
+	return tokens
+}
+
+// Returns the index after the closing quote of a quoted string or identifier
+// starting at i, or the end of sql if the string is unterminated.  The quote
+// is escaped by doubling it, and additionally with a backslash if
+// backslashEscapes is true.
+func skipQuoted(sql string, i int, quote byte, backslashEscapes bool) int {
+	for i < len(sql) {
+		c := sql[i]
+		if backslashEscapes && c == '\\' {
+			i += 2
+			continue
+		}
+		if c == quote {
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return len(sql)
+}
+
+// If a dollar-quoted string such as $$text$$ or $tag$text$tag$ starts at i,
+// returns the index after it.  An unterminated string extends to the end of
+// sql.
+func skipDollarQuoted(sql string, i int) (int, bool) {
+	j := i + 1
+	if j < len(sql) && sql[j] != '$' {
+		if !isIdentStart(sql[j]) {
+			return 0, false
+		}
+		for j < len(sql) && isIdentChar(sql[j]) && sql[j] != '$' {
+			j++
+		}
+	}
+	if j >= len(sql) || sql[j] != '$' {
+		return 0, false
+	}
+	delimiter := sql[i : j+1]
+	end := strings.Index(sql[j+1:], delimiter)
+	if end == -1 {
+		return len(sql), true
+	}
+	return j + 1 + end + len(delimiter), true
+}
+
+// Returns the index after a numeric constant starting at i.  Accepts
+// decimal, hexadecimal, octal and binary integers, decimals, exponents and
+// underscores between digits.
+func skipNumber(sql string, i int) int {
+	if sql[i] == '0' && i+1 < len(sql) && strings.IndexByte("xXoObB", sql[i+1]) != -1 {
+		i += 2
+		for i < len(sql) && (isIdentChar(sql[i]) && sql[i] != '$') {
+			i++
+		}
+		return i
+	}
+	for i < len(sql) && (isDigit(sql[i]) || sql[i] == '_') {
+		i++
+	}
+	// "1..2" is not a decimal, but a range in PL/pgSQL
+	if i < len(sql) && sql[i] == '.' && !strings.HasPrefix(sql[i:], "..") {
+		i++
+		for i < len(sql) && (isDigit(sql[i]) || sql[i] == '_') {
+			i++
+		}
+	}
+	if i < len(sql) && (sql[i] == 'e' || sql[i] == 'E') {
+		j := i + 1
+		if j < len(sql) && (sql[j] == '+' || sql[j] == '-') {
+			j++
+		}
+		if j < len(sql) && isDigit(sql[j]) {
+			i = j
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
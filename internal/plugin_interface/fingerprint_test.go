@@ -0,0 +1,119 @@
+package plugin_interface
+
+import (
+	"testing"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+	testCases := []struct {
+		name     string
+		sql      string
+		expected string
+	}{
+		// pgbench
+		{"pgbench select", "SELECT abalance FROM pgbench_accounts WHERE aid = 42;", "select abalance from pgbench_accounts where aid = $1"},
+		{"pgbench update", "UPDATE pgbench_accounts SET abalance = abalance + -5000 WHERE aid = 12345;", "update pgbench_accounts set abalance = abalance + $1 where aid = $2"},
+		{"pgbench insert", "INSERT INTO pgbench_history (tid, bid, aid, delta, mtime) VALUES (7, 1, 12345, -5000, CURRENT_TIMESTAMP);", "insert into pgbench_history(tid, bid, aid, delta, mtime) values ($1, $2, $3, $4, current_timestamp)"},
+
+		// IN lists
+		{"in list", "SELECT id FROM users WHERE id IN (1, 2, 3) AND status IN ('a', 'b')", "select id from users where id in (...) and status in (...)"},
+		{"in list with parameters", "SELECT id FROM users WHERE id IN ($1, $2, 3)", "select id from users where id in (...)"},
+		{"in list of one", "SELECT id FROM users WHERE id IN (7)", "select id from users where id in (...)"},
+		{"not in list", "SELECT id FROM users WHERE id NOT IN (-1, -2)", "select id from users where id not in (...)"},
+		{"in list of adjacent strings", "SELECT id FROM users WHERE name IN ('a'\n'b', 'c')", "select id from users where name in (...)"},
+		{"in subquery", "SELECT id FROM users WHERE id NOT IN (SELECT user_id FROM bans)", "select id from users where id not in (select user_id from bans)"},
+		{"in list of expressions", "SELECT id FROM users WHERE id IN (1, 2 + 3)", "select id from users where id in ($1, $2 + $3)"},
+
+		// negative numbers and binary minus
+		{"binary minus", "SELECT a - 1, a-1, a -1, (a) - 1, a[1] - 2 FROM t", "select a - $1, a - $2, a - $3, (a) - $4, a[$5] - $6 from t"},
+		{"negative numbers", "SELECT -1, x FROM t WHERE b = -1 AND c > -2.5e3", "select $1, x from t where b = $2 and c > $3"},
+		{"negative after keywords", "SELECT * FROM t WHERE a BETWEEN -1 AND -2 LIMIT -1", "select * from t where a between $1 and $2 limit $3"},
+		{"negative in case", "SELECT CASE WHEN a THEN -1 ELSE 2 END", "select case when a then $1 else $2 end"},
+		{"minus after parameter", "SELECT $1::int - 1", "select $1::int - $2"},
+		{"minus after function call", "SELECT * FROM t WHERE ts > now() - interval '1 day'", "select * from t where ts > now() - interval $1"},
+
+		// strings
+		{"escaped quotes", "SELECT 'it''s', E'it\\'s', E'a\\\\' FROM t", "select $1, $2, $3 from t"},
+		{"E string ending in an escaped backslash", "SELECT E'\\\\', 1", "select $1, $2"},
+		{"bit strings", "SELECT * FROM t WHERE y = B'1010' AND z = X'1F' AND n = N'x'", "select * from t where y = $1 and z = $2 and n = $3"},
+		{"unicode escapes", "SELECT U&'d\\0061t\\+000061' FROM t", "select $1 from t"},
+		{"unterminated string", "SELECT 'unterminated", "select $1"},
+
+		// dollar quoting
+		{"dollar quoted", "SELECT $$it's $1 a -- test$$ FROM t", "select $1 from t"},
+		{"tagged dollar quoted", "SELECT $fn$ body $$ nested $fn$, 1 FROM t", "select $1, $2 from t"},
+		{"function body", "CREATE FUNCTION f() RETURNS int AS $body$ BEGIN RETURN 1; END $body$ LANGUAGE plpgsql", "create function f() returns int as $1 language plpgsql"},
+
+		// adjacent string literals are a single constant
+		{"adjacent strings", "SELECT 'foo'\n'bar' AS x, 'a' 'b'", "select $1 as x, $2"},
+		{"adjacent E strings", "SELECT E'foo\\n'\n'bar'", "select $1"},
+
+		// comments
+		{"line comment", "SELECT 1 -- comment\n, 2", "select $1, $2"},
+		{"nested block comment", "SELECT /* block /* nested */ still */ 1", "select $1"},
+		{"comment at the start", "/* app:web,action:index */ SELECT 1", "select $1"},
+		{"comment-like text in a string", "SELECT '-- not a comment', '/* nor this */'", "select $1, $2"},
+		{"comment after an operator", "SELECT 1+-- comment\n2", "select $1 + $2"},
+
+		// parameters
+		{"parameters", "SELECT * FROM t WHERE a = $1 AND b = $2 AND c = 5", "select * from t where a = $1 and b = $2 and c = $3"},
+		{"parameters out of order", "SELECT * FROM t WHERE a = 1 AND b = $3 AND c = $1", "select * from t where a = $4 and b = $3 and c = $1"},
+
+		// identifiers and keywords
+		{"case folding", "select * from T where A = 1", "select * from t where a = $1"},
+		{"quoted identifiers", `SELECT "MixedCase"."Col" FROM "MixedCase"`, `select "MixedCase"."Col" from "MixedCase"`},
+		{"casts", "SELECT count(*) FROM t WHERE x::text = '5'", "select count(*) from t where x::text = $1"},
+		{"numbers", "SELECT 0x1F, 1_000_000, .5, 1.5e-3, 0b101, 0o17", "select $1, $2, $3, $4, $5, $6"},
+		{"arrays", "SELECT ARRAY[1, 2, 3], coalesce(a, 0) FROM t", "select array[$1, $2, $3], coalesce(a, $4) from t"},
+		{"subquery", "SELECT * FROM t WHERE EXISTS (SELECT 1 FROM u WHERE u.id = t.id)", "select * from t where exists (select $1 from u where u.id = t.id)"},
+		{"cte", "WITH x AS (SELECT 1) SELECT * FROM x JOIN y USING (id)", "with x as (select $1) select * from x join y using (id)"},
+		{"whitespace", "  SELECT\n\t*\r\n  FROM   t  ", "select * from t"},
+		{"empty", "", ""},
+	}
+	for _, tc := range testCases {
+		got := NormalizeQuery(tc.sql)
+		if got != tc.expected {
+			t.Errorf("%s: NormalizeQuery(%q) = %q; expected %q", tc.name, tc.sql, got, tc.expected)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	testCases := []struct {
+		a, b  string
+		equal bool
+	}{
+		// only the constants differ
+		{"SELECT * FROM t WHERE id = 1", "select *\n  from t\n where id = 2 -- by id", true},
+		{"SELECT * FROM t WHERE id IN (1, 2, 3)", "SELECT * FROM t WHERE id IN (4)", true},
+		{"SELECT * FROM t WHERE x = -1", "SELECT * FROM t WHERE x = 1", true},
+		{"SELECT 'a'", "SELECT E'b\\'c'", true},
+		{"SELECT 'a'", "SELECT $$b$$", true},
+		{"SELECT 'a' 'b'", "SELECT 'c'", true},
+		{"SELECT A FROM T", "select a from t", true},
+		{"/* request 1 */ SELECT 1", "/* request 2 */ SELECT 2", true},
+
+		// the statements differ
+		{"SELECT a - 1 FROM t", "SELECT a + 1 FROM t", false},
+		{"SELECT a - 1 FROM t", "SELECT a, -1 FROM t", false},
+		{`SELECT * FROM "T"`, "SELECT * FROM t", false},
+		{"SELECT * FROM t WHERE id IN (1, 2)", "SELECT * FROM t WHERE id IN (SELECT 1)", false},
+		{"SELECT * FROM t LIMIT 1", "SELECT * FROM t OFFSET 1", false},
+		{"SELECT * FROM t WHERE a = $1", "SELECT * FROM t WHERE a = $2", false},
+		{"SELECT * FROM t WHERE a = 1", "SELECT * FROM u WHERE a = 1", false},
+	}
+	for _, tc := range testCases {
+		fingerprintA, normalizedA := Fingerprint(tc.a)
+		fingerprintB, normalizedB := Fingerprint(tc.b)
+		if len(fingerprintA) != 16 {
+			t.Errorf("Fingerprint(%q) = %q; expected 16 hexadecimal digits", tc.a, fingerprintA)
+		}
+		if normalizedA != NormalizeQuery(tc.a) {
+			t.Errorf("Fingerprint(%q) normalized to %q, unlike NormalizeQuery", tc.a, normalizedA)
+		}
+		if (fingerprintA == fingerprintB) != tc.equal {
+			t.Errorf("Fingerprint(%q) = %s (%q), Fingerprint(%q) = %s (%q); expected equal to be %v",
+				tc.a, fingerprintA, normalizedA, tc.b, fingerprintB, normalizedB, tc.equal)
+		}
+	}
+}
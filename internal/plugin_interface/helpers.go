@@ -0,0 +1,37 @@
+package plugin_interface
+
+import (
+	"bytes"
+	"unicode/utf8"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The functions in this file are shared by the bundled plugins, for work
+// which keeps coming up when storing records.
+
+// TruncateUTF8 truncates s to at most n bytes, without cutting a multi-byte
+// UTF-8 sequence in half.
+func TruncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// BucketKeysBefore returns the keys in b which sort before end, in order, or
+// all of them if end is nil.  Deleting keys while iterating over them with a
+// cursor can skip keys, so expired keys should be collected with this first
+// and deleted afterwards.  The keys are only valid for the life of the
+// transaction.
+func BucketKeysBefore(b *bolt.Bucket, end []byte) [][]byte {
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && (end == nil || bytes.Compare(k, end) < 0); k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,80 @@
+package plugin_interface
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestTruncateUTF8(t *testing.T) {
+	testCases := []struct {
+		s        string
+		n        int
+		expected string
+	}{
+		{"SELECT 1", 100, "SELECT 1"},
+		{"SELECT 1", 8, "SELECT 1"},
+		{"SELECT 1", 6, "SELECT"},
+		{"SELECT 1", 0, ""},
+		{"", 5, ""},
+		// "ä" takes up two bytes and "€" three
+		{"päivä", 2, "p"},
+		{"päivä", 3, "pä"},
+		{"€€", 5, "€"},
+		{"€€", 4, "€"},
+		{"€€", 3, "€"},
+		{"€€", 2, ""},
+	}
+	for _, tc := range testCases {
+		if got := TruncateUTF8(tc.s, tc.n); got != tc.expected {
+			t.Errorf("TruncateUTF8(%q, %d) = %q; expected %q", tc.s, tc.n, got, tc.expected)
+		}
+	}
+}
+
+func TestBucketKeysBefore(t *testing.T) {
+	dbh, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbh.Close()
+
+	testCases := []struct {
+		end      []byte
+		expected string
+	}{
+		{nil, "a,b,ba,c"},
+		{[]byte("a"), ""},
+		{[]byte("b"), "a"},
+		{[]byte("bb"), "a,b,ba"},
+		{[]byte("z"), "a,b,ba,c"},
+	}
+	err = dbh.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("test"))
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"c", "a", "ba", "b"} {
+			err = b.Put([]byte(k), []byte("value"))
+			if err != nil {
+				return err
+			}
+		}
+		for _, tc := range testCases {
+			var keys []string
+			for _, k := range BucketKeysBefore(b, tc.end) {
+				keys = append(keys, string(k))
+			}
+			if got := strings.Join(keys, ","); got != tc.expected {
+				t.Errorf("BucketKeysBefore(%q) = %q; expected %q", tc.end, got, tc.expected)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,67 @@
+package plugin_interface
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// The interfaces in this file can optionally be implemented by a Plugin to be
+// notified of events in the log stream other than records being read.  Unless
+// stated otherwise, an error returned by any of these functions is handled
+// according to the plugin's on_error setting, like errors returned by Process.
+
+// BatchProcessor can be implemented by plugins which are more efficient when
+// processing many records at a time, e.g. ones doing bulk inserts into an
+// external database.  If a plugin implements BatchProcessor, its Process
+// function is never called.  Instead, the records are collected into batches,
+// which are bounded by the plugin's batch_max_records, batch_max_bytes and
+// batch_max_latency settings.  streamPos is the position of the last record
+// in the batch, as it would have been passed to Process.
+//
+// A batch is always passed to ProcessBatch before the position in the log
+// stream is persisted past any of its records, and before the plugin's
+// Checkpoint and Close functions are called.  If ProcessBatch returns an
+// error, the whole batch is considered to have failed.
+type BatchProcessor interface {
+	ProcessBatch(streamPos *LogStreamPosition, records [][]string) error
+}
+
+// FileSwitcher can be implemented by plugins which keep state per log file.
+// FileSwitched is called before the first record of a log file is processed:
+// when pgfisher moves on to the next file, and when the current file has been
+// truncated or replaced and is read again from its beginning.  previous is
+// the position at which reading the previous file stopped, and streamPos the
+// position in the new file.
+type FileSwitcher interface {
+	FileSwitched(previous LogStreamPosition, streamPos *LogStreamPosition) error
+}
+
+// Checkpointer can be implemented by plugins which keep state in the
+// database.  Checkpoint is called every time pgfisher persists its position in
+// the log stream, in the same transaction.  A plugin which writes its state in
+// Checkpoint (and not in Process) sees every record exactly once: after a
+// crash, both the position and the plugin's state are as of the last
+// checkpoint.  If Checkpoint returns an error, the transaction is rolled back
+// and pgfisher exits, regardless of the on_error setting.
+type Checkpointer interface {
+	Checkpoint(tx *bolt.Tx, streamPos *LogStreamPosition) error
+}
+
+// IdleNotifier can be implemented by plugins which buffer data.  Idle is
+// called when pgfisher has processed all records written so far and is going
+// to wait for the server to write more.  It's called once per such wait, not
+// every time pgfisher polls the log file.
+type IdleNotifier interface {
+	Idle(streamPos *LogStreamPosition) error
+}
+
+// Closer can be implemented by plugins which hold resources such as
+// connections or child processes.  Close is called when pgfisher is shutting
+// down, after the last record has been processed and the position in the log
+// stream has been persisted for the last time, including the call to
+// Checkpoint.  No other function of the plugin is called after Close.  Since
+// the position has already been persisted, data which has to be written before
+// it moves on should be written in ProcessBatch or Checkpoint, not in Close.
+// If Close returns an error, pgfisher exits with an error.
+type Closer interface {
+	Close() error
+}
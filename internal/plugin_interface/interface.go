@@ -1,7 +1,9 @@
 package plugin_interface
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"strconv"
 	"time"
 
@@ -10,15 +12,38 @@ import (
 )
 
 type PluginInitArgs struct {
+	// The name the plugin was registered under
+	Name               string
 	DBH                *bolt.DB
 	PrometheusRegistry *prometheus.Registry
 	Args               string
+	// The plugin's config section in the configuration file, if any
+	Config map[string]interface{}
+	// The name of a bucket in DBH reserved for this plugin.  It's created
+	// before the plugin is initialized.
+	Bucket []byte
+	// The server's log_timezone, for use with LogEntry.LogTime and
+	// LogEntry.SessionStartTime.
+	LogTimezone *time.Location
+	// The mux of the HTTP server serving the metrics, or nil if metrics
+	// are disabled.  Plugins should only register handlers for paths
+	// starting with "/plugins/" followed by their name.
+	HTTPMux *http.ServeMux
 }
 
 type LogStreamPosition struct {
 	Filename       string `json:"filename"`
 	Offset         int64  `json:"offset"`
 	BytesReadTotal int64  `json:"bytesReadTotal"`
+
+	// The identity of the file Filename referred to when it was read from.
+	// These are used to notice the file having been truncated or replaced
+	// since.  The fingerprint is computed over the first FingerprintLength
+	// bytes of the file.
+	Device            uint64 `json:"device,omitempty"`
+	Inode             uint64 `json:"inode,omitempty"`
+	Fingerprint       string `json:"fingerprint,omitempty"`
+	FingerprintLength int64  `json:"fingerprintLength,omitempty"`
 }
 
 type Plugin interface {
@@ -52,25 +77,42 @@ const (
 	BackendTypeAttno
 	LeaderPidAttno
 	QueryIDAttno
+
+	// Not a csvlog column; see ParseJSONLogRecord.
+	ExtraFieldsAttno
 )
 
 type LogEntry struct {
 	record []string
+	schema CSVLogSchema
+	// See SetLogTimezone
+	logTimezone *time.Location
 }
 
+// NewLogEntry creates a LogEntry from a record in the csvlog format of any
+// supported server version, or a record created by ParseJSONLogRecord.  The
+// columns of records wider than the newest known format are ignored; see
+// CSVLogSchemaForColumnCount.
 func NewLogEntry(record []string) (*LogEntry, error) {
-	// All supported versions should have the fields up to and including
-	// application_name.
-	if len(record) < 1+ApplicationNameAttno {
-		return nil, fmt.Errorf("unexpected record length of %d; expected at least %d", len(record), 1+ApplicationNameAttno)
+	schema, err := CSVLogSchemaForColumnCount(len(record))
+	if err != nil {
+		return nil, err
 	}
 	return &LogEntry{
 		record: record,
+		schema: schema,
 	}, nil
 }
 
+// Schema returns the csvlog format of the record.
+func (le *LogEntry) Schema() CSVLogSchema {
+	return le.schema
+}
+
+// LogTime parses the log_time column using ParseLogTimestamp.  loc should be
+// the server's log_timezone.
 func (le *LogEntry) LogTime(loc *time.Location) (time.Time, error) {
-	return time.ParseInLocation("2006-01-02 15:04:05 MST", le.record[LogTimeAttno], loc)
+	return ParseLogTimestamp(le.record[LogTimeAttno], loc)
 }
 
 func (le *LogEntry) LogTimeString() string {
@@ -85,12 +127,27 @@ func (le *LogEntry) DatabaseName() string {
 	return le.record[DatabaseNameAttno]
 }
 
+// ProcessID panics if the column does not contain a valid process ID; see
+// ParseProcessID.
 func (le *LogEntry) ProcessID() int {
-	n, err := strconv.ParseInt(le.record[ProcessIDAttno], 10, 64)
+	n, err := le.ParseProcessID()
+	if err != nil {
+		panic(err.Error())
+	}
+	return n
+}
+
+// ParseProcessID returns ErrEmptyColumn if the process ID is not known, which
+// can happen with stderr logs.
+func (le *LogEntry) ParseProcessID() (int, error) {
+	if le.record[ProcessIDAttno] == "" {
+		return 0, ErrEmptyColumn
+	}
+	n, err := strconv.ParseInt(le.record[ProcessIDAttno], 10, 32)
 	if err != nil {
-		panic(fmt.Sprintf("invalid process id %s", le.record[ProcessIDAttno]))
+		return 0, fmt.Errorf("invalid process id %s", le.record[ProcessIDAttno])
 	}
-	return int(n)
+	return int(n), nil
 }
 
 func (le *LogEntry) ConnectionFrom() string {
@@ -98,23 +155,40 @@ func (le *LogEntry) ConnectionFrom() string {
 }
 
 func (le *LogEntry) SessionID() string {
-	return le.record[DatabaseNameAttno]
+	return le.record[SessionIDAttno]
 }
 
+// SessionLineNum panics if the column does not contain a valid line number;
+// see ParseSessionLineNum.
 func (le *LogEntry) SessionLineNum() int64 {
-	n, err := strconv.ParseInt(le.record[SessionLineNumAttno], 10, 64)
+	n, err := le.ParseSessionLineNum()
 	if err != nil {
-		panic(fmt.Sprintf("invalid session line num %s", le.record[SessionLineNumAttno]))
+		panic(err.Error())
 	}
 	return n
 }
 
+// ParseSessionLineNum returns ErrEmptyColumn if the line number is not known,
+// which can happen with stderr logs.
+func (le *LogEntry) ParseSessionLineNum() (int64, error) {
+	if le.record[SessionLineNumAttno] == "" {
+		return 0, ErrEmptyColumn
+	}
+	n, err := strconv.ParseInt(le.record[SessionLineNumAttno], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid session line num %s", le.record[SessionLineNumAttno])
+	}
+	return n, nil
+}
+
 func (le *LogEntry) CommandTag() string {
 	return le.record[CommandTagAttno]
 }
 
+// SessionStartTime parses the session_start_time column using
+// ParseLogTimestamp.  loc should be the server's log_timezone.
 func (le *LogEntry) SessionStartTime(loc *time.Location) (time.Time, error) {
-	return time.ParseInLocation("2006-01-02 15:04:05 MST", le.record[SessionStartTimeAttno], loc)
+	return ParseLogTimestamp(le.record[SessionStartTimeAttno], loc)
 }
 
 func (le *LogEntry) SessionStartTimeString() string {
@@ -125,14 +199,21 @@ func (le *LogEntry) VirtualTransactionID() string {
 	return le.record[VirtualTransactionIDAttno]
 }
 
+// TransactionID panics if the column does not contain a valid transaction
+// ID; see ParseTransactionID.
 func (le *LogEntry) TransactionID() int64 {
-	n, err := strconv.ParseInt(le.record[TransactionIDAttno], 10, 64)
+	n, err := le.ParseTransactionID()
 	if err != nil {
-		panic(fmt.Sprintf("invalid transaction id %s", le.record[TransactionIDAttno]))
+		panic(err.Error())
 	}
 	return n
 }
 
+// ParseTransactionID returns zero if no transaction ID was assigned.
+func (le *LogEntry) ParseTransactionID() (int64, error) {
+	return parseOptionalInt(le.record[TransactionIDAttno], 64, "transaction id")
+}
+
 func (le *LogEntry) ErrorSeverity() string {
 	return le.record[ErrorSeverityAttno]
 }
@@ -157,12 +238,21 @@ func (le *LogEntry) InternalQuery() string {
 	return le.record[InternalQueryAttno]
 }
 
+// InternalQueryPos panics if the column does not contain a valid position;
+// see ParseInternalQueryPos.
 func (le *LogEntry) InternalQueryPos() int {
-	n, err := strconv.ParseInt(le.record[InternalQueryPosAttno], 10, 32)
+	n, err := le.ParseInternalQueryPos()
 	if err != nil {
-		panic(fmt.Sprintf("invalid internal query pos %s", le.record[InternalQueryPosAttno]))
+		panic(err.Error())
 	}
-	return int(n)
+	return n
+}
+
+// ParseInternalQueryPos returns zero if the record has no internal query
+// position.
+func (le *LogEntry) ParseInternalQueryPos() (int, error) {
+	n, err := parseOptionalInt(le.record[InternalQueryPosAttno], 32, "internal query pos")
+	return int(n), err
 }
 
 func (le *LogEntry) Context() string {
@@ -173,12 +263,20 @@ func (le *LogEntry) Query() string {
 	return le.record[QueryAttno]
 }
 
+// QueryPos panics if the column does not contain a valid position; see
+// ParseQueryPos.
 func (le *LogEntry) QueryPos() int {
-	n, err := strconv.ParseInt(le.record[QueryPosAttno], 10, 32)
+	n, err := le.ParseQueryPos()
 	if err != nil {
-		panic(fmt.Sprintf("invalid query pos %s", le.record[QueryPosAttno]))
+		panic(err.Error())
 	}
-	return int(n)
+	return n
+}
+
+// ParseQueryPos returns zero if the record has no query position.
+func (le *LogEntry) ParseQueryPos() (int, error) {
+	n, err := parseOptionalInt(le.record[QueryPosAttno], 32, "query pos")
+	return int(n), err
 }
 
 func (le *LogEntry) Location() string {
@@ -188,3 +286,70 @@ func (le *LogEntry) Location() string {
 func (le *LogEntry) ApplicationName() string {
 	return le.record[ApplicationNameAttno]
 }
+
+// BackendType returns ErrNoSuchColumn for records written by servers older
+// than version 13.
+func (le *LogEntry) BackendType() (string, error) {
+	if !le.schema.HasColumn(BackendTypeAttno) {
+		return "", ErrNoSuchColumn
+	}
+	return le.record[BackendTypeAttno], nil
+}
+
+// LeaderPid returns the process ID of the parallel group leader, or zero if
+// the process is not a parallel worker.  Returns ErrNoSuchColumn for records
+// written by servers older than version 14.
+func (le *LogEntry) LeaderPid() (int, error) {
+	if !le.schema.HasColumn(LeaderPidAttno) {
+		return 0, ErrNoSuchColumn
+	}
+	n, err := parseOptionalInt(le.record[LeaderPidAttno], 32, "leader pid")
+	return int(n), err
+}
+
+// QueryID returns ErrNoSuchColumn for records written by servers older than
+// version 14.  The query ID is zero unless compute_query_id is enabled.
+func (le *LogEntry) QueryID() (int64, error) {
+	if !le.schema.HasColumn(QueryIDAttno) {
+		return 0, ErrNoSuchColumn
+	}
+	return parseOptionalInt(le.record[QueryIDAttno], 64, "query id")
+}
+
+// Parses an integer column which is empty when the value is not applicable,
+// returning zero in that case.
+func parseOptionalInt(value string, bitSize int, what string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %s", what, value)
+	}
+	return n, nil
+}
+
+// JSONField returns the value of key as it would appear in a jsonlog record.
+// ok is false if the key was not present in the record, or had an empty
+// value.  For records read from a csvlog file, only the keys which correspond
+// to a csvlog column are available.
+func (le *LogEntry) JSONField(key string) (value string, ok bool) {
+	if attno, found := jsonLogKeyAttnos[key]; found {
+		if !le.schema.HasColumn(attno) {
+			return "", false
+		}
+		value = le.record[attno]
+		return value, value != ""
+	}
+
+	if len(le.record) <= ExtraFieldsAttno || le.record[ExtraFieldsAttno] == "" {
+		return "", false
+	}
+	var extra map[string]string
+	err := json.Unmarshal([]byte(le.record[ExtraFieldsAttno]), &extra)
+	if err != nil {
+		return "", false
+	}
+	value, ok = extra[key]
+	return value, ok && value != ""
+}
@@ -0,0 +1,116 @@
+package plugin_interface
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// The keys of a jsonlog record which map directly to a csvlog column.
+var jsonLogKeyAttnos = map[string]int{
+	"timestamp":         LogTimeAttno,
+	"user":              UserNameAttno,
+	"dbname":            DatabaseNameAttno,
+	"pid":               ProcessIDAttno,
+	"session_id":        SessionIDAttno,
+	"line_num":          SessionLineNumAttno,
+	"ps":                CommandTagAttno,
+	"session_start":     SessionStartTimeAttno,
+	"vxid":              VirtualTransactionIDAttno,
+	"txid":              TransactionIDAttno,
+	"error_severity":    ErrorSeverityAttno,
+	"state_code":        SQLStateAttno,
+	"message":           MessageAttno,
+	"detail":            DetailAttno,
+	"hint":              HintAttno,
+	"internal_query":    InternalQueryAttno,
+	"internal_position": InternalQueryPosAttno,
+	"context":           ContextAttno,
+	"statement":         QueryAttno,
+	"cursor_position":   QueryPosAttno,
+	"application_name":  ApplicationNameAttno,
+	"backend_type":      BackendTypeAttno,
+	"leader_pid":        LeaderPidAttno,
+	"query_id":          QueryIDAttno,
+}
+
+// ParseJSONLogRecord converts a single line of a jsonlog file into a record
+// with the same layout as a csvlog record, so that it can be passed to
+// Plugin.Process.  The keys which have no csvlog equivalent (remote_host,
+// remote_port, func_name, file_name, file_line_num and any keys added in
+// future server versions) are kept as a JSON object in the column
+// ExtraFieldsAttno; see LogEntry.JSONField.
+func ParseJSONLogRecord(data []byte) ([]string, error) {
+	var obj map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&obj)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse jsonlog record: %s", err)
+	}
+
+	record := make([]string, ExtraFieldsAttno+1)
+	// csvlog always includes the transaction ID, jsonlog only when assigned
+	record[TransactionIDAttno] = "0"
+	extra := make(map[string]string)
+	var detailLog string
+	var hasDetailLog bool
+	for key, value := range obj {
+		var str string
+		switch v := value.(type) {
+		case string:
+			str = v
+		case json.Number:
+			str = v.String()
+		case bool:
+			str = strconv.FormatBool(v)
+		case nil:
+			str = ""
+		default:
+			data, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			str = string(data)
+		}
+
+		attno, ok := jsonLogKeyAttnos[key]
+		if key == "detail_log" {
+			detailLog, hasDetailLog = str, true
+		} else if ok {
+			record[attno] = str
+		} else {
+			extra[key] = str
+		}
+	}
+
+	// The server only writes one of detail and detail_log, but should a
+	// record have both, detail_log takes precedence like it does in csvlog.
+	if hasDetailLog {
+		record[DetailAttno] = detailLog
+	}
+
+	// csvlog combines these into a single column each
+	if host, ok := extra["remote_host"]; ok {
+		record[ConnectionFromAttno] = host
+		if port, ok := extra["remote_port"]; ok {
+			record[ConnectionFromAttno] += ":" + port
+		}
+	}
+	if file, ok := extra["file_name"]; ok {
+		record[LocationAttno] = file + ":" + extra["file_line_num"]
+		if function, ok := extra["func_name"]; ok {
+			record[LocationAttno] = function + ", " + record[LocationAttno]
+		}
+	}
+
+	if len(extra) > 0 {
+		data, err := json.Marshal(extra)
+		if err != nil {
+			return nil, err
+		}
+		record[ExtraFieldsAttno] = string(data)
+	}
+	return record, nil
+}
@@ -0,0 +1,144 @@
+package plugin_interface
+
+import (
+	"testing"
+)
+
+func TestParseJSONLogRecord(t *testing.T) {
+	testCases := []struct {
+		name     string
+		line     string
+		expected map[int]string
+		extra    map[string]string
+	}{
+		{
+			name: "statement",
+			line: `{"timestamp":"2024-10-01 13:00:00.123 EEST","user":"app","dbname":"appdb","pid":1234,"remote_host":"10.0.0.1","remote_port":5432,"session_id":"66fbc8a0.4d2","line_num":3,"ps":"SELECT","session_start":"2024-10-01 12:59:00 EEST","vxid":"3/42","txid":0,"error_severity":"LOG","message":"duration: 1.000 ms  statement: SELECT 1","application_name":"psql","backend_type":"client backend","query_id":-123}`,
+			expected: map[int]string{
+				LogTimeAttno:              "2024-10-01 13:00:00.123 EEST",
+				UserNameAttno:             "app",
+				DatabaseNameAttno:         "appdb",
+				ProcessIDAttno:            "1234",
+				ConnectionFromAttno:       "10.0.0.1:5432",
+				SessionIDAttno:            "66fbc8a0.4d2",
+				SessionLineNumAttno:       "3",
+				CommandTagAttno:           "SELECT",
+				SessionStartTimeAttno:     "2024-10-01 12:59:00 EEST",
+				VirtualTransactionIDAttno: "3/42",
+				TransactionIDAttno:        "0",
+				ErrorSeverityAttno:        "LOG",
+				MessageAttno:              "duration: 1.000 ms  statement: SELECT 1",
+				ApplicationNameAttno:      "psql",
+				BackendTypeAttno:          "client backend",
+				QueryIDAttno:              "-123",
+				DetailAttno:               "",
+			},
+			extra: map[string]string{
+				"remote_host": "10.0.0.1",
+				"remote_port": "5432",
+			},
+		},
+		{
+			name: "error with location",
+			line: `{"timestamp":"2024-10-01 13:00:00.123 EEST","pid":1234,"error_severity":"ERROR","state_code":"42P01","message":"relation \"foo\" does not exist","statement":"SELECT * FROM foo","cursor_position":15,"func_name":"parserOpenTable","file_name":"parse_relation.c","file_line_num":1392,"txid":"745"}`,
+			expected: map[int]string{
+				ErrorSeverityAttno: "ERROR",
+				SQLStateAttno:      "42P01",
+				MessageAttno:       `relation "foo" does not exist`,
+				QueryAttno:         "SELECT * FROM foo",
+				QueryPosAttno:      "15",
+				LocationAttno:      "parserOpenTable, parse_relation.c:1392",
+				TransactionIDAttno: "745",
+				UserNameAttno:      "",
+			},
+			extra: map[string]string{
+				"func_name":     "parserOpenTable",
+				"file_name":     "parse_relation.c",
+				"file_line_num": "1392",
+			},
+		},
+		{
+			name: "detail",
+			line: `{"error_severity":"ERROR","message":"m","detail":"client detail"}`,
+			expected: map[int]string{
+				DetailAttno: "client detail",
+			},
+		},
+		{
+			name: "detail_log",
+			line: `{"error_severity":"ERROR","message":"m","detail_log":"server detail"}`,
+			expected: map[int]string{
+				DetailAttno: "server detail",
+			},
+		},
+		{
+			name: "detail_log before detail",
+			line: `{"detail_log":"server detail","detail":"client detail"}`,
+			expected: map[int]string{
+				DetailAttno: "server detail",
+			},
+		},
+		{
+			name: "detail_log after detail",
+			line: `{"detail":"client detail","detail_log":"server detail"}`,
+			expected: map[int]string{
+				DetailAttno: "server detail",
+			},
+		},
+		{
+			name: "unknown keys",
+			line: `{"message":"m","future_key":{"a":[1,2]},"flag":true,"nothing":null}`,
+			expected: map[int]string{
+				MessageAttno: "m",
+			},
+			extra: map[string]string{
+				"future_key": `{"a":[1,2]}`,
+				"flag":       "true",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		record, err := ParseJSONLogRecord([]byte(tc.line))
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if len(record) != ExtraFieldsAttno+1 {
+			t.Errorf("%s: unexpected record length %d", tc.name, len(record))
+			continue
+		}
+		for attno, value := range tc.expected {
+			if record[attno] != value {
+				t.Errorf("%s: column %d = %q; expected %q", tc.name, attno, record[attno], value)
+			}
+		}
+
+		le, err := NewLogEntry(record)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		for key, value := range tc.extra {
+			got, ok := le.JSONField(key)
+			if !ok || got != value {
+				t.Errorf("%s: JSONField(%q) = %q, %v; expected %q", tc.name, key, got, ok, value)
+			}
+		}
+		if _, ok := le.JSONField("detail_log"); ok {
+			t.Errorf("%s: detail_log was kept as an extra field", tc.name)
+		}
+	}
+}
+
+func TestParseJSONLogRecordErrors(t *testing.T) {
+	for _, line := range []string{
+		``,
+		`{"message":`,
+		`["message"]`,
+	} {
+		_, err := ParseJSONLogRecord([]byte(line))
+		if err == nil {
+			t.Errorf("ParseJSONLogRecord(%q) did not return an error", line)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package plugin_interface
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// OtherLabelValue is the value LabelLimiter uses for the values which aren't
+// among the most common ones.
+const OtherLabelValue = "other"
+
+// How many times max values a LabelLimiter counts at most.  The least common
+// ones are forgotten beyond that.
+const labelCountsFactor = 10
+
+// LabelLimiter bounds the number of values of a Prometheus label whose values
+// are chosen by the clients, such as the application name, so that a
+// misbehaving client can't create an unbounded number of series.  Only the
+// max most common values are used as is, and the rest are replaced with
+// OtherLabelValue.  Until max values have been seen, every new value is used
+// as is.
+//
+// The values are ranked again by Rerank, which plugins should call in
+// Checkpoint after Store: a value which has become more common than one of
+// the values in use replaces it.  The counts are kept in the plugin's bucket
+// by Store and Load, so the same values are used after a restart.
+type LabelLimiter struct {
+	name string
+	max  int
+	// The values used as is
+	admitted map[string]bool
+	// The number of times each value has been seen, including the ones in
+	// the bucket
+	counts map[string]int64
+}
+
+// NewLabelLimiter returns a LabelLimiter for the label called name, using at
+// most max values as is.
+func NewLabelLimiter(name string, max int) *LabelLimiter {
+	return &LabelLimiter{
+		name:     name,
+		max:      max,
+		admitted: make(map[string]bool),
+		counts:   make(map[string]int64),
+	}
+}
+
+// Name returns the name of the label.
+func (l *LabelLimiter) Name() string {
+	return l.name
+}
+
+// Value counts v, and returns the value to use for the label in its place.
+func (l *LabelLimiter) Value(v string) string {
+	l.counts[v]++
+	if len(l.counts) > labelCountsFactor*l.max {
+		l.forgetLeastCommon()
+	}
+	if l.admitted[v] {
+		return v
+	}
+	if len(l.admitted) < l.max {
+		l.admitted[v] = true
+		return v
+	}
+	return OtherLabelValue
+}
+
+// Returns the values sorted by how common they are, most common first.
+func (l *LabelLimiter) sortedValues() []string {
+	values := make([]string, 0, len(l.counts))
+	for v := range l.counts {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if l.counts[values[i]] != l.counts[values[j]] {
+			return l.counts[values[i]] > l.counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	return values
+}
+
+// Forgets the counts of the least common values, keeping half of the
+// maximum, and the ones which are admitted.
+func (l *LabelLimiter) forgetLeastCommon() {
+	for i, v := range l.sortedValues() {
+		if i >= labelCountsFactor*l.max/2 && !l.admitted[v] {
+			delete(l.counts, v)
+		}
+	}
+}
+
+// Rerank uses the max most common values as is from now on, and returns the
+// values which were used as is but no longer are, in order.  The series with
+// those values should be deleted.
+func (l *LabelLimiter) Rerank() []string {
+	admitted := make(map[string]bool)
+	for i, v := range l.sortedValues() {
+		if i >= l.max {
+			break
+		}
+		admitted[v] = true
+	}
+	var dropped []string
+	for v := range l.admitted {
+		if !admitted[v] {
+			dropped = append(dropped, v)
+		}
+	}
+	l.admitted = admitted
+	sort.Strings(dropped)
+	return dropped
+}
+
+// Load reads the counts from b, which was written to by Store, and uses the
+// most common values as is.
+func (l *LabelLimiter) Load(b *bolt.Bucket) error {
+	data := b.Get([]byte(l.name))
+	if data == nil {
+		return nil
+	}
+	err := json.Unmarshal(data, &l.counts)
+	if err != nil {
+		return fmt.Errorf("could not decode the counts of label %s: %s", l.name, err)
+	}
+	l.Rerank()
+	return nil
+}
+
+// Store writes the counts into b under the name of the label, as a JSON
+// object with the number of times each value has been seen.
+func (l *LabelLimiter) Store(b *bolt.Bucket) error {
+	data, err := json.Marshal(l.counts)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(l.name), data)
+}
@@ -0,0 +1,131 @@
+package plugin_interface
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestLabelLimiter(t *testing.T) {
+	testCases := []struct {
+		name string
+		max  int
+		// the values of the records, with "|" marking a re-ranking
+		values string
+		// the label value returned for each record
+		expected string
+		// the values dropped at each re-ranking
+		dropped []string
+	}{
+		{"under the maximum", 3, "a b c a", "a b c a", nil},
+		{"over the maximum", 2, "a b c a c", "a b other a other", nil},
+		{
+			name:     "a value becoming more common replaces another",
+			max:      2,
+			values:   "a b c c c | a b c",
+			expected: "a b other other other | a other c",
+			dropped:  []string{"b"},
+		},
+		{
+			name:     "ties are broken by the value",
+			max:      1,
+			values:   "b a | a b",
+			expected: "b other | a other",
+			dropped:  []string{"b"},
+		},
+		{
+			name:     "nothing changes",
+			max:      2,
+			values:   "a b c | a b c |",
+			expected: "a b other | a b other |",
+			dropped:  nil,
+		},
+	}
+	for _, tc := range testCases {
+		l := NewLabelLimiter("database", tc.max)
+		var got []string
+		var dropped []string
+		for _, v := range strings.Fields(tc.values) {
+			if v == "|" {
+				dropped = append(dropped, l.Rerank()...)
+				got = append(got, v)
+				continue
+			}
+			got = append(got, l.Value(v))
+		}
+		if strings.Join(got, " ") != tc.expected {
+			t.Errorf("%s: got %q; expected %q", tc.name, strings.Join(got, " "), tc.expected)
+		}
+		if strings.Join(dropped, " ") != strings.Join(tc.dropped, " ") {
+			t.Errorf("%s: dropped %q; expected %q", tc.name, dropped, tc.dropped)
+		}
+	}
+}
+
+func TestLabelLimiterForgetsLeastCommon(t *testing.T) {
+	l := NewLabelLimiter("user", 2)
+	l.Value("a")
+	l.Value("b")
+	// the counts of values seen only once are eventually forgotten, but
+	// the admitted ones are kept
+	for i := 0; i < 10*labelCountsFactor; i++ {
+		l.Value(strings.Repeat("x", i+1))
+	}
+	if len(l.counts) > labelCountsFactor*l.max {
+		t.Errorf("kept the counts of %d values; expected at most %d", len(l.counts), labelCountsFactor*l.max)
+	}
+	for _, v := range []string{"a", "b"} {
+		if _, ok := l.counts[v]; !ok {
+			t.Errorf("forgot the count of admitted value %q", v)
+		}
+	}
+}
+
+func TestLabelLimiterStoreAndLoad(t *testing.T) {
+	dbh, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbh.Close()
+
+	l := NewLabelLimiter("application", 2)
+	for _, v := range strings.Fields("a b c c c d d") {
+		l.Value(v)
+	}
+	err = dbh.Update(func(tx *bolt.Tx) error {
+		labels, err := tx.CreateBucket([]byte("labels"))
+		if err != nil {
+			return err
+		}
+		return l.Store(labels)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// after a restart the most common values are admitted, not the first
+	// ones seen
+	loaded := NewLabelLimiter("application", 2)
+	err = dbh.View(func(tx *bolt.Tx) error {
+		return loaded.Load(tx.Bucket([]byte("labels")))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		value    string
+		expected string
+	}{
+		{"c", "c"},
+		{"d", "d"},
+		{"a", OtherLabelValue},
+		{"e", OtherLabelValue},
+	} {
+		if got := loaded.Value(tc.value); got != tc.expected {
+			t.Errorf("Value(%q) after loading = %q; expected %q", tc.value, got, tc.expected)
+		}
+	}
+}
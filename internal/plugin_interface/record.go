@@ -0,0 +1,130 @@
+package plugin_interface
+
+import (
+	"fmt"
+	"time"
+)
+
+// Record holds the columns of a LogEntry parsed into their native types.
+// Integer columns which are empty because the value is not applicable (e.g.
+// QueryPos, or LeaderPid for processes which are not parallel workers) are
+// zero, as are the columns not present in the record's csvlog format.
+type Record struct {
+	LogTime              time.Time
+	UserName             string
+	DatabaseName         string
+	ProcessID            int
+	ConnectionFrom       string
+	SessionID            string
+	SessionLineNum       int64
+	CommandTag           string
+	SessionStartTime     time.Time
+	VirtualTransactionID string
+	TransactionID        int64
+	ErrorSeverity        string
+	SQLState             string
+	Message              string
+	Detail               string
+	Hint                 string
+	InternalQuery        string
+	InternalQueryPos     int
+	Context              string
+	Query                string
+	QueryPos             int
+	Location             string
+	ApplicationName      string
+	BackendType          string
+	LeaderPid            int
+	QueryID              int64
+}
+
+// DecodeError is returned by Decode when one or more columns could not be
+// parsed.
+type DecodeError struct {
+	// The errors, keyed by the name of the column in the Record struct
+	Errors map[string]error
+}
+
+func (e *DecodeError) Error() string {
+	msg := "could not decode log entry:"
+	for _, name := range recordColumnNames {
+		if err, ok := e.Errors[name]; ok {
+			msg += fmt.Sprintf(" %s: %s;", name, err)
+		}
+	}
+	return msg[:len(msg)-1]
+}
+
+// The order DecodeError lists its errors in
+var recordColumnNames = []string{"LogTime", "ProcessID", "SessionLineNum", "SessionStartTime", "TransactionID", "InternalQueryPos", "QueryPos", "LeaderPid", "QueryID"}
+
+// SetLogTimezone sets the location Decode interprets the time zone
+// abbreviations in timestamps in; see LogTime.  It should be the server's
+// log_timezone, as passed to plugins in PluginInitArgs.LogTimezone.  Defaults
+// to UTC.
+func (le *LogEntry) SetLogTimezone(loc *time.Location) {
+	le.logTimezone = loc
+}
+
+// Decode parses every column of the log entry into into.  Empty timestamps,
+// process IDs and line numbers are left as zero values.  If any column fails
+// to parse, a *DecodeError is returned, but all other columns are still
+// decoded.  Timestamps are interpreted using the time zone set with
+// SetLogTimezone.
+func (le *LogEntry) Decode(into *Record) error {
+	loc := le.logTimezone
+	errs := make(map[string]error)
+	check := func(name string, err error) {
+		if err != nil && err != ErrEmptyColumn && err != ErrNoSuchColumn {
+			errs[name] = err
+		}
+	}
+
+	var err error
+	*into = Record{
+		UserName:             le.UserName(),
+		DatabaseName:         le.DatabaseName(),
+		ConnectionFrom:       le.ConnectionFrom(),
+		SessionID:            le.SessionID(),
+		CommandTag:           le.CommandTag(),
+		VirtualTransactionID: le.VirtualTransactionID(),
+		ErrorSeverity:        le.ErrorSeverity(),
+		SQLState:             le.SQLState(),
+		Message:              le.Message(),
+		Detail:               le.Detail(),
+		Hint:                 le.Hint(),
+		InternalQuery:        le.InternalQuery(),
+		Context:              le.Context(),
+		Query:                le.Query(),
+		Location:             le.Location(),
+		ApplicationName:      le.ApplicationName(),
+	}
+	if le.LogTimeString() != "" {
+		into.LogTime, err = le.LogTime(loc)
+		check("LogTime", err)
+	}
+	into.ProcessID, err = le.ParseProcessID()
+	check("ProcessID", err)
+	into.SessionLineNum, err = le.ParseSessionLineNum()
+	check("SessionLineNum", err)
+	if le.SessionStartTimeString() != "" {
+		into.SessionStartTime, err = le.SessionStartTime(loc)
+		check("SessionStartTime", err)
+	}
+	into.TransactionID, err = le.ParseTransactionID()
+	check("TransactionID", err)
+	into.InternalQueryPos, err = le.ParseInternalQueryPos()
+	check("InternalQueryPos", err)
+	into.QueryPos, err = le.ParseQueryPos()
+	check("QueryPos", err)
+	into.BackendType, _ = le.BackendType()
+	into.LeaderPid, err = le.LeaderPid()
+	check("LeaderPid", err)
+	into.QueryID, err = le.QueryID()
+	check("QueryID", err)
+
+	if len(errs) > 0 {
+		return &DecodeError{Errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package plugin_interface
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogEntryDecode(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	le, err := NewLogEntry(LatestCSVLogSchema().NewRecord(map[int]string{
+		LogTimeAttno:          "2024-10-01 13:00:00.123 CEST",
+		UserNameAttno:         "app",
+		ProcessIDAttno:        "1234",
+		SessionLineNumAttno:   "3",
+		SessionStartTimeAttno: "2024-10-01 12:59:00 CEST",
+		TransactionIDAttno:    "745",
+		ErrorSeverityAttno:    "ERROR",
+		MessageAttno:          "division by zero",
+		QueryPosAttno:         "8",
+		QueryIDAttno:          "-123",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	le.SetLogTimezone(berlin)
+	var r Record
+	err = le.Decode(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.LogTime.Equal(time.Date(2024, 10, 1, 11, 0, 0, 123e6, time.UTC)) {
+		t.Errorf("unexpected LogTime %s", r.LogTime)
+	}
+	if !r.SessionStartTime.Equal(time.Date(2024, 10, 1, 10, 59, 0, 0, time.UTC)) {
+		t.Errorf("unexpected SessionStartTime %s", r.SessionStartTime)
+	}
+	if r.UserName != "app" || r.ProcessID != 1234 || r.SessionLineNum != 3 || r.TransactionID != 745 ||
+		r.ErrorSeverity != "ERROR" || r.Message != "division by zero" || r.QueryPos != 8 || r.QueryID != -123 ||
+		r.InternalQueryPos != 0 || r.LeaderPid != 0 {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+func TestLogEntryDecodeErrors(t *testing.T) {
+	le, err := NewLogEntry(LatestCSVLogSchema().NewRecord(map[int]string{
+		LogTimeAttno:   "2024-10-01 13:00:00.123 CEST",
+		ProcessIDAttno: "12x4",
+		QueryPosAttno:  "eight",
+		MessageAttno:   "message",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// CEST is not in use in UTC, the default
+	var r Record
+	err = le.Decode(&r)
+	decodeErr, ok := err.(*DecodeError)
+	if !ok {
+		t.Fatalf("expected a *DecodeError; got %v", err)
+	}
+	for _, name := range []string{"LogTime", "ProcessID", "QueryPos"} {
+		if decodeErr.Errors[name] == nil {
+			t.Errorf("expected an error for %s; got %v", name, decodeErr)
+		}
+	}
+	if len(decodeErr.Errors) != 3 {
+		t.Errorf("unexpected errors %v", decodeErr)
+	}
+	// the other columns are still decoded
+	if r.Message != "message" {
+		t.Errorf("unexpected Message %q", r.Message)
+	}
+}
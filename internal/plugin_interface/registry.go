@@ -0,0 +1,56 @@
+package plugin_interface
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// PluginInitFunc creates an instance of a plugin.
+type PluginInitFunc func(args PluginInitArgs) (Plugin, error)
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]PluginInitFunc)
+)
+
+// RegisterPlugin makes a plugin available under name, so that it can be
+// selected in pgfisher's configuration.  It's meant to be called from the init
+// function of the plugin's package, and panics if name is already in use.
+func RegisterPlugin(name string, initFunc PluginInitFunc) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if name == "" {
+		panic("plugin name must not be empty")
+	}
+	if initFunc == nil {
+		panic(fmt.Sprintf("nil init function for plugin %q", name))
+	}
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("plugin %q registered twice", name))
+	}
+	registry[name] = initFunc
+}
+
+// LookupPlugin returns the init function of the plugin registered under name.
+func LookupPlugin(name string) (PluginInitFunc, bool) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	initFunc, ok := registry[name]
+	return initFunc, ok
+}
+
+// RegisteredPlugins returns the names of all registered plugins, sorted.
+func RegisteredPlugins() []string {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,189 @@
+package plugin_interface
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrNoSuchColumn is returned by the accessors of LogEntry for columns which
+// are not present in the csvlog format of the server version which wrote the
+// record.
+var ErrNoSuchColumn = errors.New("column not present in this version's csvlog format")
+
+// ErrEmptyColumn is returned by the accessors of LogEntry for columns which
+// should always have a value, but don't.  Records from stderr log files only
+// have the values included in log_line_prefix.
+var ErrEmptyColumn = errors.New("column is empty")
+
+// CSVLogSchema describes the csvlog format of a range of server versions.
+type CSVLogSchema struct {
+	// The first server version using this format, in the format of the
+	// server_version_num setting, e.g. 90400 or 140000.
+	MinServerVersion int
+	NumColumns       int
+}
+
+// The csvlog formats of all supported server versions, oldest first.
+var csvLogSchemas = []CSVLogSchema{
+	{MinServerVersion: 90400, NumColumns: 1 + ApplicationNameAttno},
+	{MinServerVersion: 130000, NumColumns: 1 + BackendTypeAttno},
+	{MinServerVersion: 140000, NumColumns: 1 + QueryIDAttno},
+}
+
+// CSVLogSchemaForServerVersion returns the csvlog format of a server version
+// as returned by ParseServerVersion.
+func CSVLogSchemaForServerVersion(version int) (CSVLogSchema, error) {
+	if version < csvLogSchemas[0].MinServerVersion {
+		return CSVLogSchema{}, fmt.Errorf("server version %s is not supported", FormatServerVersion(version))
+	}
+	schema := csvLogSchemas[0]
+	for _, s := range csvLogSchemas {
+		if version >= s.MinServerVersion {
+			schema = s
+		}
+	}
+	return schema, nil
+}
+
+// CSVLogSchemaForColumnCount returns the csvlog format of records with
+// numColumns columns: the newest one whose records have no more columns than
+// that.  Newer server versions can add columns at the end, and those are
+// ignored until they're known.
+func CSVLogSchemaForColumnCount(numColumns int) (CSVLogSchema, error) {
+	if numColumns < csvLogSchemas[0].NumColumns {
+		return CSVLogSchema{}, fmt.Errorf("unexpected record length %d; expected at least %d", numColumns, csvLogSchemas[0].NumColumns)
+	}
+	schema := csvLogSchemas[0]
+	for _, s := range csvLogSchemas {
+		if numColumns >= s.NumColumns {
+			schema = s
+		}
+	}
+	return schema, nil
+}
+
+// HasColumn reports whether records in this format include the column attno.
+func (s CSVLogSchema) HasColumn(attno int) bool {
+	return attno < s.NumColumns
+}
+
+// NewRecord returns a record in this format with the columns in columns set,
+// and the rest empty, e.g. for testing plugins.  Columns not present in this
+// format are ignored.
+func (s CSVLogSchema) NewRecord(columns map[int]string) []string {
+	record := make([]string, s.NumColumns)
+	for attno, value := range columns {
+		if s.HasColumn(attno) {
+			record[attno] = value
+		}
+	}
+	return record
+}
+
+// LatestCSVLogSchema returns the csvlog format of the newest supported server
+// version.
+func LatestCSVLogSchema() CSVLogSchema {
+	return csvLogSchemas[len(csvLogSchemas)-1]
+}
+
+// ParseServerVersion parses a major server version such as "9.6" or "14",
+// returning it in the format of the server_version_num setting.
+func ParseServerVersion(version string) (int, error) {
+	parts := strings.Split(version, ".")
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 0 {
+		return 0, fmt.Errorf("invalid server version %q", version)
+	}
+	if major >= 10 {
+		if len(parts) > 2 {
+			return 0, fmt.Errorf("invalid server version %q", version)
+		}
+		return major * 10000, nil
+	}
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid server version %q", version)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil || minor < 0 || minor > 99 {
+		return 0, fmt.Errorf("invalid server version %q", version)
+	}
+	return major*10000 + minor*100, nil
+}
+
+// FormatServerVersion is the inverse of ParseServerVersion.
+func FormatServerVersion(version int) string {
+	if version >= 100000 {
+		return strconv.Itoa(version / 10000)
+	}
+	return fmt.Sprintf("%d.%d", version/10000, (version/100)%100)
+}
+
+// The names of the csvlog columns, as used in the documentation of the
+// server, indexed by attno.
+var columnNames = []string{
+	LogTimeAttno:              "log_time",
+	UserNameAttno:             "user_name",
+	DatabaseNameAttno:         "database_name",
+	ProcessIDAttno:            "process_id",
+	ConnectionFromAttno:       "connection_from",
+	SessionIDAttno:            "session_id",
+	SessionLineNumAttno:       "session_line_num",
+	CommandTagAttno:           "command_tag",
+	SessionStartTimeAttno:     "session_start_time",
+	VirtualTransactionIDAttno: "virtual_transaction_id",
+	TransactionIDAttno:        "transaction_id",
+	ErrorSeverityAttno:        "error_severity",
+	SQLStateAttno:             "sql_state_code",
+	MessageAttno:              "message",
+	DetailAttno:               "detail",
+	HintAttno:                 "hint",
+	InternalQueryAttno:        "internal_query",
+	InternalQueryPosAttno:     "internal_query_pos",
+	ContextAttno:              "context",
+	QueryAttno:                "query",
+	QueryPosAttno:             "query_pos",
+	LocationAttno:             "location",
+	ApplicationNameAttno:      "application_name",
+	BackendTypeAttno:          "backend_type",
+	LeaderPidAttno:            "leader_pid",
+	QueryIDAttno:              "query_id",
+}
+
+// ColumnName returns the name of the csvlog column attno, e.g. "user_name".
+func ColumnName(attno int) string {
+	if attno < 0 || attno >= len(columnNames) {
+		return ""
+	}
+	return columnNames[attno]
+}
+
+// ColumnAttno is the inverse of ColumnName.
+func ColumnAttno(name string) (int, bool) {
+	for attno, n := range columnNames {
+		if n == name {
+			return attno, true
+		}
+	}
+	return -1, false
+}
+
+// The severities in the order client_min_messages uses, least severe first.
+// This is also the order of the levels in the server's source code.  Unlike
+// log_min_messages, which ranks LOG between ERROR and FATAL, it ranks LOG below
+// everything but the debug levels.
+var severityLevels = []string{"DEBUG5", "DEBUG4", "DEBUG3", "DEBUG2", "DEBUG1", "LOG", "INFO", "NOTICE", "WARNING", "ERROR", "FATAL", "PANIC"}
+
+// SeverityLevel returns the position of severity (in upper case, as in the
+// error_severity column) in the order client_min_messages uses, so that the
+// levels of two severities can be compared.  Returns false for unknown
+// severities.
+func SeverityLevel(severity string) (int, bool) {
+	for level, s := range severityLevels {
+		if s == severity {
+			return level, true
+		}
+	}
+	return -1, false
+}
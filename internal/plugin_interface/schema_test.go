@@ -0,0 +1,108 @@
+package plugin_interface
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCSVLogSchemaForColumnCount(t *testing.T) {
+	testCases := []struct {
+		numColumns int
+		// 0 if an error is expected
+		expected int
+	}{
+		{0, 0},
+		{ApplicationNameAttno, 0},
+		{1 + ApplicationNameAttno, 90400},
+		{1 + BackendTypeAttno, 130000},
+		{1 + QueryIDAttno, 140000},
+		// a newer server version with columns not known yet
+		{2 + QueryIDAttno, 140000},
+		{10 + QueryIDAttno, 140000},
+	}
+	for _, tc := range testCases {
+		schema, err := CSVLogSchemaForColumnCount(tc.numColumns)
+		if tc.expected == 0 {
+			if err == nil {
+				t.Errorf("CSVLogSchemaForColumnCount(%d) = %+v; expected an error", tc.numColumns, schema)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("CSVLogSchemaForColumnCount(%d): %s", tc.numColumns, err)
+		} else if schema.MinServerVersion != tc.expected {
+			t.Errorf("CSVLogSchemaForColumnCount(%d) = %d; expected %d", tc.numColumns, schema.MinServerVersion, tc.expected)
+		}
+	}
+}
+
+func TestNewLogEntryColumnCounts(t *testing.T) {
+	testCases := []struct {
+		name    string
+		record  []string
+		version int
+		// the values returned by QueryID and BackendType, or "-" for
+		// ErrNoSuchColumn
+		queryID     string
+		backendType string
+	}{
+		{"9.4", make([]string, 1+ApplicationNameAttno), 90400, "-", "-"},
+		{"13", append(make([]string, BackendTypeAttno), "client backend"), 130000, "-", "client backend"},
+		{"14", append(make([]string, QueryIDAttno), "-42"), 140000, "-42", ""},
+		// as created by ParseJSONLogRecord
+		{"json", append(LatestCSVLogSchema().NewRecord(map[int]string{QueryIDAttno: "7"}), `{"x":"y"}`), 140000, "7", ""},
+		{"newer", append(append(make([]string, QueryIDAttno), "5"), "unknown", "columns"), 140000, "5", ""},
+	}
+	for _, tc := range testCases {
+		le, err := NewLogEntry(tc.record)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if le.Schema().MinServerVersion != tc.version {
+			t.Errorf("%s: got the format of %d; expected %d", tc.name, le.Schema().MinServerVersion, tc.version)
+		}
+		queryID, err := le.QueryID()
+		got := fmt.Sprint(queryID)
+		if err == ErrNoSuchColumn {
+			got = "-"
+		} else if err != nil {
+			got = err.Error()
+		}
+		if got != tc.queryID {
+			t.Errorf("%s: QueryID() returned %s; expected %s", tc.name, got, tc.queryID)
+		}
+		got, err = le.BackendType()
+		if err == ErrNoSuchColumn {
+			got = "-"
+		} else if err != nil {
+			got = err.Error()
+		}
+		if got != tc.backendType {
+			t.Errorf("%s: BackendType() returned %q; expected %q", tc.name, got, tc.backendType)
+		}
+	}
+
+	_, err := NewLogEntry(make([]string, ApplicationNameAttno))
+	if err == nil {
+		t.Errorf("NewLogEntry accepted a record without application_name")
+	}
+}
+
+func TestCSVLogSchemaNewRecord(t *testing.T) {
+	schema, err := CSVLogSchemaForServerVersion(90600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := schema.NewRecord(map[int]string{
+		UserNameAttno: "app",
+		// not present in the format of 9.6
+		QueryIDAttno: "1",
+	})
+	if len(record) != 1+ApplicationNameAttno || record[UserNameAttno] != "app" {
+		t.Errorf("got %q", record)
+	}
+	if latest := LatestCSVLogSchema().NewRecord(nil); len(latest) != 1+QueryIDAttno {
+		t.Errorf("got %d columns in the latest format; expected %d", len(latest), 1+QueryIDAttno)
+	}
+}
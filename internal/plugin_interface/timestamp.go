@@ -0,0 +1,62 @@
+package plugin_interface
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var numericZoneRe = regexp.MustCompile(`^([+-])([0-9]{2}):?([0-9]{2})?:?([0-9]{2})?$`)
+
+// ParseLogTimestamp parses a timestamp in the format the server writes them
+// into log files, e.g. "2024-03-31 02:30:00.123 CEST".  The milliseconds are
+// optional.  The time zone is either a numeric UTC offset such as "+03" or
+// "-03:30", or an abbreviation, which is resolved against loc.  loc should
+// therefore be the server's log_timezone; this also picks the correct
+// instant for the wall clock times which occur twice when daylight saving
+// time ends.  The returned time is in loc.  A nil loc is treated as UTC.
+func ParseLogTimestamp(value string, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	sep := strings.LastIndexByte(value, ' ')
+	if sep == -1 {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q: missing time zone", value)
+	}
+	zone := value[sep+1:]
+	// Fractional seconds are accepted even though the layout doesn't have
+	// them.
+	wall, err := time.Parse("2006-01-02 15:04:05", value[:sep])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q: %s", value, err)
+	}
+
+	if m := numericZoneRe.FindStringSubmatch(zone); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		seconds, _ := strconv.Atoi(m[4])
+		offset := hours*3600 + minutes*60 + seconds
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return wall.Add(-time.Duration(offset) * time.Second).In(loc), nil
+	}
+
+	// Find an instant at which loc is called zone and the wall clock shows
+	// the time we parsed.  Around a transition the wall clock time can map
+	// to the offset in effect before or after it, so try both.
+	for _, probe := range []time.Duration{0, -12 * time.Hour, 12 * time.Hour} {
+		_, offset := wall.Add(probe).In(loc).Zone()
+		t := wall.Add(-time.Duration(offset) * time.Second).In(loc)
+		name, actualOffset := t.Zone()
+		if name == zone && actualOffset == offset {
+			return t, nil
+		}
+	}
+	if zone == "UTC" || zone == "GMT" {
+		return wall.In(loc), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q: time zone %q is not in use in %s at that time", value, zone, loc)
+}
@@ -0,0 +1,99 @@
+package plugin_interface
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLogTimestamp(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(year int, month time.Month, day, hour, min, sec, msec int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, msec*1e6, time.UTC)
+	}
+
+	testCases := []struct {
+		name  string
+		value string
+		loc   *time.Location
+		// the zero time if an error is expected
+		expected time.Time
+	}{
+		{"milliseconds", "2024-10-01 13:00:00.123 CEST", berlin, utc(2024, 10, 1, 11, 0, 0, 123)},
+		{"no milliseconds", "2024-10-01 13:00:00 CEST", berlin, utc(2024, 10, 1, 11, 0, 0, 0)},
+		{"winter", "2024-01-15 13:00:00.000 CET", berlin, utc(2024, 1, 15, 12, 0, 0, 0)},
+		{"summer abbreviation in winter", "2024-01-15 13:00:00.000 CEST", berlin, time.Time{}},
+		{"new york summer", "2024-07-04 12:00:00.000 EDT", newYork, utc(2024, 7, 4, 16, 0, 0, 0)},
+		{"new york winter", "2024-01-15 12:00:00.000 EST", newYork, utc(2024, 1, 15, 17, 0, 0, 0)},
+
+		// Berlin falls back from 03:00 CEST to 02:00 CET on 2024-10-27, so
+		// 02:00-02:59 happens twice.
+		{"berlin fall back, first 02:30", "2024-10-27 02:30:00.000 CEST", berlin, utc(2024, 10, 27, 0, 30, 0, 0)},
+		{"berlin fall back, second 02:30", "2024-10-27 02:30:00.000 CET", berlin, utc(2024, 10, 27, 1, 30, 0, 0)},
+		{"berlin fall back, last CEST millisecond", "2024-10-27 02:59:59.999 CEST", berlin, utc(2024, 10, 27, 0, 59, 59, 999)},
+		{"berlin fall back, first CET instant", "2024-10-27 02:00:00.000 CET", berlin, utc(2024, 10, 27, 1, 0, 0, 0)},
+		// Berlin springs forward from 02:00 CET to 03:00 CEST on 2024-03-31, so
+		// 02:00-02:59 never happens.
+		{"berlin spring forward, before", "2024-03-31 01:59:59.999 CET", berlin, utc(2024, 3, 31, 0, 59, 59, 999)},
+		{"berlin spring forward, after", "2024-03-31 03:00:00.000 CEST", berlin, utc(2024, 3, 31, 1, 0, 0, 0)},
+		{"berlin spring forward, missing hour in CET", "2024-03-31 02:30:00.000 CET", berlin, time.Time{}},
+		{"berlin spring forward, missing hour in CEST", "2024-03-31 02:30:00.000 CEST", berlin, time.Time{}},
+
+		// New York falls back from 02:00 EDT to 01:00 EST on 2024-11-03.
+		{"new york fall back, first 01:30", "2024-11-03 01:30:00.000 EDT", newYork, utc(2024, 11, 3, 5, 30, 0, 0)},
+		{"new york fall back, second 01:30", "2024-11-03 01:30:00.000 EST", newYork, utc(2024, 11, 3, 6, 30, 0, 0)},
+		// New York springs forward from 02:00 EST to 03:00 EDT on 2024-03-10.
+		{"new york spring forward, before", "2024-03-10 01:59:59.999 EST", newYork, utc(2024, 3, 10, 6, 59, 59, 999)},
+		{"new york spring forward, after", "2024-03-10 03:00:00.000 EDT", newYork, utc(2024, 3, 10, 7, 0, 0, 0)},
+		{"new york spring forward, missing hour", "2024-03-10 02:30:00.000 EST", newYork, time.Time{}},
+
+		// Numeric offsets don't depend on loc, even during the missing hour.
+		{"numeric hours", "2024-10-01 13:00:00.000 +03", berlin, utc(2024, 10, 1, 10, 0, 0, 0)},
+		{"numeric negative", "2024-10-01 13:00:00.000 -03:30", berlin, utc(2024, 10, 1, 16, 30, 0, 0)},
+		{"numeric without colon", "2024-10-01 13:00:00.000 +0530", berlin, utc(2024, 10, 1, 7, 30, 0, 0)},
+		{"numeric seconds", "2024-10-01 13:00:00.000 +00:19:32", berlin, utc(2024, 10, 1, 12, 40, 28, 0)},
+		{"numeric in missing hour", "2024-03-31 02:30:00.000 +01", berlin, utc(2024, 3, 31, 1, 30, 0, 0)},
+		{"numeric ambiguous", "2024-10-27 02:30:00.000 +02", berlin, utc(2024, 10, 27, 0, 30, 0, 0)},
+		{"numeric nil location", "2024-10-01 13:00:00.000 +03", nil, utc(2024, 10, 1, 10, 0, 0, 0)},
+
+		{"utc", "2024-10-01 13:00:00.000 UTC", berlin, utc(2024, 10, 1, 13, 0, 0, 0)},
+		{"gmt", "2024-10-01 13:00:00.000 GMT", newYork, utc(2024, 10, 1, 13, 0, 0, 0)},
+		{"nil location", "2024-10-01 13:00:00.000 UTC", nil, utc(2024, 10, 1, 13, 0, 0, 0)},
+
+		{"unknown abbreviation", "2024-10-01 13:00:00.000 XYZ", berlin, time.Time{}},
+		{"abbreviation of another zone", "2024-10-01 13:00:00.000 EDT", berlin, time.Time{}},
+		{"abbreviation with nil location", "2024-10-01 13:00:00.000 CEST", nil, time.Time{}},
+		{"missing zone", "2024-10-01T13:00:00.000", berlin, time.Time{}},
+		{"invalid date", "2024-13-01 13:00:00.000 CEST", berlin, time.Time{}},
+		{"empty", "", berlin, time.Time{}},
+	}
+	for _, tc := range testCases {
+		got, err := ParseLogTimestamp(tc.value, tc.loc)
+		if tc.expected.IsZero() {
+			if err == nil {
+				t.Errorf("%s: ParseLogTimestamp(%q) = %s; expected an error", tc.name, tc.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParseLogTimestamp(%q): %s", tc.name, tc.value, err)
+			continue
+		}
+		if !got.Equal(tc.expected) {
+			t.Errorf("%s: ParseLogTimestamp(%q) = %s; expected %s", tc.name, tc.value, got.UTC(), tc.expected)
+		}
+		expectedLoc := tc.loc
+		if expectedLoc == nil {
+			expectedLoc = time.UTC
+		}
+		if got.Location() != expectedLoc {
+			t.Errorf("%s: ParseLogTimestamp(%q) returned a time in %s; expected %s", tc.name, tc.value, got.Location(), expectedLoc)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+// Package autovacuum implements a plugin which parses the messages logged at
+// the end of autovacuum and autoanalyze runs because of
+// log_autovacuum_min_duration, in the formats used by PostgreSQL 9.4 to 17.
+// The details of every run are exported as metrics labelled by database,
+// schema, table and operation ("vacuum" or "analyze"), e.g. the time and the
+// duration of the last run of each table as
+// pgfisher_autovacuum_last_run_timestamp_seconds and
+// pgfisher_autovacuum_last_elapsed_seconds.  Only the runs of the first
+// max_tables tables seen get series of their own; the rest are counted with
+// all three labels set to "other".
+//
+// The runs are also kept in the plugin's bucket, which contains a bucket
+// called "tables", which contains a bucket for every table, named like the
+// server logs it, e.g. "postgres.public.t".  In it, the key is the log_time of
+// the run in UTC, e.g. "2024-10-01T13:00:00.000000Z", followed by a space and
+// the operation, and the value is a Run in JSON.  ReadHistory reads them.  On
+// startup, the last run gauges are set from the bucket.
+//
+// If pgfisher serves metrics over HTTP, the runs of a table are also served
+// in JSON, newest first, at /plugins/NAME/history?table=TABLE, where NAME is
+// the name of the plugin.  The query parameter limit (default 20) limits the
+// number of runs returned.
+//
+// Settings:
+//
+//	history_length   how many runs to keep per table (default 100)
+//	max_tables       how many tables to export metrics for (default 1000)
+package autovacuum
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const pluginName = "autovacuum"
+
+const (
+	defaultHistoryLength = 100
+	defaultMaxTables     = 1000
+
+	// How many runs ServeHTTP returns if the request doesn't say
+	defaultHTTPLimit = 20
+
+	// The value of the labels of the tables beyond max_tables
+	otherLabelValue = "other"
+	// The format of the log_time in the keys.  Fixed width, so the keys
+	// sort in time order.
+	runKeyTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var tablesBucket = []byte("tables")
+
+func init() {
+	shared.RegisterPlugin(pluginName, newAutovacuumPlugin)
+}
+
+// The key of a run in the bucket of its table.
+func (r *Run) key() []byte {
+	return []byte(r.LogTime.UTC().Format(runKeyTimeFormat) + " " + r.Operation)
+}
+
+type autovacuumPlugin struct {
+	dbh           *bolt.DB
+	bucket        []byte
+	logTimezone   *time.Location
+	historyLength int
+	maxTables     int
+
+	// The tables which have series of their own
+	tables map[string]bool
+
+	runsTotal              *prometheus.CounterVec
+	elapsedSecondsTotal    *prometheus.CounterVec
+	cpuSecondsTotal        *prometheus.CounterVec
+	lastRunTimestamp       *prometheus.GaugeVec
+	lastElapsedSeconds     *prometheus.GaugeVec
+	pagesRemovedTotal      *prometheus.CounterVec
+	tuplesRemovedTotal     *prometheus.CounterVec
+	deadTuplesNotRemovable *prometheus.GaugeVec
+	buffersTotal           *prometheus.CounterVec
+	walBytesTotal          *prometheus.CounterVec
+	ioTimeSecondsTotal     *prometheus.CounterVec
+
+	// Protects pending, which is also read by the HTTP handler.
+	lock sync.Mutex
+	// The runs seen since the last checkpoint by table, oldest first.
+	// Added to the buckets of the tables in Checkpoint.
+	pending map[string][]*Run
+}
+
+func newAutovacuumPlugin(args shared.PluginInitArgs) (shared.Plugin, error) {
+	err := shared.CheckConfigKeys(args.Config, "history_length", "max_tables")
+	if err != nil {
+		return nil, err
+	}
+	historyLength, err := shared.ConfigInt(args.Config, "history_length", defaultHistoryLength)
+	if err != nil {
+		return nil, err
+	}
+	if historyLength <= 0 {
+		return nil, fmt.Errorf("invalid history_length %d; must be positive", historyLength)
+	}
+	maxTables, err := shared.ConfigInt(args.Config, "max_tables", defaultMaxTables)
+	if err != nil {
+		return nil, err
+	}
+	if maxTables <= 0 {
+		return nil, fmt.Errorf("invalid max_tables %d; must be positive", maxTables)
+	}
+
+	p := &autovacuumPlugin{
+		dbh:           args.DBH,
+		bucket:        args.Bucket,
+		logTimezone:   args.LogTimezone,
+		historyLength: int(historyLength),
+		maxTables:     int(maxTables),
+		tables:        make(map[string]bool),
+		pending:       make(map[string][]*Run),
+	}
+	err = p.registerMetrics(args)
+	if err != nil {
+		return nil, err
+	}
+	err = args.DBH.View(p.loadLastRuns)
+	if err != nil {
+		return nil, err
+	}
+	if args.HTTPMux != nil {
+		args.HTTPMux.Handle("/plugins/"+args.Name+"/history", p)
+	}
+	return p, nil
+}
+
+func (p *autovacuumPlugin) registerMetrics(args shared.PluginInitArgs) error {
+	constLabels := prometheus.Labels{"plugin": args.Name}
+	labels := []string{"database", "schema", "table", "operation"}
+	vacuumLabels := []string{"database", "schema", "table"}
+	newCounter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        name,
+				Help:        help,
+				ConstLabels: constLabels,
+			},
+			labels,
+		)
+	}
+	newGauge := func(name, help string, labels ...string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name:        name,
+				Help:        help,
+				ConstLabels: constLabels,
+			},
+			labels,
+		)
+	}
+
+	p.runsTotal = newCounter(
+		"pgfisher_autovacuum_runs_total",
+		"The number of autovacuum and autoanalyze runs logged.",
+		labels...)
+	p.elapsedSecondsTotal = newCounter(
+		"pgfisher_autovacuum_elapsed_seconds_total",
+		"The total duration of the autovacuum and autoanalyze runs logged.",
+		labels...)
+	p.cpuSecondsTotal = newCounter(
+		"pgfisher_autovacuum_cpu_seconds_total",
+		"The CPU time used by the autovacuum and autoanalyze runs logged.",
+		append(labels, "mode")...)
+	p.lastRunTimestamp = newGauge(
+		"pgfisher_autovacuum_last_run_timestamp_seconds",
+		"The log_time of the last autovacuum or autoanalyze run logged.",
+		labels...)
+	p.lastElapsedSeconds = newGauge(
+		"pgfisher_autovacuum_last_elapsed_seconds",
+		"The duration of the last autovacuum or autoanalyze run logged.",
+		labels...)
+	p.pagesRemovedTotal = newCounter(
+		"pgfisher_autovacuum_pages_removed_total",
+		"The number of pages truncated by the autovacuum runs logged.",
+		vacuumLabels...)
+	p.tuplesRemovedTotal = newCounter(
+		"pgfisher_autovacuum_tuples_removed_total",
+		"The number of dead tuples removed by the autovacuum runs logged.",
+		vacuumLabels...)
+	p.deadTuplesNotRemovable = newGauge(
+		"pgfisher_autovacuum_dead_tuples_not_removable",
+		"The number of dead tuples the last autovacuum run logged could not remove yet.",
+		vacuumLabels...)
+	p.buffersTotal = newCounter(
+		"pgfisher_autovacuum_buffers_total",
+		"The number of buffers hit, missed and dirtied by the autovacuum and autoanalyze runs logged.",
+		append(labels, "access")...)
+	p.walBytesTotal = newCounter(
+		"pgfisher_autovacuum_wal_bytes_total",
+		"The amount of WAL generated by the autovacuum and autoanalyze runs logged.",
+		labels...)
+	p.ioTimeSecondsTotal = newCounter(
+		"pgfisher_autovacuum_io_time_seconds_total",
+		"The time spent reading and writing data files by the autovacuum and autoanalyze runs logged.",
+		append(labels, "direction")...)
+
+	for _, c := range []prometheus.Collector{
+		p.runsTotal,
+		p.elapsedSecondsTotal,
+		p.cpuSecondsTotal,
+		p.lastRunTimestamp,
+		p.lastElapsedSeconds,
+		p.pagesRemovedTotal,
+		p.tuplesRemovedTotal,
+		p.deadTuplesNotRemovable,
+		p.buffersTotal,
+		p.walBytesTotal,
+		p.ioTimeSecondsTotal,
+	} {
+		err := args.PrometheusRegistry.Register(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the values of the database, schema and table labels for run.
+func (p *autovacuumPlugin) tableLabels(run *Run) []string {
+	name := run.FullTableName()
+	if !p.tables[name] {
+		if len(p.tables) >= p.maxTables {
+			return []string{otherLabelValue, otherLabelValue, otherLabelValue}
+		}
+		p.tables[name] = true
+	}
+	return []string{run.Database, run.Schema, run.Table}
+}
+
+// Sets the last run gauges of run.
+func (p *autovacuumPlugin) setLastRun(tableLabels []string, run *Run) {
+	labels := append(tableLabels, run.Operation)
+	p.lastRunTimestamp.WithLabelValues(labels...).Set(float64(run.LogTime.UnixNano()) / float64(time.Second))
+	p.lastElapsedSeconds.WithLabelValues(labels...).Set(run.ElapsedSeconds)
+	if run.Operation == OperationVacuum {
+		p.deadTuplesNotRemovable.WithLabelValues(tableLabels...).Set(float64(run.TuplesDeadNotRemovable))
+	}
+}
+
+// Sets the last run gauges from the runs in the bucket.
+func (p *autovacuumPlugin) loadLastRuns(tx *bolt.Tx) error {
+	tables := tx.Bucket(p.bucket).Bucket(tablesBucket)
+	if tables == nil {
+		return nil
+	}
+	return tables.ForEach(func(k, v []byte) error {
+		last := make(map[string]*Run)
+		c := tables.Bucket(k).Cursor()
+		for k, v := c.Last(); k != nil && len(last) < 2; k, v = c.Prev() {
+			var run Run
+			err := json.Unmarshal(v, &run)
+			if err != nil {
+				return fmt.Errorf("could not decode run %q: %s", k, err)
+			}
+			if last[run.Operation] == nil {
+				last[run.Operation] = &run
+			}
+		}
+		for _, run := range last {
+			p.setLastRun(p.tableLabels(run), run)
+		}
+		return nil
+	})
+}
+
+func (p *autovacuumPlugin) Process(streamPos *shared.LogStreamPosition, record []string) error {
+	le, err := shared.NewLogEntry(record)
+	if err != nil {
+		return err
+	}
+	if le.ErrorSeverity() != "LOG" {
+		return nil
+	}
+	run, ok := ParseMessage(le.Message())
+	if !ok {
+		return nil
+	}
+	run.LogTime, err = le.LogTime(p.logTimezone)
+	if err != nil {
+		return err
+	}
+
+	tableLabels := p.tableLabels(run)
+	labels := append(tableLabels, run.Operation)
+	p.runsTotal.WithLabelValues(labels...).Inc()
+	p.elapsedSecondsTotal.WithLabelValues(labels...).Add(run.ElapsedSeconds)
+	p.cpuSecondsTotal.WithLabelValues(append(labels, "user")...).Add(run.CPUUserSeconds)
+	p.cpuSecondsTotal.WithLabelValues(append(labels, "system")...).Add(run.CPUSystemSeconds)
+	p.buffersTotal.WithLabelValues(append(labels, "hit")...).Add(float64(run.BufferHits))
+	p.buffersTotal.WithLabelValues(append(labels, "miss")...).Add(float64(run.BufferMisses))
+	p.buffersTotal.WithLabelValues(append(labels, "dirtied")...).Add(float64(run.BufferDirtied))
+	p.walBytesTotal.WithLabelValues(labels...).Add(float64(run.WALBytes))
+	p.ioTimeSecondsTotal.WithLabelValues(append(labels, "read")...).Add(run.IOReadMS / 1000)
+	p.ioTimeSecondsTotal.WithLabelValues(append(labels, "write")...).Add(run.IOWriteMS / 1000)
+	if run.Operation == OperationVacuum {
+		p.pagesRemovedTotal.WithLabelValues(tableLabels...).Add(float64(run.PagesRemoved))
+		p.tuplesRemovedTotal.WithLabelValues(tableLabels...).Add(float64(run.TuplesRemoved))
+	}
+	p.setLastRun(tableLabels, run)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	name := run.FullTableName()
+	p.pending[name] = append(p.pending[name], run)
+	return nil
+}
+
+func (p *autovacuumPlugin) Checkpoint(tx *bolt.Tx, streamPos *shared.LogStreamPosition) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	tables, err := tx.Bucket(p.bucket).CreateBucketIfNotExists(tablesBucket)
+	if err != nil {
+		return err
+	}
+	for name, runs := range p.pending {
+		table, err := tables.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		for _, run := range runs {
+			data, err := json.Marshal(run)
+			if err != nil {
+				return err
+			}
+			err = table.Put(run.key(), data)
+			if err != nil {
+				return err
+			}
+		}
+
+		keys := shared.BucketKeysBefore(table, nil)
+		var expired [][]byte
+		if len(keys) > p.historyLength {
+			expired = keys[:len(keys)-p.historyLength]
+		}
+		for _, k := range expired {
+			err = table.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	p.pending = make(map[string][]*Run)
+	return nil
+}
+
+// ReadHistory returns the runs of table, named like the server logs it, in the
+// plugin's bucket, called bucketName, newest first.  At most limit runs are
+// returned, unless limit is zero.
+func ReadHistory(tx *bolt.Tx, bucketName []byte, table string, limit int) ([]*Run, error) {
+	bucket := tx.Bucket(bucketName)
+	if bucket == nil {
+		return nil, fmt.Errorf("bucket %q does not exist", bucketName)
+	}
+	runs := []*Run{}
+	tables := bucket.Bucket(tablesBucket)
+	if tables == nil {
+		return runs, nil
+	}
+	runsBucket := tables.Bucket([]byte(table))
+	if runsBucket == nil {
+		return runs, nil
+	}
+	c := runsBucket.Cursor()
+	for k, v := c.Last(); k != nil && (limit == 0 || len(runs) < limit); k, v = c.Prev() {
+		var run Run
+		err := json.Unmarshal(v, &run)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode run %q of table %s: %s", k, table, err)
+		}
+		runs = append(runs, &run)
+	}
+	return runs, nil
+}
+
+// ServeHTTP serves the runs of a table, including the ones processed since
+// the last checkpoint.
+func (p *autovacuumPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	table := query.Get("table")
+	if table == "" {
+		http.Error(w, "table is required", http.StatusBadRequest)
+		return
+	}
+	limit := defaultHTTPLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", value), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	// Keeps Checkpoint from writing the pending runs between reading the
+	// history and the pending runs, which would return them twice or not at
+	// all.
+	p.lock.Lock()
+	var runs []*Run
+	err := p.dbh.View(func(tx *bolt.Tx) error {
+		var err error
+		runs, err = ReadHistory(tx, p.bucket, table, limit)
+		return err
+	})
+	if err == nil {
+		pending := p.pending[table]
+		newest := make([]*Run, 0, len(pending)+len(runs))
+		for i := len(pending) - 1; i >= 0; i-- {
+			newest = append(newest, pending[i])
+		}
+		runs = append(newest, runs...)
+		if len(runs) > limit {
+			runs = runs[:limit]
+		}
+	}
+	p.lock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
@@ -0,0 +1,288 @@
+package autovacuum
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var testBucket = []byte("plugin:autovacuum")
+
+var testTime = time.Date(2024, 10, 1, 13, 0, 0, 0, time.UTC)
+
+func openTestDB(t *testing.T) *bolt.DB {
+	t.Helper()
+	dbh, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbh.Close() })
+	err = dbh.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket(testBucket)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbh
+}
+
+func newTestPlugin(t *testing.T, dbh *bolt.DB, config map[string]interface{}) (*autovacuumPlugin, *prometheus.Registry) {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	p, err := newAutovacuumPlugin(shared.PluginInitArgs{
+		Name:               pluginName,
+		DBH:                dbh,
+		PrometheusRegistry: registry,
+		Config:             config,
+		Bucket:             testBucket,
+		LogTimezone:        time.UTC,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*autovacuumPlugin), registry
+}
+
+func checkpoint(t *testing.T, dbh *bolt.DB, p *autovacuumPlugin) {
+	t.Helper()
+	err := dbh.Update(func(tx *bolt.Tx) error {
+		return p.Checkpoint(tx, &shared.LogStreamPosition{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Processes a run of operation on the table postgres.public.TABLE, logged
+// minutes after testTime and taking elapsed seconds.
+func processRun(t *testing.T, p *autovacuumPlugin, table string, operation string, minutes int, elapsed float64) {
+	t.Helper()
+	var message string
+	if operation == OperationVacuum {
+		message = fmt.Sprintf(`automatic vacuum of table "postgres.public.%s": index scans: 0
+pages: 0 removed, 10 remain, 0 skipped due to pins, 0 skipped frozen
+tuples: 5 removed, 400 remain, 3 are dead but not yet removable, oldest xmin: 571
+buffer usage: 40 hits, 0 misses, 4 dirtied
+avg read rate: 0.000 MB/s, avg write rate: 1.500 MB/s
+system usage: CPU: user: 0.00 s, system: 0.00 s, elapsed: %.2f s`, table, elapsed)
+	} else {
+		message = fmt.Sprintf(`automatic analyze of table "postgres.public.%s" system usage: CPU: user: 0.01 s, system: 0.00 s, elapsed: %.2f s`, table, elapsed)
+	}
+	logTime := testTime.Add(time.Duration(minutes) * time.Minute)
+	record := shared.LatestCSVLogSchema().NewRecord(map[int]string{
+		shared.LogTimeAttno:       logTime.Format("2006-01-02 15:04:05 MST"),
+		shared.ErrorSeverityAttno: "LOG",
+		shared.MessageAttno:       message,
+	})
+	err := p.Process(&shared.LogStreamPosition{}, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns the minutes after testTime of runs.
+func runMinutes(runs []*Run) []int {
+	minutes := []int{}
+	for _, run := range runs {
+		minutes = append(minutes, int(run.LogTime.Sub(testTime)/time.Minute))
+	}
+	return minutes
+}
+
+func readTestHistory(t *testing.T, dbh *bolt.DB, table string) []*Run {
+	t.Helper()
+	var runs []*Run
+	err := dbh.View(func(tx *bolt.Tx) error {
+		var err error
+		runs, err = ReadHistory(tx, testBucket, table, 0)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runs
+}
+
+// Returns the values of the gauge called name by the table and operation
+// labels, e.g. "t/vacuum".
+func gaugeValues(t *testing.T, registry *prometheus.Registry, name string) map[string]float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			values[labels["table"]+"/"+labels["operation"]] = m.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCheckpoint(t *testing.T) {
+	dbh := openTestDB(t)
+	p, _ := newTestPlugin(t, dbh, map[string]interface{}{"history_length": int64(3)})
+
+	for i := 0; i < 5; i++ {
+		processRun(t, p, "t", OperationVacuum, i, 0.5)
+	}
+	processRun(t, p, "u", OperationAnalyze, 10, 2)
+	if got := readTestHistory(t, dbh, "postgres.public.t"); len(got) != 0 {
+		t.Errorf("got %d runs before the checkpoint; expected none", len(got))
+	}
+
+	checkpoint(t, dbh, p)
+	// Only the newest history_length runs are kept, newest first.
+	if got := runMinutes(readTestHistory(t, dbh, "postgres.public.t")); !equalInts(got, []int{4, 3, 2}) {
+		t.Errorf("got runs %v of t; expected %v", got, []int{4, 3, 2})
+	}
+	if got := runMinutes(readTestHistory(t, dbh, "postgres.public.u")); !equalInts(got, []int{10}) {
+		t.Errorf("got runs %v of u; expected %v", got, []int{10})
+	}
+
+	// The analyze runs share the history of the table with the vacuum runs.
+	processRun(t, p, "t", OperationAnalyze, 5, 1)
+	processRun(t, p, "t", OperationVacuum, 6, 1.25)
+	checkpoint(t, dbh, p)
+	history := readTestHistory(t, dbh, "postgres.public.t")
+	if got := runMinutes(history); !equalInts(got, []int{6, 5, 4}) {
+		t.Errorf("got runs %v of t after the second checkpoint; expected %v", got, []int{6, 5, 4})
+	}
+	if len(history) > 0 && (history[0].Operation != OperationVacuum || history[0].ElapsedSeconds != 1.25 || history[0].TuplesDeadNotRemovable != 3) {
+		t.Errorf("got newest run %+v of t; expected the vacuum taking 1.25 s", history[0])
+	}
+	if got := readTestHistory(t, dbh, "postgres.public.v"); len(got) != 0 {
+		t.Errorf("got %d runs of a table without any", len(got))
+	}
+
+	// The last run gauges are set from the bucket when starting again.
+	_, registry := newTestPlugin(t, dbh, map[string]interface{}{"history_length": int64(3)})
+	expectedTimestamps := map[string]float64{
+		"t/vacuum":  float64(testTime.Add(6 * time.Minute).Unix()),
+		"t/analyze": float64(testTime.Add(5 * time.Minute).Unix()),
+		"u/analyze": float64(testTime.Add(10 * time.Minute).Unix()),
+	}
+	timestamps := gaugeValues(t, registry, "pgfisher_autovacuum_last_run_timestamp_seconds")
+	if len(timestamps) != len(expectedTimestamps) {
+		t.Errorf("got last run timestamps %v; expected %v", timestamps, expectedTimestamps)
+	}
+	for k, expected := range expectedTimestamps {
+		if timestamps[k] != expected {
+			t.Errorf("got last run timestamp %f of %s; expected %f", timestamps[k], k, expected)
+		}
+	}
+	elapsed := gaugeValues(t, registry, "pgfisher_autovacuum_last_elapsed_seconds")
+	if elapsed["t/vacuum"] != 1.25 || elapsed["t/analyze"] != 1 || elapsed["u/analyze"] != 2 {
+		t.Errorf("got last elapsed seconds %v", elapsed)
+	}
+	dead := gaugeValues(t, registry, "pgfisher_autovacuum_dead_tuples_not_removable")
+	if dead["t/"] != 3 || len(dead) != 1 {
+		t.Errorf("got dead tuples not removable %v; expected 3 for t", dead)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	dbh := openTestDB(t)
+	p, _ := newTestPlugin(t, dbh, nil)
+	for i := 0; i < 25; i++ {
+		processRun(t, p, "t", OperationVacuum, i, 0.5)
+	}
+	checkpoint(t, dbh, p)
+	// still pending; served along with the ones in the bucket
+	processRun(t, p, "t", OperationAnalyze, 25, 1)
+	processRun(t, p, "t", OperationVacuum, 26, 0.5)
+
+	testCases := []struct {
+		query          string
+		expectedStatus int
+		// the minutes after testTime of the runs expected, newest first
+		expected []int
+	}{
+		{"table=postgres.public.t&limit=4", http.StatusOK, []int{26, 25, 24, 23}},
+		{"table=postgres.public.t&limit=1", http.StatusOK, []int{26}},
+		{"table=postgres.public.t&limit=1000", http.StatusOK, []int{26, 25, 24, 23, 22, 21, 20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}},
+		{"table=postgres.public.t", http.StatusOK, []int{26, 25, 24, 23, 22, 21, 20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7}},
+		{"table=postgres.public.u", http.StatusOK, []int{}},
+		{"", http.StatusBadRequest, nil},
+		{"table=postgres.public.t&limit=0", http.StatusBadRequest, nil},
+		{"table=postgres.public.t&limit=-1", http.StatusBadRequest, nil},
+		{"table=postgres.public.t&limit=many", http.StatusBadRequest, nil},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/plugins/autovacuum/history?"+tc.query, nil))
+		if w.Code != tc.expectedStatus {
+			t.Errorf("%q: got status %d; expected %d", tc.query, w.Code, tc.expectedStatus)
+			continue
+		}
+		if tc.expectedStatus != http.StatusOK {
+			continue
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%q: got Content-Type %q; expected %q", tc.query, contentType, "application/json")
+		}
+		var runs []*Run
+		err := json.Unmarshal(w.Body.Bytes(), &runs)
+		if err != nil {
+			t.Errorf("%q: could not decode response %q: %s", tc.query, w.Body.String(), err)
+			continue
+		}
+		if runs == nil {
+			t.Errorf("%q: got %q; expected an array", tc.query, w.Body.String())
+		}
+		if got := runMinutes(runs); !equalInts(got, tc.expected) {
+			t.Errorf("%q: got runs %v; expected %v", tc.query, got, tc.expected)
+		}
+	}
+}
+
+func TestNewAutovacuumPluginConfig(t *testing.T) {
+	dbh := openTestDB(t)
+	for _, config := range []map[string]interface{}{
+		{"history_length": int64(0)},
+		{"max_tables": int64(-1)},
+		{"history_length": "many"},
+		{"history": int64(10)},
+	} {
+		_, err := newAutovacuumPlugin(shared.PluginInitArgs{
+			Name:               pluginName,
+			DBH:                dbh,
+			PrometheusRegistry: prometheus.NewRegistry(),
+			Config:             config,
+			Bucket:             testBucket,
+			LogTimezone:        time.UTC,
+		})
+		if err == nil {
+			t.Errorf("newAutovacuumPlugin accepted the configuration %v", config)
+		}
+	}
+}
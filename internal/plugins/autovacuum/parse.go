@@ -0,0 +1,173 @@
+package autovacuum
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The operations a Run can be of.
+const (
+	OperationVacuum  = "vacuum"
+	OperationAnalyze = "analyze"
+)
+
+// Run describes a single run of autovacuum or autoanalyze on a table, as
+// logged by the server because of log_autovacuum_min_duration.  The details
+// logged vary between server versions; the fields for details the server
+// didn't log are zero.
+type Run struct {
+	// The log_time of the record.  Not set by ParseMessage.
+	LogTime time.Time `json:"logTime"`
+	// One of the Operation constants
+	Operation string `json:"operation"`
+	// An aggressive vacuum freezes all unfrozen pages (9.6 and later)
+	Aggressive bool `json:"aggressive,omitempty"`
+	// The vacuum was started to prevent transaction ID wraparound (12 and
+	// later)
+	Wraparound bool   `json:"wraparound,omitempty"`
+	Database   string `json:"database"`
+	Schema     string `json:"schema"`
+	Table      string `json:"table"`
+
+	ElapsedSeconds   float64 `json:"elapsedSeconds"`
+	CPUUserSeconds   float64 `json:"cpuUserSeconds"`
+	CPUSystemSeconds float64 `json:"cpuSystemSeconds"`
+
+	// Vacuum only
+	IndexScans             int64 `json:"indexScans,omitempty"`
+	PagesRemoved           int64 `json:"pagesRemoved,omitempty"`
+	PagesRemain            int64 `json:"pagesRemain,omitempty"`
+	PagesScanned           int64 `json:"pagesScanned,omitempty"`
+	TuplesRemoved          int64 `json:"tuplesRemoved,omitempty"`
+	TuplesRemain           int64 `json:"tuplesRemain,omitempty"`
+	TuplesDeadNotRemovable int64 `json:"tuplesDeadNotRemovable,omitempty"`
+	TuplesFrozen           int64 `json:"tuplesFrozen,omitempty"`
+
+	// Buffer usage is logged for analyze since 13, as are the rates.
+	BufferHits    int64   `json:"bufferHits,omitempty"`
+	BufferMisses  int64   `json:"bufferMisses,omitempty"`
+	BufferDirtied int64   `json:"bufferDirtied,omitempty"`
+	ReadRateMBps  float64 `json:"readRateMBps,omitempty"`
+	WriteRateMBps float64 `json:"writeRateMBps,omitempty"`
+	// 13 and later
+	WALRecords        int64 `json:"walRecords,omitempty"`
+	WALFullPageImages int64 `json:"walFullPageImages,omitempty"`
+	WALBytes          int64 `json:"walBytes,omitempty"`
+	// 14 and later, with track_io_timing
+	IOReadMS  float64 `json:"ioReadMs,omitempty"`
+	IOWriteMS float64 `json:"ioWriteMs,omitempty"`
+}
+
+// FullTableName returns the name of the table as the server logs it, e.g.
+// "postgres.public.t".
+func (r *Run) FullTableName() string {
+	return r.Database + "." + r.Schema + "." + r.Table
+}
+
+var (
+	runHeaderRe = regexp.MustCompile(`^automatic (aggressive )?(vacuum|analyze)( to prevent wraparound)? of table "([^"]*)"`)
+
+	// 10 and later
+	systemUsageRe = regexp.MustCompile(`CPU: user: ([0-9.]+) s, system: ([0-9.]+) s, elapsed: ([0-9.]+) s`)
+	// 9.4 to 9.6
+	oldSystemUsageRe = regexp.MustCompile(`CPU ([0-9.]+)s/([0-9.]+)u sec elapsed ([0-9.]+) sec`)
+
+	indexScansRe   = regexp.MustCompile(`index scans: ([0-9]+)`)
+	pagesRe        = regexp.MustCompile(`pages: ([0-9]+) removed, ([0-9]+) remain`)
+	pagesScannedRe = regexp.MustCompile(`pages: [0-9]+ removed, [0-9]+ remain, ([0-9]+) scanned`)
+	tuplesRe       = regexp.MustCompile(`tuples: ([0-9]+) removed, ([0-9]+) remain, ([0-9]+) are dead but not yet removable`)
+	frozenRe       = regexp.MustCompile(`frozen: [0-9]+ pages from table \([0-9.]+% of total\) had ([0-9]+) tuples frozen`)
+	// "misses" was renamed to "reads" in 17.
+	bufferUsageRe = regexp.MustCompile(`buffer usage: ([0-9]+) hits, ([0-9]+) (?:misses|reads), ([0-9]+) dirtied`)
+	ratesRe       = regexp.MustCompile(`avg read rate: ([0-9.]+) MB/s, avg write rate: ([0-9.]+) MB/s`)
+	walUsageRe    = regexp.MustCompile(`WAL usage: ([0-9]+) records, ([0-9]+) full page images, ([0-9]+) bytes`)
+	ioTimingsRe   = regexp.MustCompile(`I/O timings: read: ([0-9.]+) ms, write: ([0-9.]+) ms`)
+)
+
+// ParseMessage parses the message of a record logged at the end of an
+// autovacuum or autoanalyze run, e.g.
+//
+//	automatic vacuum of table "postgres.public.t": index scans: 0
+//	pages: 0 removed, 443 remain, 0 skipped due to pins, 0 skipped frozen
+//	...
+//
+// ok is false if message is not such a message.  Only messages written with
+// lc_messages set to English are recognized.
+func ParseMessage(message string) (run *Run, ok bool) {
+	m := runHeaderRe.FindStringSubmatch(message)
+	if m == nil {
+		return nil, false
+	}
+	run = &Run{
+		Aggressive: m[1] != "",
+		Operation:  m[2],
+		Wraparound: m[3] != "",
+	}
+	// Neither the schema nor the table is quoted, so this is ambiguous if
+	// their names contain dots.
+	names := strings.SplitN(m[4], ".", 3)
+	if len(names) != 3 {
+		return nil, false
+	}
+	run.Database, run.Schema, run.Table = names[0], names[1], names[2]
+
+	if m := systemUsageRe.FindStringSubmatch(message); m != nil {
+		run.CPUUserSeconds = parseFloat(m[1])
+		run.CPUSystemSeconds = parseFloat(m[2])
+		run.ElapsedSeconds = parseFloat(m[3])
+	} else if m := oldSystemUsageRe.FindStringSubmatch(message); m != nil {
+		run.CPUSystemSeconds = parseFloat(m[1])
+		run.CPUUserSeconds = parseFloat(m[2])
+		run.ElapsedSeconds = parseFloat(m[3])
+	}
+	if m := indexScansRe.FindStringSubmatch(message); m != nil {
+		run.IndexScans = parseInt(m[1])
+	}
+	if m := pagesRe.FindStringSubmatch(message); m != nil {
+		run.PagesRemoved = parseInt(m[1])
+		run.PagesRemain = parseInt(m[2])
+	}
+	if m := pagesScannedRe.FindStringSubmatch(message); m != nil {
+		run.PagesScanned = parseInt(m[1])
+	}
+	if m := tuplesRe.FindStringSubmatch(message); m != nil {
+		run.TuplesRemoved = parseInt(m[1])
+		run.TuplesRemain = parseInt(m[2])
+		run.TuplesDeadNotRemovable = parseInt(m[3])
+	}
+	if m := frozenRe.FindStringSubmatch(message); m != nil {
+		run.TuplesFrozen = parseInt(m[1])
+	}
+	if m := bufferUsageRe.FindStringSubmatch(message); m != nil {
+		run.BufferHits = parseInt(m[1])
+		run.BufferMisses = parseInt(m[2])
+		run.BufferDirtied = parseInt(m[3])
+	}
+	if m := ratesRe.FindStringSubmatch(message); m != nil {
+		run.ReadRateMBps = parseFloat(m[1])
+		run.WriteRateMBps = parseFloat(m[2])
+	}
+	if m := walUsageRe.FindStringSubmatch(message); m != nil {
+		run.WALRecords = parseInt(m[1])
+		run.WALFullPageImages = parseInt(m[2])
+		run.WALBytes = parseInt(m[3])
+	}
+	if m := ioTimingsRe.FindStringSubmatch(message); m != nil {
+		run.IOReadMS = parseFloat(m[1])
+		run.IOWriteMS = parseFloat(m[2])
+	}
+	return run, true
+}
+
+// The regular expressions only match valid numbers, barring overflows.
+func parseInt(s string) int64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+func parseFloat(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
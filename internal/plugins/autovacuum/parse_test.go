@@ -0,0 +1,258 @@
+package autovacuum
+
+import (
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	testCases := []struct {
+		name    string
+		message string
+		// nil if the message is not recognized
+		expected *Run
+	}{
+		{
+			name: "9.4 vacuum",
+			message: `automatic vacuum of table "postgres.public.t": index scans: 1
+pages: 0 removed, 443 remain
+tuples: 1000 removed, 99000 remain, 12 are dead but not yet removable
+buffer usage: 950 hits, 3 misses, 448 dirtied
+avg read rate: 0.061 MB/s, avg write rate: 9.125 MB/s
+system usage: CPU 0.01s/0.05u sec elapsed 0.38 sec`,
+			expected: &Run{
+				Operation: OperationVacuum, Database: "postgres", Schema: "public", Table: "t",
+				ElapsedSeconds: 0.38, CPUUserSeconds: 0.05, CPUSystemSeconds: 0.01,
+				IndexScans: 1, PagesRemoved: 0, PagesRemain: 443,
+				TuplesRemoved: 1000, TuplesRemain: 99000, TuplesDeadNotRemovable: 12,
+				BufferHits: 950, BufferMisses: 3, BufferDirtied: 448,
+				ReadRateMBps: 0.061, WriteRateMBps: 9.125,
+			},
+		},
+		{
+			name:    "9.4 analyze",
+			message: `automatic analyze of table "postgres.public.t" system usage: CPU 0.00s/0.02u sec elapsed 0.10 sec`,
+			expected: &Run{
+				Operation: OperationAnalyze, Database: "postgres", Schema: "public", Table: "t",
+				ElapsedSeconds: 0.1, CPUUserSeconds: 0.02,
+			},
+		},
+		{
+			name: "9.6 aggressive vacuum",
+			message: `automatic aggressive vacuum of table "app.public.accounts": index scans: 0
+pages: 2 removed, 10 remain, 0 skipped due to pins, 8 skipped frozen
+tuples: 5 removed, 400 remain, 0 are dead but not yet removable
+buffer usage: 40 hits, 0 misses, 4 dirtied
+avg read rate: 0.000 MB/s, avg write rate: 1.500 MB/s
+system usage: CPU 0.00s/0.00u sec elapsed 0.02 sec`,
+			expected: &Run{
+				Operation: OperationVacuum, Aggressive: true, Database: "app", Schema: "public", Table: "accounts",
+				ElapsedSeconds: 0.02,
+				PagesRemoved:   2, PagesRemain: 10,
+				TuplesRemoved: 5, TuplesRemain: 400,
+				BufferHits: 40, BufferDirtied: 4,
+				WriteRateMBps: 1.5,
+			},
+		},
+		{
+			name: "10 vacuum",
+			message: `automatic vacuum of table "postgres.public.t": index scans: 1
+pages: 0 removed, 443 remain, 0 skipped due to pins, 0 skipped frozen
+tuples: 1000 removed, 99000 remain, 0 are dead but not yet removable, oldest xmin: 571
+buffer usage: 950 hits, 3 misses, 448 dirtied
+avg read rate: 0.061 MB/s, avg write rate: 9.125 MB/s
+system usage: CPU: user: 0.05 s, system: 0.01 s, elapsed: 0.38 s`,
+			expected: &Run{
+				Operation: OperationVacuum, Database: "postgres", Schema: "public", Table: "t",
+				ElapsedSeconds: 0.38, CPUUserSeconds: 0.05, CPUSystemSeconds: 0.01,
+				IndexScans: 1, PagesRemain: 443,
+				TuplesRemoved: 1000, TuplesRemain: 99000,
+				BufferHits: 950, BufferMisses: 3, BufferDirtied: 448,
+				ReadRateMBps: 0.061, WriteRateMBps: 9.125,
+			},
+		},
+		{
+			name: "12 vacuum to prevent wraparound",
+			message: `automatic aggressive vacuum to prevent wraparound of table "postgres.pg_catalog.pg_class": index scans: 0
+pages: 0 removed, 13 remain, 0 skipped due to pins, 0 skipped frozen
+tuples: 0 removed, 412 remain, 0 are dead but not yet removable, oldest xmin: 200000571
+buffer usage: 54 hits, 0 misses, 14 dirtied
+avg read rate: 0.000 MB/s, avg write rate: 27.344 MB/s
+system usage: CPU: user: 0.00 s, system: 0.00 s, elapsed: 0.00 s`,
+			expected: &Run{
+				Operation: OperationVacuum, Aggressive: true, Wraparound: true,
+				Database: "postgres", Schema: "pg_catalog", Table: "pg_class",
+				PagesRemain:  13,
+				TuplesRemain: 412,
+				BufferHits:   54, BufferDirtied: 14,
+				WriteRateMBps: 27.344,
+			},
+		},
+		{
+			name: "13 vacuum",
+			message: `automatic vacuum of table "postgres.public.t": index scans: 1
+pages: 0 removed, 443 remain, 0 skipped due to pins, 0 skipped frozen
+tuples: 1000 removed, 99000 remain, 0 are dead but not yet removable, oldest xmin: 571
+buffer usage: 950 hits, 3 misses, 448 dirtied
+avg read rate: 0.061 MB/s, avg write rate: 9.125 MB/s
+system usage: CPU: user: 0.05 s, system: 0.01 s, elapsed: 0.38 s
+WAL usage: 1334 records, 447 full page images, 3461425 bytes`,
+			expected: &Run{
+				Operation: OperationVacuum, Database: "postgres", Schema: "public", Table: "t",
+				ElapsedSeconds: 0.38, CPUUserSeconds: 0.05, CPUSystemSeconds: 0.01,
+				IndexScans: 1, PagesRemain: 443,
+				TuplesRemoved: 1000, TuplesRemain: 99000,
+				BufferHits: 950, BufferMisses: 3, BufferDirtied: 448,
+				ReadRateMBps: 0.061, WriteRateMBps: 9.125,
+				WALRecords: 1334, WALFullPageImages: 447, WALBytes: 3461425,
+			},
+		},
+		{
+			name: "14 vacuum with track_io_timing",
+			message: `automatic vacuum of table "postgres.public.t": index scans: 1
+pages: 0 removed, 443 remain, 0 skipped due to pins, 0 skipped frozen
+tuples: 1000 removed, 99000 remain, 0 are dead but not yet removable, oldest xmin: 571
+index scan needed: 6 pages from table (1.35% of total) had 1000 dead item identifiers removed
+index "t_pkey": pages: 276 in total, 0 newly deleted, 0 currently deleted, 0 reusable
+I/O timings: read: 2.521 ms, write: 0.000 ms
+avg read rate: 0.061 MB/s, avg write rate: 9.125 MB/s
+buffer usage: 950 hits, 3 misses, 448 dirtied
+WAL usage: 1334 records, 447 full page images, 3461425 bytes
+system usage: CPU: user: 0.05 s, system: 0.01 s, elapsed: 0.38 s`,
+			expected: &Run{
+				Operation: OperationVacuum, Database: "postgres", Schema: "public", Table: "t",
+				ElapsedSeconds: 0.38, CPUUserSeconds: 0.05, CPUSystemSeconds: 0.01,
+				IndexScans: 1, PagesRemain: 443,
+				TuplesRemoved: 1000, TuplesRemain: 99000,
+				BufferHits: 950, BufferMisses: 3, BufferDirtied: 448,
+				ReadRateMBps: 0.061, WriteRateMBps: 9.125,
+				WALRecords: 1334, WALFullPageImages: 447, WALBytes: 3461425,
+				IOReadMS: 2.521,
+			},
+		},
+		{
+			name: "14 analyze",
+			message: `automatic analyze of table "postgres.public.t"
+I/O timings: read: 1.250 ms, write: 0.000 ms
+avg read rate: 12.500 MB/s, avg write rate: 0.000 MB/s
+buffer usage: 120 hits, 16 misses, 0 dirtied
+system usage: CPU: user: 0.02 s, system: 0.00 s, elapsed: 0.01 s`,
+			expected: &Run{
+				Operation: OperationAnalyze, Database: "postgres", Schema: "public", Table: "t",
+				ElapsedSeconds: 0.01, CPUUserSeconds: 0.02,
+				BufferHits: 120, BufferMisses: 16,
+				ReadRateMBps: 12.5,
+				IOReadMS:     1.25,
+			},
+		},
+		{
+			name: "16 vacuum",
+			message: `automatic vacuum of table "postgres.public.t": index scans: 1
+pages: 0 removed, 443 remain, 443 scanned (100.00% of total)
+tuples: 1000 removed, 99000 remain, 3 are dead but not yet removable
+removable cutoff: 741, which was 0 XIDs old when operation ended
+new relfrozenxid: 740, which is 2 XIDs ahead of previous value
+frozen: 12 pages from table (2.71% of total) had 1500 tuples frozen
+index scan needed: 6 pages from table (1.35% of total) had 1000 dead item identifiers removed
+index "t_pkey": pages: 276 in total, 0 newly deleted, 0 currently deleted, 0 reusable
+avg read rate: 0.061 MB/s, avg write rate: 9.125 MB/s
+buffer usage: 950 hits, 3 misses, 448 dirtied
+WAL usage: 1334 records, 447 full page images, 3461425 bytes
+system usage: CPU: user: 0.05 s, system: 0.01 s, elapsed: 0.38 s`,
+			expected: &Run{
+				Operation: OperationVacuum, Database: "postgres", Schema: "public", Table: "t",
+				ElapsedSeconds: 0.38, CPUUserSeconds: 0.05, CPUSystemSeconds: 0.01,
+				IndexScans: 1, PagesRemain: 443, PagesScanned: 443,
+				TuplesRemoved: 1000, TuplesRemain: 99000, TuplesDeadNotRemovable: 3,
+				TuplesFrozen: 1500,
+				BufferHits:   950, BufferMisses: 3, BufferDirtied: 448,
+				ReadRateMBps: 0.061, WriteRateMBps: 9.125,
+				WALRecords: 1334, WALFullPageImages: 447, WALBytes: 3461425,
+			},
+		},
+		{
+			name: "17 vacuum",
+			message: `automatic vacuum of table "postgres.public.t": index scans: 0
+pages: 4 removed, 439 remain, 20 scanned (4.51% of total)
+tuples: 10 removed, 98990 remain, 0 are dead but not yet removable
+removable cutoff: 752, which was 0 XIDs old when operation ended
+frozen: 0 pages from table (0.00% of total) had 0 tuples frozen
+index scan not needed: 0 pages from table (0.00% of total) had 0 dead item identifiers removed
+I/O timings: read: 0.000 ms, write: 0.310 ms
+avg read rate: 0.000 MB/s, avg write rate: 3.000 MB/s
+buffer usage: 80 hits, 0 reads, 6 dirtied
+WAL usage: 30 records, 2 full page images, 17040 bytes
+system usage: CPU: user: 0.00 s, system: 0.00 s, elapsed: 0.02 s`,
+			expected: &Run{
+				Operation: OperationVacuum, Database: "postgres", Schema: "public", Table: "t",
+				ElapsedSeconds: 0.02,
+				PagesRemoved:   4, PagesRemain: 439, PagesScanned: 20,
+				TuplesRemoved: 10, TuplesRemain: 98990,
+				BufferHits: 80, BufferDirtied: 6,
+				WriteRateMBps: 3,
+				WALRecords:    30, WALFullPageImages: 2, WALBytes: 17040,
+				IOWriteMS: 0.31,
+			},
+		},
+		{
+			name: "17 analyze",
+			message: `automatic analyze of table "app.sales.orders"
+avg read rate: 8.000 MB/s, avg write rate: 0.000 MB/s
+buffer usage: 300 hits, 40 reads, 2 dirtied
+system usage: CPU: user: 0.04 s, system: 0.01 s, elapsed: 0.05 s`,
+			expected: &Run{
+				Operation: OperationAnalyze, Database: "app", Schema: "sales", Table: "orders",
+				ElapsedSeconds: 0.05, CPUUserSeconds: 0.04, CPUSystemSeconds: 0.01,
+				BufferHits: 300, BufferMisses: 40, BufferDirtied: 2,
+				ReadRateMBps: 8,
+			},
+		},
+		{
+			// only the first dot separates the database from the schema, and
+			// the second the schema from the table
+			name:    "dots in the table name",
+			message: `automatic analyze of table "postgres.public.t.v1" system usage: CPU: user: 0.00 s, system: 0.00 s, elapsed: 0.00 s`,
+			expected: &Run{
+				Operation: OperationAnalyze, Database: "postgres", Schema: "public", Table: "t.v1",
+			},
+		},
+		{
+			name:    "not qualified",
+			message: `automatic vacuum of table "t": index scans: 0`,
+		},
+		{
+			name:    "another message",
+			message: `checkpoint complete: wrote 3 buffers (0.0%)`,
+		},
+		{
+			name:    "not at the beginning",
+			message: `canceling automatic vacuum of table "postgres.public.t"`,
+		},
+		{
+			name:    "lc_messages not English",
+			message: `VACUUM automático de la tabla «postgres.public.t»: recorridos de índice: 0`,
+		},
+	}
+	for _, tc := range testCases {
+		run, ok := ParseMessage(tc.message)
+		if tc.expected == nil {
+			if ok {
+				t.Errorf("%s: ParseMessage recognized the message: %+v", tc.name, run)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: ParseMessage did not recognize the message", tc.name)
+			continue
+		}
+		if *run != *tc.expected {
+			t.Errorf("%s: got\n%+v\nexpected\n%+v", tc.name, *run, *tc.expected)
+		}
+	}
+}
+
+func TestFullTableName(t *testing.T) {
+	run := &Run{Database: "postgres", Schema: "public", Table: "t"}
+	if got := run.FullTableName(); got != "postgres.public.t" {
+		t.Errorf("FullTableName() = %q; expected %q", got, "postgres.public.t")
+	}
+}
@@ -0,0 +1,246 @@
+// Package errorrate implements a plugin which counts the records by severity
+// and SQLSTATE class, e.g. "23 integrity_constraint_violation", labelled by
+// database, user and application.  The counts are exported as
+// pgfisher_errorrate_records_total.
+//
+// So that a misbehaving application can't create an unbounded number of
+// series, only the max_label_values most common values of each of the
+// database, user and application labels are used as is, and the rest are
+// counted as "other"; see shared.LabelLimiter.  The values are ranked again
+// at every checkpoint, and the series of the values which are no longer among
+// the most common ones are removed.  How common each value is, is kept in the
+// bucket, so the same values keep their series after a restart.
+//
+// The first and last time each SQLSTATE was seen, how many times, and the
+// message of the most recent record with it are kept in the bucket as well.
+// The bucket contains a bucket called "sqlstates", in which the key is the
+// SQLSTATE and the value is a SQLStateStats in JSON, and a bucket called
+// "labels", in which the key is the name of a label and the value a JSON
+// object with the number of records seen with each of its values.
+//
+// Settings:
+//
+//	max_label_values    how many values of each label to use as is
+//	                    (default 10)
+//	max_sample_length   how many bytes of the sample messages to keep
+//	                    (default 1024)
+package errorrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const pluginName = "errorrate"
+
+const (
+	defaultMaxLabelValues  = 10
+	defaultMaxSampleLength = 1024
+)
+
+var (
+	sqlStatesBucket = []byte("sqlstates")
+	labelsBucket    = []byte("labels")
+)
+
+func init() {
+	shared.RegisterPlugin(pluginName, newErrorRatePlugin)
+}
+
+// SQLStateStats is what is kept in the bucket for every SQLSTATE.
+type SQLStateStats struct {
+	SQLState string `json:"sqlstate"`
+	Class    string `json:"class"`
+	Count    int64  `json:"count"`
+	// Records whose log_time can't be parsed are counted, but don't move
+	// these.  Zero if no record with the SQLSTATE had a valid log_time.
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	// From the most recent record with the SQLSTATE
+	SampleSeverity string `json:"sampleSeverity"`
+	SampleMessage  string `json:"sampleMessage"`
+}
+
+func (s *SQLStateStats) merge(other *SQLStateStats) {
+	s.Count += other.Count
+	if other.LastSeen.IsZero() {
+		return
+	}
+	if s.FirstSeen.IsZero() || other.FirstSeen.Before(s.FirstSeen) {
+		s.FirstSeen = other.FirstSeen
+	}
+	if !other.LastSeen.Before(s.LastSeen) {
+		s.LastSeen = other.LastSeen
+		s.SampleSeverity = other.SampleSeverity
+		s.SampleMessage = other.SampleMessage
+	}
+}
+
+type errorRatePlugin struct {
+	bucket          []byte
+	logTimezone     *time.Location
+	maxSampleLength int
+
+	recordsTotal *prometheus.CounterVec
+	databases    *shared.LabelLimiter
+	users        *shared.LabelLimiter
+	applications *shared.LabelLimiter
+
+	// The SQLSTATEs seen since the last checkpoint.  Merged with the ones
+	// in the bucket in Checkpoint.
+	pending map[string]*SQLStateStats
+}
+
+func newErrorRatePlugin(args shared.PluginInitArgs) (shared.Plugin, error) {
+	err := shared.CheckConfigKeys(args.Config, "max_label_values", "max_sample_length")
+	if err != nil {
+		return nil, err
+	}
+	maxLabelValues, err := shared.ConfigInt(args.Config, "max_label_values", defaultMaxLabelValues)
+	if err != nil {
+		return nil, err
+	}
+	if maxLabelValues <= 0 {
+		return nil, fmt.Errorf("invalid max_label_values %d; must be positive", maxLabelValues)
+	}
+	maxSampleLength, err := shared.ConfigInt(args.Config, "max_sample_length", defaultMaxSampleLength)
+	if err != nil {
+		return nil, err
+	}
+	if maxSampleLength <= 0 {
+		return nil, fmt.Errorf("invalid max_sample_length %d; must be positive", maxSampleLength)
+	}
+
+	recordsTotal := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "pgfisher_errorrate_records_total",
+			Help:        "The number of records by severity and SQLSTATE class.",
+			ConstLabels: prometheus.Labels{"plugin": args.Name},
+		},
+		[]string{"severity", "sqlstate_class", "database", "user", "application"},
+	)
+	err = args.PrometheusRegistry.Register(recordsTotal)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &errorRatePlugin{
+		bucket:          args.Bucket,
+		logTimezone:     args.LogTimezone,
+		maxSampleLength: int(maxSampleLength),
+		recordsTotal:    recordsTotal,
+		databases:       shared.NewLabelLimiter("database", int(maxLabelValues)),
+		users:           shared.NewLabelLimiter("user", int(maxLabelValues)),
+		applications:    shared.NewLabelLimiter("application", int(maxLabelValues)),
+		pending:         make(map[string]*SQLStateStats),
+	}
+	err = args.DBH.View(func(tx *bolt.Tx) error {
+		labels := tx.Bucket(p.bucket).Bucket(labelsBucket)
+		if labels == nil {
+			return nil
+		}
+		for _, l := range p.labelLimiters() {
+			err := l.Load(labels)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *errorRatePlugin) labelLimiters() []*shared.LabelLimiter {
+	return []*shared.LabelLimiter{p.databases, p.users, p.applications}
+}
+
+func (p *errorRatePlugin) Process(streamPos *shared.LogStreamPosition, record []string) error {
+	le, err := shared.NewLogEntry(record)
+	if err != nil {
+		return err
+	}
+	sqlstate := le.SQLState()
+	p.recordsTotal.WithLabelValues(
+		le.ErrorSeverity(),
+		shared.SQLStateClass(sqlstate),
+		p.databases.Value(le.DatabaseName()),
+		p.users.Value(le.UserName()),
+		p.applications.Value(le.ApplicationName()),
+	).Inc()
+
+	if sqlstate == "" {
+		return nil
+	}
+	// A record with an odd log_time is still counted, rather than stopping
+	// the pipeline over it.
+	logTime, err := le.LogTime(p.logTimezone)
+	if err != nil {
+		logTime = time.Time{}
+	}
+	s := &SQLStateStats{
+		SQLState:       sqlstate,
+		Class:          shared.SQLStateClass(sqlstate),
+		Count:          1,
+		FirstSeen:      logTime,
+		LastSeen:       logTime,
+		SampleSeverity: le.ErrorSeverity(),
+		SampleMessage:  shared.TruncateUTF8(le.Message(), p.maxSampleLength),
+	}
+	if pending, ok := p.pending[sqlstate]; ok {
+		pending.merge(s)
+	} else {
+		p.pending[sqlstate] = s
+	}
+	return nil
+}
+
+func (p *errorRatePlugin) Checkpoint(tx *bolt.Tx, streamPos *shared.LogStreamPosition) error {
+	bucket := tx.Bucket(p.bucket)
+	sqlstates, err := bucket.CreateBucketIfNotExists(sqlStatesBucket)
+	if err != nil {
+		return err
+	}
+	for sqlstate, stats := range p.pending {
+		if data := sqlstates.Get([]byte(sqlstate)); data != nil {
+			var stored SQLStateStats
+			err = json.Unmarshal(data, &stored)
+			if err != nil {
+				return fmt.Errorf("could not decode the statistics of SQLSTATE %s: %s", sqlstate, err)
+			}
+			stored.merge(stats)
+			stats = &stored
+		}
+		data, err := json.Marshal(stats)
+		if err != nil {
+			return err
+		}
+		err = sqlstates.Put([]byte(sqlstate), data)
+		if err != nil {
+			return err
+		}
+	}
+	p.pending = make(map[string]*SQLStateStats)
+
+	labels, err := bucket.CreateBucketIfNotExists(labelsBucket)
+	if err != nil {
+		return err
+	}
+	for _, l := range p.labelLimiters() {
+		err = l.Store(labels)
+		if err != nil {
+			return err
+		}
+		for _, v := range l.Rerank() {
+			p.recordsTotal.DeletePartialMatch(prometheus.Labels{l.Name(): v})
+		}
+	}
+	return nil
+}
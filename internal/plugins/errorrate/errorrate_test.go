@@ -0,0 +1,185 @@
+package errorrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSQLStateStatsMerge(t *testing.T) {
+	t1 := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	stats := func(first, last time.Time, message string) SQLStateStats {
+		return SQLStateStats{Count: 1, FirstSeen: first, LastSeen: last, SampleMessage: message}
+	}
+	testCases := []struct {
+		name     string
+		s        SQLStateStats
+		other    SQLStateStats
+		expected SQLStateStats
+	}{
+		{"later", stats(t1, t1, "a"), stats(t2, t2, "b"), SQLStateStats{Count: 2, FirstSeen: t1, LastSeen: t2, SampleMessage: "b"}},
+		{"earlier", stats(t2, t2, "a"), stats(t1, t1, "b"), SQLStateStats{Count: 2, FirstSeen: t1, LastSeen: t2, SampleMessage: "a"}},
+		// the most recent record wins a tie
+		{"at the same time", stats(t1, t1, "a"), stats(t1, t1, "b"), SQLStateStats{Count: 2, FirstSeen: t1, LastSeen: t1, SampleMessage: "b"}},
+		// records without a valid log_time only add to the count
+		{"other without times", stats(t1, t2, "a"), stats(time.Time{}, time.Time{}, "b"), SQLStateStats{Count: 2, FirstSeen: t1, LastSeen: t2, SampleMessage: "a"}},
+		{"without times", stats(time.Time{}, time.Time{}, "a"), stats(t1, t2, "b"), SQLStateStats{Count: 2, FirstSeen: t1, LastSeen: t2, SampleMessage: "b"}},
+	}
+	for _, tc := range testCases {
+		tc.s.merge(&tc.other)
+		if tc.s != tc.expected {
+			t.Errorf("%s: got %+v; expected %+v", tc.name, tc.s, tc.expected)
+		}
+	}
+}
+
+func TestErrorRatePlugin(t *testing.T) {
+	dbh, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbh.Close()
+	bucket := []byte("plugin:errorrate")
+	err = dbh.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket(bucket)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPlugin := func() (*errorRatePlugin, *prometheus.Registry) {
+		registry := prometheus.NewRegistry()
+		p, err := newErrorRatePlugin(shared.PluginInitArgs{
+			Name:               pluginName,
+			DBH:                dbh,
+			PrometheusRegistry: registry,
+			Config:             map[string]interface{}{"max_label_values": int64(1)},
+			Bucket:             bucket,
+			LogTimezone:        time.UTC,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.(*errorRatePlugin), registry
+	}
+	process := func(p *errorRatePlugin, records [][4]string) {
+		for _, r := range records {
+			err := p.Process(&shared.LogStreamPosition{}, shared.LatestCSVLogSchema().NewRecord(map[int]string{
+				shared.LogTimeAttno:         r[0],
+				shared.ErrorSeverityAttno:   r[1],
+				shared.SQLStateAttno:        r[2],
+				shared.DatabaseNameAttno:    r[3],
+				shared.UserNameAttno:        "u",
+				shared.ApplicationNameAttno: "psql",
+				shared.MessageAttno:         r[1] + " at " + r[0],
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkpoint := func(p *errorRatePlugin) {
+		err := dbh.Update(func(tx *bolt.Tx) error {
+			return p.Checkpoint(tx, &shared.LogStreamPosition{})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Returns the counts by severity, SQLSTATE class and database.
+	counts := func(registry *prometheus.Registry) string {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]float64)
+		for _, f := range families {
+			for _, m := range f.GetMetric() {
+				labels := make(map[string]string)
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				got[labels["severity"]+"/"+labels["sqlstate_class"]+"/"+labels["database"]] = m.GetCounter().GetValue()
+			}
+		}
+		return fmt.Sprint(got)
+	}
+	stored := func(sqlstate string) SQLStateStats {
+		var s SQLStateStats
+		err := dbh.View(func(tx *bolt.Tx) error {
+			return json.Unmarshal(tx.Bucket(bucket).Bucket(sqlStatesBucket).Get([]byte(sqlstate)), &s)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	p, registry := newPlugin()
+	process(p, [][4]string{
+		{"2024-10-01 12:00:00 UTC", "ERROR", "23505", "app"},
+		{"2024-10-01 12:00:01 UTC", "LOG", "00000", "app"},
+		{"2024-10-01 12:00:02 UTC", "ERROR", "23505", "reporting"},
+		// an odd log_time doesn't stop the plugin
+		{"yesterday", "ERROR", "23505", "reporting"},
+		{"", "FATAL", "57P01", "reporting"},
+	})
+	expected := fmt.Sprint(map[string]float64{
+		"ERROR/23 integrity_constraint_violation/app":   1,
+		"ERROR/23 integrity_constraint_violation/other": 2,
+		"LOG/00 successful_completion/app":              1,
+		"FATAL/57 operator_intervention/other":          1,
+	})
+	if got := counts(registry); got != expected {
+		t.Errorf("got counts %s; expected %s", got, expected)
+	}
+	checkpoint(p)
+	// reporting is now the most common database, and replaces app
+	expected = fmt.Sprint(map[string]float64{
+		"ERROR/23 integrity_constraint_violation/other": 2,
+		"FATAL/57 operator_intervention/other":          1,
+	})
+	if got := counts(registry); got != expected {
+		t.Errorf("got counts %s after the checkpoint; expected %s", got, expected)
+	}
+	s := stored("23505")
+	if s.Count != 3 || !s.FirstSeen.Equal(time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)) ||
+		!s.LastSeen.Equal(time.Date(2024, 10, 1, 12, 0, 2, 0, time.UTC)) ||
+		s.SampleMessage != "ERROR at 2024-10-01 12:00:02 UTC" {
+		t.Errorf("got %+v for 23505 after the first checkpoint", s)
+	}
+	if s := stored("57P01"); s.Count != 1 || !s.FirstSeen.IsZero() || s.SampleSeverity != "FATAL" {
+		t.Errorf("got %+v for 57P01 after the first checkpoint", s)
+	}
+
+	// A new plugin merges with the state in the bucket, and uses the same
+	// database label.
+	p, registry = newPlugin()
+	process(p, [][4]string{
+		{"2024-10-01 11:00:00 UTC", "ERROR", "23505", "reporting"},
+		{"2024-10-01 13:00:00 UTC", "FATAL", "57P01", "app"},
+	})
+	expected = fmt.Sprint(map[string]float64{
+		"ERROR/23 integrity_constraint_violation/reporting": 1,
+		"FATAL/57 operator_intervention/other":              1,
+	})
+	if got := counts(registry); got != expected {
+		t.Errorf("got counts %s after reloading; expected %s", got, expected)
+	}
+	checkpoint(p)
+	s = stored("23505")
+	if s.Count != 4 || !s.FirstSeen.Equal(time.Date(2024, 10, 1, 11, 0, 0, 0, time.UTC)) ||
+		s.SampleMessage != "ERROR at 2024-10-01 12:00:02 UTC" {
+		t.Errorf("got %+v for 23505 after the second checkpoint", s)
+	}
+	if s := stored("57P01"); s.Count != 2 || !s.FirstSeen.Equal(time.Date(2024, 10, 1, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %+v for 57P01 after the second checkpoint", s)
+	}
+}
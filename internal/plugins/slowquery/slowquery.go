@@ -0,0 +1,283 @@
+// Package slowquery implements a plugin which analyzes the durations the
+// server logs because of log_min_duration_statement or log_duration.  It
+// exports the durations as a Prometheus histogram labelled by database, user,
+// application and the kind of message (see shared.DurationMessage), and keeps
+// the slowest statements of every hour in its bucket.  application_name is set
+// by the client, so only the max_applications most common applications are
+// used as is in the application label, and the rest are labelled "other"; see
+// shared.LabelLimiter.
+//
+// The bucket contains a bucket called "hours", in which the key is the
+// beginning of the hour in UTC in RFC 3339 format, e.g.
+// "2024-10-01T13:00:00Z", and the value is a JSON array of the slowest
+// statements logged during that hour, slowest first.  The statements are
+// normalized with shared.Fingerprint, so the constants in them are replaced
+// with parameters.  The bucket also contains a bucket called "labels", in
+// which the key "application" has the number of records seen with each
+// application in JSON.
+//
+// Settings:
+//
+//	buckets                the histogram buckets in seconds
+//	top_n                  how many statements to keep per hour (default 10)
+//	max_statement_length   how many bytes of each statement to keep
+//	                       (default 4096)
+//	max_applications       how many applications to use as is in the
+//	                       application label (default 10)
+//	retention              how long to keep the statements of an hour for,
+//	                       relative to the newest record (default "168h")
+package slowquery
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const pluginName = "slowquery"
+
+var defaultBuckets = prometheus.ExponentialBuckets(0.001, 4, 10)
+
+const (
+	defaultTopN               = 10
+	defaultMaxStatementLength = 4096
+	defaultRetention          = 7 * 24 * time.Hour
+	defaultMaxApplications    = 10
+)
+
+var (
+	hoursBucket  = []byte("hours")
+	labelsBucket = []byte("labels")
+)
+
+func init() {
+	shared.RegisterPlugin(pluginName, newSlowQueryPlugin)
+}
+
+// SlowStatement is a statement kept in the bucket.
+type SlowStatement struct {
+	LogTime     time.Time `json:"logTime"`
+	DurationMS  float64   `json:"durationMs"`
+	Kind        string    `json:"kind"`
+	Database    string    `json:"database"`
+	User        string    `json:"user"`
+	Application string    `json:"application"`
+	// The statement normalized by shared.Fingerprint
+	Statement   string `json:"statement"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type slowQueryPlugin struct {
+	bucket             []byte
+	logTimezone        *time.Location
+	topN               int
+	maxStatementLength int
+	retention          time.Duration
+
+	durationSeconds *prometheus.HistogramVec
+	applications    *shared.LabelLimiter
+
+	// The slowest statements of every hour seen since the last checkpoint,
+	// slowest first.  Merged with the ones in the bucket in Checkpoint.
+	pending map[time.Time][]SlowStatement
+	// The log_time of the newest record seen so far
+	newest time.Time
+}
+
+func newSlowQueryPlugin(args shared.PluginInitArgs) (shared.Plugin, error) {
+	err := shared.CheckConfigKeys(args.Config, "buckets", "top_n", "max_statement_length", "retention", "max_applications")
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := shared.ConfigFloatList(args.Config, "buckets", defaultBuckets)
+	if err != nil {
+		return nil, err
+	}
+	topN, err := shared.ConfigInt(args.Config, "top_n", defaultTopN)
+	if err != nil {
+		return nil, err
+	}
+	if topN <= 0 {
+		return nil, fmt.Errorf("invalid top_n %d; must be positive", topN)
+	}
+	maxStatementLength, err := shared.ConfigInt(args.Config, "max_statement_length", defaultMaxStatementLength)
+	if err != nil {
+		return nil, err
+	}
+	if maxStatementLength <= 0 {
+		return nil, fmt.Errorf("invalid max_statement_length %d; must be positive", maxStatementLength)
+	}
+	retention, err := shared.ConfigDuration(args.Config, "retention", defaultRetention)
+	if err != nil {
+		return nil, err
+	}
+	if retention <= 0 {
+		return nil, fmt.Errorf("invalid retention %s; must be positive", retention)
+	}
+	maxApplications, err := shared.ConfigInt(args.Config, "max_applications", defaultMaxApplications)
+	if err != nil {
+		return nil, err
+	}
+	if maxApplications <= 0 {
+		return nil, fmt.Errorf("invalid max_applications %d; must be positive", maxApplications)
+	}
+
+	durationSeconds := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:        "pgfisher_slowquery_duration_seconds",
+			Help:        "The durations of the statements logged with a duration.",
+			Buckets:     buckets,
+			ConstLabels: prometheus.Labels{"plugin": args.Name},
+		},
+		[]string{"database", "user", "application", "kind"},
+	)
+	err = args.PrometheusRegistry.Register(durationSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &slowQueryPlugin{
+		bucket:             args.Bucket,
+		logTimezone:        args.LogTimezone,
+		topN:               int(topN),
+		maxStatementLength: int(maxStatementLength),
+		retention:          retention,
+		durationSeconds:    durationSeconds,
+		applications:       shared.NewLabelLimiter("application", int(maxApplications)),
+		pending:            make(map[time.Time][]SlowStatement),
+	}
+	err = args.DBH.View(func(tx *bolt.Tx) error {
+		labels := tx.Bucket(p.bucket).Bucket(labelsBucket)
+		if labels == nil {
+			return nil
+		}
+		return p.applications.Load(labels)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *slowQueryPlugin) Process(streamPos *shared.LogStreamPosition, record []string) error {
+	le, err := shared.NewLogEntry(record)
+	if err != nil {
+		return err
+	}
+	if le.ErrorSeverity() != "LOG" {
+		return nil
+	}
+	msg, ok := shared.ParseDurationMessage(le.Message())
+	if !ok {
+		return nil
+	}
+	p.durationSeconds.WithLabelValues(
+		le.DatabaseName(),
+		le.UserName(),
+		p.applications.Value(le.ApplicationName()),
+		msg.Kind,
+	).Observe(msg.Duration.Seconds())
+
+	// Plans are logged by auto_explain in addition to the statement, and
+	// with log_duration the statement isn't known.
+	if msg.Kind == shared.DurationKindPlan || msg.Kind == shared.DurationKindNone {
+		return nil
+	}
+	logTime, err := le.LogTime(p.logTimezone)
+	if err != nil {
+		return err
+	}
+	if logTime.After(p.newest) {
+		p.newest = logTime
+	}
+	fingerprint, statement := shared.Fingerprint(msg.Text)
+	hour := logTime.UTC().Truncate(time.Hour)
+	p.pending[hour] = p.addSlowStatement(p.pending[hour], SlowStatement{
+		LogTime:     logTime,
+		DurationMS:  float64(msg.Duration) / float64(time.Millisecond),
+		Kind:        msg.Kind,
+		Database:    le.DatabaseName(),
+		User:        le.UserName(),
+		Application: le.ApplicationName(),
+		Statement:   shared.TruncateUTF8(statement, p.maxStatementLength),
+		Fingerprint: fingerprint,
+	})
+	return nil
+}
+
+// Adds s to statements if it's among the topN slowest ones, and returns the
+// result.
+func (p *slowQueryPlugin) addSlowStatement(statements []SlowStatement, s SlowStatement) []SlowStatement {
+	i := sort.Search(len(statements), func(i int) bool {
+		return statements[i].DurationMS < s.DurationMS
+	})
+	if i >= p.topN {
+		return statements
+	}
+	statements = append(statements, SlowStatement{})
+	copy(statements[i+1:], statements[i:])
+	statements[i] = s
+	if len(statements) > p.topN {
+		statements = statements[:p.topN]
+	}
+	return statements
+}
+
+func (p *slowQueryPlugin) Checkpoint(tx *bolt.Tx, streamPos *shared.LogStreamPosition) error {
+	bucket := tx.Bucket(p.bucket)
+	labels, err := bucket.CreateBucketIfNotExists(labelsBucket)
+	if err != nil {
+		return err
+	}
+	err = p.applications.Store(labels)
+	if err != nil {
+		return err
+	}
+	for _, v := range p.applications.Rerank() {
+		p.durationSeconds.DeletePartialMatch(prometheus.Labels{p.applications.Name(): v})
+	}
+
+	hours, err := bucket.CreateBucketIfNotExists(hoursBucket)
+	if err != nil {
+		return err
+	}
+	for hour, statements := range p.pending {
+		key := []byte(hour.Format(time.RFC3339))
+		if data := hours.Get(key); data != nil {
+			var stored []SlowStatement
+			err = json.Unmarshal(data, &stored)
+			if err != nil {
+				return fmt.Errorf("could not decode the statements of hour %s: %s", key, err)
+			}
+			for _, s := range stored {
+				statements = p.addSlowStatement(statements, s)
+			}
+		}
+		data, err := json.Marshal(statements)
+		if err != nil {
+			return err
+		}
+		err = hours.Put(key, data)
+		if err != nil {
+			return err
+		}
+	}
+	p.pending = make(map[time.Time][]SlowStatement)
+
+	if p.newest.IsZero() {
+		return nil
+	}
+	cutoff := []byte(p.newest.UTC().Add(-p.retention).Truncate(time.Hour).Format(time.RFC3339))
+	for _, k := range shared.BucketKeysBefore(hours, cutoff) {
+		err = hours.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
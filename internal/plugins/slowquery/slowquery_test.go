@@ -0,0 +1,344 @@
+package slowquery
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var testBucket = []byte("plugin:slowquery")
+
+func openTestDB(t *testing.T) *bolt.DB {
+	t.Helper()
+	dbh, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbh.Close() })
+	err = dbh.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket(testBucket)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbh
+}
+
+func newTestPlugin(t *testing.T, dbh *bolt.DB, config map[string]interface{}) (*slowQueryPlugin, *prometheus.Registry) {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	p, err := newSlowQueryPlugin(shared.PluginInitArgs{
+		Name:               pluginName,
+		DBH:                dbh,
+		PrometheusRegistry: registry,
+		Config:             config,
+		Bucket:             testBucket,
+		LogTimezone:        time.UTC,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*slowQueryPlugin), registry
+}
+
+func checkpoint(t *testing.T, dbh *bolt.DB, p *slowQueryPlugin) {
+	t.Helper()
+	err := dbh.Update(func(tx *bolt.Tx) error {
+		return p.Checkpoint(tx, &shared.LogStreamPosition{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testRecord struct {
+	logTime     string
+	severity    string
+	application string
+	message     string
+}
+
+func (r testRecord) record() []string {
+	severity := r.severity
+	if severity == "" {
+		severity = "LOG"
+	}
+	return shared.LatestCSVLogSchema().NewRecord(map[int]string{
+		shared.LogTimeAttno:         r.logTime,
+		shared.UserNameAttno:        "u",
+		shared.DatabaseNameAttno:    "app",
+		shared.ErrorSeverityAttno:   severity,
+		shared.MessageAttno:         r.message,
+		shared.ApplicationNameAttno: r.application,
+	})
+}
+
+// Returns the number of observations in every series of the histogram, keyed
+// by the application and the kind of message.
+func histogramCounts(t *testing.T, registry *prometheus.Registry) map[string]uint64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]uint64)
+	for _, f := range families {
+		if f.GetName() != "pgfisher_slowquery_duration_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["database"] != "app" || labels["user"] != "u" || labels["plugin"] != pluginName {
+				t.Errorf("unexpected labels %v", labels)
+			}
+			counts[labels["application"]+"/"+labels["kind"]] = m.GetHistogram().GetSampleCount()
+		}
+	}
+	return counts
+}
+
+// Returns the durations of the slowest statements of every hour in the
+// bucket, keyed by the hour.
+func storedStatements(t *testing.T, dbh *bolt.DB) map[string][]float64 {
+	t.Helper()
+	stored := make(map[string][]float64)
+	err := dbh.View(func(tx *bolt.Tx) error {
+		hours := tx.Bucket(testBucket).Bucket(hoursBucket)
+		if hours == nil {
+			return nil
+		}
+		return hours.ForEach(func(k, v []byte) error {
+			var statements []SlowStatement
+			err := json.Unmarshal(v, &statements)
+			if err != nil {
+				return err
+			}
+			stored[string(k)] = []float64{}
+			for _, s := range statements {
+				stored[string(k)] = append(stored[string(k)], s.DurationMS)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestProcess(t *testing.T) {
+	testCases := []struct {
+		name    string
+		records []testRecord
+		// the observations per application and kind
+		expectedCounts map[string]uint64
+		// the statements kept for the hour starting at 13:00, slowest first
+		expectedStatements []string
+	}{
+		{
+			name: "statements",
+			records: []testRecord{
+				{"2024-10-01 13:00:01 UTC", "", "psql", "duration: 12.5 ms  statement: SELECT * FROM t WHERE id = 1"},
+				{"2024-10-01 13:00:02 UTC", "", "psql", "duration: 500 ms  statement: SELECT * FROM t WHERE id = 2"},
+				{"2024-10-01 13:00:03 UTC", "", "web", "duration: 0.5 ms  execute S_1: SELECT * FROM u WHERE id = $1"},
+			},
+			expectedCounts: map[string]uint64{"psql/statement": 2, "web/execute": 1},
+			expectedStatements: []string{
+				"500:select * from t where id = $1",
+				"12.5:select * from t where id = $1",
+				"0.5:select * from u where id = $1",
+			},
+		},
+		{
+			// with log_duration the statement isn't known, and plans are
+			// logged in addition to the statement
+			name: "observed but not kept",
+			records: []testRecord{
+				{"2024-10-01 13:00:01 UTC", "", "psql", "duration: 3.000 ms"},
+				{"2024-10-01 13:00:02 UTC", "", "psql", "duration: 900 ms  plan:\nQuery Text: SELECT 1\nResult  (cost=0.00..0.01 rows=1 width=4)"},
+			},
+			expectedCounts:     map[string]uint64{"psql/": 1, "psql/plan": 1},
+			expectedStatements: nil,
+		},
+		{
+			name: "not a duration",
+			records: []testRecord{
+				{"2024-10-01 13:00:01 UTC", "", "psql", "statement: SELECT 1"},
+				{"2024-10-01 13:00:02 UTC", "", "psql", "checkpoint starting: time"},
+				// only LOG messages carry durations
+				{"2024-10-01 13:00:03 UTC", "ERROR", "psql", "duration: 10 ms  statement: SELECT 1"},
+			},
+			expectedCounts:     map[string]uint64{},
+			expectedStatements: nil,
+		},
+		{
+			name: "only the slowest statements are kept",
+			records: []testRecord{
+				{"2024-10-01 13:00:01 UTC", "", "psql", "duration: 5 ms  statement: SELECT 5"},
+				{"2024-10-01 13:00:02 UTC", "", "psql", "duration: 1 ms  statement: SELECT 1"},
+				{"2024-10-01 13:00:03 UTC", "", "psql", "duration: 9 ms  statement: SELECT 9"},
+				{"2024-10-01 13:00:04 UTC", "", "psql", "duration: 3 ms  statement: SELECT 3"},
+				// in another hour
+				{"2024-10-01 14:00:00 UTC", "", "psql", "duration: 2 ms  statement: SELECT 2"},
+			},
+			expectedCounts:     map[string]uint64{"psql/statement": 5},
+			expectedStatements: []string{"9:select $1", "5:select $1", "3:select $1"},
+		},
+	}
+	hour := time.Date(2024, 10, 1, 13, 0, 0, 0, time.UTC)
+	for _, tc := range testCases {
+		p, registry := newTestPlugin(t, openTestDB(t), map[string]interface{}{"top_n": int64(3)})
+		for _, r := range tc.records {
+			err := p.Process(&shared.LogStreamPosition{}, r.record())
+			if err != nil {
+				t.Fatalf("%s: %s", tc.name, err)
+			}
+		}
+		counts := histogramCounts(t, registry)
+		if fmt.Sprint(counts) != fmt.Sprint(tc.expectedCounts) {
+			t.Errorf("%s: got observations %v; expected %v", tc.name, counts, tc.expectedCounts)
+		}
+		var statements []string
+		for _, s := range p.pending[hour] {
+			statements = append(statements, fmt.Sprintf("%g:%s", s.DurationMS, s.Statement))
+		}
+		if strings.Join(statements, "|") != strings.Join(tc.expectedStatements, "|") {
+			t.Errorf("%s: got statements %q; expected %q", tc.name, statements, tc.expectedStatements)
+		}
+	}
+}
+
+func TestAddSlowStatement(t *testing.T) {
+	testCases := []struct {
+		durations []float64
+		expected  []float64
+	}{
+		{[]float64{1}, []float64{1}},
+		{[]float64{1, 2, 3}, []float64{3, 2, 1}},
+		{[]float64{3, 1, 2, 5, 4}, []float64{5, 4, 3}},
+		// not slower than the slowest ones kept
+		{[]float64{3, 2, 1, 1, 0.5}, []float64{3, 2, 1}},
+		// a statement as slow as one kept goes after it
+		{[]float64{2, 2, 2, 2}, []float64{2, 2, 2}},
+	}
+	p := &slowQueryPlugin{topN: 3}
+	for _, tc := range testCases {
+		var statements []SlowStatement
+		for i, d := range tc.durations {
+			statements = p.addSlowStatement(statements, SlowStatement{DurationMS: d, Statement: fmt.Sprint(i)})
+		}
+		var got []float64
+		for _, s := range statements {
+			got = append(got, s.DurationMS)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+			t.Errorf("addSlowStatement(%v) = %v; expected %v", tc.durations, got, tc.expected)
+		}
+		if len(tc.durations) == 4 && statements[0].Statement != "0" {
+			t.Errorf("the earlier of two equally slow statements was replaced")
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dbh := openTestDB(t)
+	config := map[string]interface{}{
+		"top_n":            int64(2),
+		"retention":        "2h",
+		"max_applications": int64(1),
+	}
+	process := func(p *slowQueryPlugin, records ...testRecord) {
+		for _, r := range records {
+			err := p.Process(&shared.LogStreamPosition{}, r.record())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	p, registry := newTestPlugin(t, dbh, config)
+	process(p,
+		testRecord{"2024-10-01 10:30:00 UTC", "", "batch", "duration: 100 ms  statement: SELECT 100"},
+		testRecord{"2024-10-01 12:10:00 UTC", "", "batch", "duration: 4 ms  statement: SELECT 4"},
+		testRecord{"2024-10-01 12:20:00 UTC", "", "web", "duration: 2 ms  statement: SELECT 2"},
+		testRecord{"2024-10-01 12:30:00 UTC", "", "web", "duration: 1 ms  statement: SELECT 1"},
+		testRecord{"2024-10-01 12:35:00 UTC", "", "web", "duration: 0.1 ms  statement: SELECT 0.1"},
+	)
+	// the first application seen gets a series of its own
+	counts := histogramCounts(t, registry)
+	if fmt.Sprint(counts) != fmt.Sprint(map[string]uint64{"batch/statement": 2, "other/statement": 3}) {
+		t.Errorf("got observations %v before the checkpoint", counts)
+	}
+	checkpoint(t, dbh, p)
+	expected := map[string][]float64{
+		"2024-10-01T10:00:00Z": {100},
+		"2024-10-01T12:00:00Z": {4, 2},
+	}
+	if got := storedStatements(t, dbh); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("got %v after the first checkpoint; expected %v", got, expected)
+	}
+	// web is now the most common application, and replaces batch
+	counts = histogramCounts(t, registry)
+	if fmt.Sprint(counts) != fmt.Sprint(map[string]uint64{"other/statement": 3}) {
+		t.Errorf("got observations %v after the checkpoint", counts)
+	}
+
+	// A new plugin carries on from the state in the bucket: the
+	// statements are merged with the ones stored, and the hours older than
+	// the retention are removed.
+	p, registry = newTestPlugin(t, dbh, config)
+	process(p,
+		testRecord{"2024-10-01 12:40:00 UTC", "", "web", "duration: 3 ms  statement: SELECT 3"},
+		testRecord{"2024-10-01 12:50:00 UTC", "", "batch", "duration: 0.5 ms  statement: SELECT 0.5"},
+		testRecord{"2024-10-01 13:00:00 UTC", "", "web", "duration: 7 ms  statement: SELECT 7"},
+	)
+	counts = histogramCounts(t, registry)
+	if fmt.Sprint(counts) != fmt.Sprint(map[string]uint64{"other/statement": 1, "web/statement": 2}) {
+		t.Errorf("got observations %v after reloading", counts)
+	}
+	checkpoint(t, dbh, p)
+	expected = map[string][]float64{
+		"2024-10-01T12:00:00Z": {4, 3},
+		"2024-10-01T13:00:00Z": {7},
+	}
+	if got := storedStatements(t, dbh); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("got %v after the second checkpoint; expected %v", got, expected)
+	}
+	if len(p.pending) != 0 {
+		t.Errorf("Checkpoint left %d hours pending", len(p.pending))
+	}
+}
+
+func TestNewSlowQueryPluginConfig(t *testing.T) {
+	for _, config := range []map[string]interface{}{
+		{"top_n": int64(0)},
+		{"max_statement_length": int64(-1)},
+		{"retention": "0s"},
+		{"max_applications": int64(0)},
+		{"buckets": "1"},
+		{"no_such_setting": int64(1)},
+	} {
+		_, err := newSlowQueryPlugin(shared.PluginInitArgs{
+			Name:               pluginName,
+			DBH:                openTestDB(t),
+			PrometheusRegistry: prometheus.NewRegistry(),
+			Config:             config,
+			Bucket:             testBucket,
+			LogTimezone:        time.UTC,
+		})
+		if err == nil {
+			t.Errorf("newSlowQueryPlugin accepted %v", config)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// Package statements implements a plugin which aggregates the durations of
+// the statements logged because of log_min_duration_statement into
+// statistics similar to the ones in pg_stat_statements: the number of calls,
+// and the total, minimum, maximum, mean and standard deviation of their
+// execution time per normalized statement, database and user.  Note that
+// only the statements which were logged are counted, so unless
+// log_min_duration_statement is 0, the statistics only cover the slow ones.
+//
+// The statistics are kept per window of time in the plugin's bucket, so they
+// survive restarts.  The bucket contains a bucket called "windows", which
+// contains a bucket for every window, named after the beginning of the window
+// in UTC in RFC 3339 format, e.g. "2024-10-01T13:00:00Z".  In it, the key is
+// the fingerprint, database and user separated by NUL bytes, and the value
+// is a StatementStats in JSON.  ReadTop reads them.
+//
+// If pgfisher serves metrics over HTTP, the top statements are also served
+// in JSON at /plugins/NAME/top, where NAME is the name of the plugin.  The
+// query parameters order (one of the Order constants, default "total"),
+// limit (default 20), and since and until (in RFC 3339 format) correspond to
+// the fields of TopOptions.
+//
+// Settings:
+//
+//	window             the length of the windows (default "1h")
+//	retention          how long to keep the windows for, relative to the
+//	                   newest record (default "168h")
+//	max_query_length   how many bytes of the queries to keep (default 4096)
+package statements
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	shared "github.com/johto/pgfisher/internal/plugin_interface"
+	bolt "go.etcd.io/bbolt"
+)
+
+// PluginName is the name the plugin is registered under.
+const PluginName = "statements"
+
+const (
+	defaultWindow         = time.Hour
+	defaultRetention      = 7 * 24 * time.Hour
+	defaultMaxQueryLength = 4096
+
+	// How many statements are listed if no limit is given, both by the HTTP
+	// endpoint and by pgfisher top
+	DefaultLimit = 20
+)
+
+var windowsBucket = []byte("windows")
+
+func init() {
+	shared.RegisterPlugin(PluginName, newStatementsPlugin)
+}
+
+type statementsPlugin struct {
+	dbh            *bolt.DB
+	bucket         []byte
+	logTimezone    *time.Location
+	window         time.Duration
+	retention      time.Duration
+	maxQueryLength int
+
+	// Protects pending and newest, which are also read by the HTTP handler.
+	lock sync.Mutex
+	// The statistics collected since the last checkpoint by the beginning of
+	// their window and key.  Merged with the ones in the bucket in
+	// Checkpoint.
+	pending map[time.Time]map[string]*StatementStats
+	// The log_time of the newest record seen so far
+	newest time.Time
+}
+
+func newStatementsPlugin(args shared.PluginInitArgs) (shared.Plugin, error) {
+	err := shared.CheckConfigKeys(args.Config, "window", "retention", "max_query_length")
+	if err != nil {
+		return nil, err
+	}
+	window, err := shared.ConfigDuration(args.Config, "window", defaultWindow)
+	if err != nil {
+		return nil, err
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid window %s; must be positive", window)
+	}
+	retention, err := shared.ConfigDuration(args.Config, "retention", defaultRetention)
+	if err != nil {
+		return nil, err
+	}
+	if retention <= 0 {
+		return nil, fmt.Errorf("invalid retention %s; must be positive", retention)
+	}
+	maxQueryLength, err := shared.ConfigInt(args.Config, "max_query_length", defaultMaxQueryLength)
+	if err != nil {
+		return nil, err
+	}
+	if maxQueryLength <= 0 {
+		return nil, fmt.Errorf("invalid max_query_length %d; must be positive", maxQueryLength)
+	}
+
+	p := &statementsPlugin{
+		dbh:            args.DBH,
+		bucket:         args.Bucket,
+		logTimezone:    args.LogTimezone,
+		window:         window,
+		retention:      retention,
+		maxQueryLength: int(maxQueryLength),
+		pending:        make(map[time.Time]map[string]*StatementStats),
+	}
+	if args.HTTPMux != nil {
+		args.HTTPMux.Handle("/plugins/"+args.Name+"/top", p)
+	}
+	return p, nil
+}
+
+func (p *statementsPlugin) Process(streamPos *shared.LogStreamPosition, record []string) error {
+	le, err := shared.NewLogEntry(record)
+	if err != nil {
+		return err
+	}
+	if le.ErrorSeverity() != "LOG" {
+		return nil
+	}
+	msg, ok := shared.ParseDurationMessage(le.Message())
+	if !ok {
+		return nil
+	}
+	// Only count each execution once; the durations of the parse and bind
+	// steps are logged separately.
+	switch msg.Kind {
+	case shared.DurationKindStatement, shared.DurationKindExecute, shared.DurationKindExecuteFetch:
+	default:
+		return nil
+	}
+	logTime, err := le.LogTime(p.logTimezone)
+	if err != nil {
+		return err
+	}
+
+	fingerprint, query := shared.Fingerprint(msg.Text)
+	key := StatementStats{
+		Fingerprint: fingerprint,
+		Database:    le.DatabaseName(),
+		User:        le.UserName(),
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if logTime.After(p.newest) {
+		p.newest = logTime
+	}
+	windowStart := logTime.UTC().Truncate(p.window)
+	window := p.pending[windowStart]
+	if window == nil {
+		window = make(map[string]*StatementStats)
+		p.pending[windowStart] = window
+	}
+	stats := window[string(key.key())]
+	if stats == nil {
+		stats = &key
+		stats.Query = shared.TruncateUTF8(query, p.maxQueryLength)
+		stats.SampleQuery = shared.TruncateUTF8(msg.Text, p.maxQueryLength)
+		window[string(key.key())] = stats
+	}
+	stats.addCall(float64(msg.Duration) / float64(time.Millisecond))
+	return nil
+}
+
+func (p *statementsPlugin) Checkpoint(tx *bolt.Tx, streamPos *shared.LogStreamPosition) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	windows, err := tx.Bucket(p.bucket).CreateBucketIfNotExists(windowsBucket)
+	if err != nil {
+		return err
+	}
+	for windowStart, pending := range p.pending {
+		window, err := windows.CreateBucketIfNotExists([]byte(windowStart.Format(time.RFC3339)))
+		if err != nil {
+			return err
+		}
+		for key, stats := range pending {
+			if data := window.Get([]byte(key)); data != nil {
+				var stored StatementStats
+				err = json.Unmarshal(data, &stored)
+				if err != nil {
+					return fmt.Errorf("could not decode the statistics of statement %q: %s", key, err)
+				}
+				stored.merge(stats)
+				stats = &stored
+			}
+			data, err := json.Marshal(stats)
+			if err != nil {
+				return err
+			}
+			err = window.Put([]byte(key), data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	p.pending = make(map[time.Time]map[string]*StatementStats)
+
+	if p.newest.IsZero() {
+		return nil
+	}
+	cutoff := []byte(p.newest.UTC().Add(-p.retention).Truncate(p.window).Format(time.RFC3339))
+	for _, k := range shared.BucketKeysBefore(windows, cutoff) {
+		err = windows.DeleteBucket(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the top statements, including the ones processed since
+// the last checkpoint.
+func (p *statementsPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseTopQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A checkpoint in between reading the bucket and the pending statistics
+	// would count the statistics it moves twice or not at all.
+	p.lock.Lock()
+	var merged map[string]*StatementStats
+	err = p.dbh.View(func(tx *bolt.Tx) error {
+		merged, err = readMerged(tx, p.bucket, opts)
+		return err
+	})
+	if err == nil {
+		for windowStart, pending := range p.pending {
+			if !windowSelected(windowStart, opts) {
+				continue
+			}
+			for _, stats := range pending {
+				addMerged(merged, stats)
+			}
+		}
+	}
+	p.lock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sortTop(merged, opts))
+}
+
+func parseTopQuery(r *http.Request) (TopOptions, error) {
+	query := r.URL.Query()
+	opts := TopOptions{
+		Order: OrderTotal,
+		Limit: DefaultLimit,
+	}
+	if order := query.Get("order"); order != "" {
+		err := CheckOrder(order)
+		if err != nil {
+			return TopOptions{}, err
+		}
+		opts.Order = order
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return TopOptions{}, fmt.Errorf("invalid limit %q", limit)
+		}
+		opts.Limit = n
+	}
+	for _, param := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &opts.Since}, {"until", &opts.Until}} {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return TopOptions{}, fmt.Errorf("invalid %s %q: %s", param.name, value, err)
+		}
+		*param.t = t
+	}
+	return opts, nil
+}
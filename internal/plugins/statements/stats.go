@@ -0,0 +1,214 @@
+package statements
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// StatementStats are the statistics of a statement during a window, or during
+// several windows once merged.
+type StatementStats struct {
+	// From shared.Fingerprint
+	Fingerprint string `json:"fingerprint"`
+	Query       string `json:"query"`
+	Database    string `json:"database"`
+	User        string `json:"user"`
+	// One of the statements with this fingerprint, as it was logged
+	SampleQuery string `json:"sampleQuery"`
+
+	Calls   int64   `json:"calls"`
+	TotalMS float64 `json:"totalMs"`
+	MinMS   float64 `json:"minMs"`
+	MaxMS   float64 `json:"maxMs"`
+	// The sum of the squared differences of the durations from their mean,
+	// for computing StddevMS.  It's updated incrementally like in
+	// pg_stat_statements, since a plain sum of squares loses precision when
+	// the durations are large compared to their spread.
+	SumVarMS float64 `json:"sumVarMs"`
+
+	// Derived from the above
+	MeanMS   float64 `json:"meanMs"`
+	StddevMS float64 `json:"stddevMs"`
+}
+
+// The key of the statistics of a statement in the bucket of its window.
+func (s *StatementStats) key() []byte {
+	return []byte(s.Fingerprint + "\x00" + s.Database + "\x00" + s.User)
+}
+
+func (s *StatementStats) addCall(durationMS float64) {
+	if s.Calls == 0 || durationMS < s.MinMS {
+		s.MinMS = durationMS
+	}
+	if s.Calls == 0 || durationMS > s.MaxMS {
+		s.MaxMS = durationMS
+	}
+	oldMean := s.mean()
+	s.Calls++
+	s.TotalMS += durationMS
+	s.SumVarMS += (durationMS - oldMean) * (durationMS - s.mean())
+	s.updateDerived()
+}
+
+func (s *StatementStats) merge(other *StatementStats) {
+	if other.Calls == 0 {
+		return
+	}
+	if s.Calls == 0 || other.MinMS < s.MinMS {
+		s.MinMS = other.MinMS
+	}
+	if s.Calls == 0 || other.MaxMS > s.MaxMS {
+		s.MaxMS = other.MaxMS
+	}
+	if s.SampleQuery == "" {
+		s.SampleQuery = other.SampleQuery
+	}
+	// the parallel variant of the incremental update in addCall
+	delta := other.mean() - s.mean()
+	calls := s.Calls + other.Calls
+	s.SumVarMS += other.SumVarMS + delta*delta*float64(s.Calls)*float64(other.Calls)/float64(calls)
+	s.Calls = calls
+	s.TotalMS += other.TotalMS
+	s.updateDerived()
+}
+
+func (s *StatementStats) mean() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.TotalMS / float64(s.Calls)
+}
+
+// Computes the mean and the population standard deviation, like
+// pg_stat_statements does.
+func (s *StatementStats) updateDerived() {
+	s.MeanMS = s.mean()
+	// rounding errors can make the variance slightly negative
+	s.StddevMS = math.Sqrt(math.Max(s.SumVarMS/float64(s.Calls), 0))
+}
+
+// The orders ReadTop can sort the statements in.
+const (
+	OrderTotal = "total"
+	OrderMean  = "mean"
+	OrderMax   = "max"
+	OrderCalls = "calls"
+)
+
+// TopOptions selects the statements returned by ReadTop.
+type TopOptions struct {
+	// Only windows beginning at or after Since and before Until are
+	// included.  Either can be zero, meaning no limit.
+	Since time.Time
+	Until time.Time
+	// One of the Order constants; the statements are sorted by it in
+	// descending order.
+	Order string
+	// The maximum number of statements to return
+	Limit int
+}
+
+// CheckOrder returns an error if order is not one of the Order constants.
+func CheckOrder(order string) error {
+	switch order {
+	case OrderTotal, OrderMean, OrderMax, OrderCalls:
+		return nil
+	default:
+		return fmt.Errorf("invalid order %q; must be %q, %q, %q or %q", order, OrderTotal, OrderMean, OrderMax, OrderCalls)
+	}
+}
+
+// ReadTop merges the statistics in the windows selected by opts in the
+// plugin's bucket, called bucketName, and returns the top statements.
+func ReadTop(tx *bolt.Tx, bucketName []byte, opts TopOptions) ([]*StatementStats, error) {
+	merged, err := readMerged(tx, bucketName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sortTop(merged, opts), nil
+}
+
+// Returns the statistics in the windows selected by opts merged by statement.
+func readMerged(tx *bolt.Tx, bucketName []byte, opts TopOptions) (map[string]*StatementStats, error) {
+	bucket := tx.Bucket(bucketName)
+	if bucket == nil {
+		return nil, fmt.Errorf("bucket %q does not exist", bucketName)
+	}
+	merged := make(map[string]*StatementStats)
+	windows := bucket.Bucket(windowsBucket)
+	if windows == nil {
+		return merged, nil
+	}
+	err := windows.ForEach(func(k, v []byte) error {
+		start, err := time.Parse(time.RFC3339, string(k))
+		if err != nil {
+			return fmt.Errorf("invalid window %q", k)
+		}
+		if !windowSelected(start, opts) {
+			return nil
+		}
+		return windows.Bucket(k).ForEach(func(k, v []byte) error {
+			var stats StatementStats
+			err := json.Unmarshal(v, &stats)
+			if err != nil {
+				return fmt.Errorf("could not decode the statistics of statement %q: %s", k, err)
+			}
+			addMerged(merged, &stats)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+func windowSelected(start time.Time, opts TopOptions) bool {
+	return (opts.Since.IsZero() || !start.Before(opts.Since)) &&
+		(opts.Until.IsZero() || start.Before(opts.Until))
+}
+
+func addMerged(merged map[string]*StatementStats, stats *StatementStats) {
+	key := string(stats.key())
+	if existing, ok := merged[key]; ok {
+		existing.merge(stats)
+	} else {
+		s := *stats
+		merged[key] = &s
+	}
+}
+
+func sortTop(merged map[string]*StatementStats, opts TopOptions) []*StatementStats {
+	top := make([]*StatementStats, 0, len(merged))
+	for _, stats := range merged {
+		top = append(top, stats)
+	}
+	value := func(s *StatementStats) float64 {
+		switch opts.Order {
+		case OrderMean:
+			return s.MeanMS
+		case OrderMax:
+			return s.MaxMS
+		case OrderCalls:
+			return float64(s.Calls)
+		default:
+			return s.TotalMS
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		vi, vj := value(top[i]), value(top[j])
+		if vi != vj {
+			return vi > vj
+		}
+		return string(top[i].key()) < string(top[j].key())
+	})
+	if opts.Limit > 0 && len(top) > opts.Limit {
+		top = top[:opts.Limit]
+	}
+	return top
+}
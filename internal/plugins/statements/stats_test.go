@@ -0,0 +1,243 @@
+package statements
+
+import (
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func floatsEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+// Checks the statistics against the ones computed directly from durations.
+func checkStats(t *testing.T, name string, s *StatementStats, durations []float64) {
+	t.Helper()
+	var total, min, max float64
+	for i, d := range durations {
+		total += d
+		if i == 0 || d < min {
+			min = d
+		}
+		if i == 0 || d > max {
+			max = d
+		}
+	}
+	mean := total / float64(len(durations))
+	var squaredDeviations float64
+	for _, d := range durations {
+		squaredDeviations += (d - mean) * (d - mean)
+	}
+	stddev := math.Sqrt(squaredDeviations / float64(len(durations)))
+
+	if s.Calls != int64(len(durations)) || !floatsEqual(s.TotalMS, total) ||
+		s.MinMS != min || s.MaxMS != max ||
+		!floatsEqual(s.MeanMS, mean) || !floatsEqual(s.StddevMS, stddev) {
+		t.Errorf("%s: got calls %d, total %g, min %g, max %g, mean %g, stddev %g; expected %d, %g, %g, %g, %g, %g",
+			name, s.Calls, s.TotalMS, s.MinMS, s.MaxMS, s.MeanMS, s.StddevMS,
+			len(durations), total, min, max, mean, stddev)
+	}
+}
+
+func TestStatementStatsAddCall(t *testing.T) {
+	testCases := []struct {
+		name      string
+		durations []float64
+	}{
+		{"one call", []float64{12.5}},
+		{"several calls", []float64{1, 2, 3, 4}},
+		{"decreasing", []float64{4, 3, 2, 1}},
+		{"zero durations", []float64{0, 0, 5}},
+		// rounding errors can make the variance come out slightly negative
+		{"identical durations", []float64{0.1, 0.1, 0.1}},
+		// a sum of squares would lose the precision needed here
+		{"large durations", []float64{1e6, 1e6 + 1, 1e6 + 2}},
+	}
+	for _, tc := range testCases {
+		var s StatementStats
+		for _, d := range tc.durations {
+			s.addCall(d)
+		}
+		checkStats(t, tc.name, &s, tc.durations)
+		if math.IsNaN(s.StddevMS) {
+			t.Errorf("%s: stddev is NaN", tc.name)
+		}
+	}
+}
+
+func TestStatementStatsMerge(t *testing.T) {
+	durations := []float64{5, 1, 9, 3, 3, 7, 0.5, 12}
+	// Merging the statistics of any split of the calls gives the same
+	// result as adding the calls one by one.
+	for split := 0; split <= len(durations); split++ {
+		a := StatementStats{SampleQuery: "SELECT 1"}
+		b := StatementStats{SampleQuery: "SELECT 2"}
+		for _, d := range durations[:split] {
+			a.addCall(d)
+		}
+		for _, d := range durations[split:] {
+			b.addCall(d)
+		}
+		a.merge(&b)
+		checkStats(t, "merge", &a, durations)
+		if a.SampleQuery != "SELECT 1" {
+			t.Errorf("merge replaced the sample query with %q", a.SampleQuery)
+		}
+	}
+
+	// merging statistics without calls changes nothing
+	var s StatementStats
+	s.addCall(3)
+	s.merge(&StatementStats{MinMS: 0, MaxMS: 0})
+	checkStats(t, "merge without calls", &s, []float64{3})
+
+	// merging into empty statistics copies them
+	empty := StatementStats{}
+	empty.merge(&s)
+	checkStats(t, "merge into empty", &empty, []float64{3})
+
+	// the sample query is taken from the other statistics if missing
+	withoutSample := StatementStats{}
+	withoutSample.merge(&StatementStats{SampleQuery: "SELECT 3", Calls: 1, TotalMS: 1, MinMS: 1, MaxMS: 1, SumVarMS: 0})
+	if withoutSample.SampleQuery != "SELECT 3" {
+		t.Errorf("merge did not take the sample query; got %q", withoutSample.SampleQuery)
+	}
+}
+
+func TestCheckOrder(t *testing.T) {
+	for _, order := range []string{OrderTotal, OrderMean, OrderMax, OrderCalls} {
+		if err := CheckOrder(order); err != nil {
+			t.Errorf("CheckOrder(%q): %s", order, err)
+		}
+	}
+	for _, order := range []string{"", "min", "Total"} {
+		if err := CheckOrder(order); err == nil {
+			t.Errorf("CheckOrder(%q) did not return an error", order)
+		}
+	}
+}
+
+func TestReadTop(t *testing.T) {
+	dbh, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbh.Close()
+	bucketName := []byte("plugin:statements")
+
+	hour1 := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	hour2 := hour1.Add(time.Hour)
+	hour3 := hour2.Add(time.Hour)
+	newStats := func(fingerprint string, user string, durations ...float64) *StatementStats {
+		s := &StatementStats{Fingerprint: fingerprint, Query: "query " + fingerprint, Database: "app", User: user}
+		for _, d := range durations {
+			s.addCall(d)
+		}
+		return s
+	}
+	windows := map[time.Time][]*StatementStats{
+		hour1: {newStats("a", "u", 100), newStats("b", "u", 1, 1, 1, 1)},
+		hour2: {newStats("a", "u", 10, 10), newStats("b", "u", 1), newStats("c", "u", 50)},
+		// the same statement run by another user is counted separately
+		hour3: {newStats("a", "other", 1000)},
+	}
+	err = dbh.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket(bucketName)
+		if err != nil {
+			return err
+		}
+		windowsB, err := bucket.CreateBucket(windowsBucket)
+		if err != nil {
+			return err
+		}
+		for start, stats := range windows {
+			window, err := windowsB.CreateBucket([]byte(start.Format(time.RFC3339)))
+			if err != nil {
+				return err
+			}
+			for _, s := range stats {
+				data, err := json.Marshal(s)
+				if err != nil {
+					return err
+				}
+				err = window.Put(s.key(), data)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name string
+		opts TopOptions
+		// fingerprint/user and calls of each statement returned, in order
+		expected []string
+	}{
+		{"total", TopOptions{Order: OrderTotal}, []string{"a/other:1", "a/u:3", "c/u:1", "b/u:5"}},
+		{"mean", TopOptions{Order: OrderMean}, []string{"a/other:1", "c/u:1", "a/u:3", "b/u:5"}},
+		{"max", TopOptions{Order: OrderMax}, []string{"a/other:1", "a/u:3", "c/u:1", "b/u:5"}},
+		{"calls", TopOptions{Order: OrderCalls}, []string{"b/u:5", "a/u:3", "a/other:1", "c/u:1"}},
+		{"limit", TopOptions{Order: OrderCalls, Limit: 2}, []string{"b/u:5", "a/u:3"}},
+		{"since", TopOptions{Order: OrderTotal, Since: hour2}, []string{"a/other:1", "c/u:1", "a/u:2", "b/u:1"}},
+		{"until", TopOptions{Order: OrderTotal, Until: hour2}, []string{"a/u:1", "b/u:4"}},
+		{"since and until", TopOptions{Order: OrderTotal, Since: hour2, Until: hour3}, []string{"c/u:1", "a/u:2", "b/u:1"}},
+		{"nothing selected", TopOptions{Order: OrderTotal, Since: hour3.Add(time.Hour)}, []string{}},
+	}
+	for _, tc := range testCases {
+		var top []*StatementStats
+		err := dbh.View(func(tx *bolt.Tx) error {
+			var err error
+			top, err = ReadTop(tx, bucketName, tc.opts)
+			return err
+		})
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		got := make([]string, 0, len(top))
+		for _, s := range top {
+			got = append(got, s.Fingerprint+"/"+s.User+":"+strconv.FormatInt(s.Calls, 10))
+		}
+		if len(got) != len(tc.expected) {
+			t.Errorf("%s: got %q; expected %q", tc.name, got, tc.expected)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.expected[i] {
+				t.Errorf("%s: got %q; expected %q", tc.name, got, tc.expected)
+				break
+			}
+		}
+	}
+
+	// the merged statistics of a/u over all windows
+	err = dbh.View(func(tx *bolt.Tx) error {
+		top, err := ReadTop(tx, bucketName, TopOptions{Order: OrderTotal})
+		if err != nil {
+			return err
+		}
+		checkStats(t, "merged a/u", top[1], []float64{100, 10, 10})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dbh.View(func(tx *bolt.Tx) error {
+		_, err := ReadTop(tx, []byte("no such bucket"), TopOptions{Order: OrderTotal})
+		return err
+	})
+	if err == nil {
+		t.Errorf("ReadTop did not return an error for a missing bucket")
+	}
+}